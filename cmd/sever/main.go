@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"octopus/config"
+	"time"
 
 	_ "octopus/example/proto/proto_menu"
 	"octopus/mash"
@@ -38,6 +39,15 @@ func NewCustomUrlHttpMash() *mash.HttpMash {
 	)
 }
 
+func NewReflectHttpMash() *mash.HttpMash {
+	return mash.NewHttpMash(
+		mash.WithHttpRouter(
+			service.WithRegCenter(regcenter.NewReflectCenter("./config2.json", time.Minute)),
+		),
+		mash.WithHttpListenPort(":9000"),
+	)
+}
+
 func NewGrpcMash() *mash.GrpcMash {
 	return mash.NewGrpcMash(
 		mash.WithGrpcRouter(
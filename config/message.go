@@ -3,22 +3,52 @@ package config
 import "os"
 
 const (
-	NOHOST           = "no host here"
-	NOROUTER         = "no router here"
-	HOOKHOST         = "the host: %v not in the hookwhite list"
-	NOMESSAGETABLE   = "Please add the Proto Message Table"
-	IPLIMITED        = "the IP is limited"
-	BUCKETEMPTY      = "the token bucket is empty"
-	NOPOOL           = "no grpc connect pool"
-	WRONGPATHPATTERN = "wrong url pattern"
-	WRONGPATH        = "%v is wrong url"
-	GRPCPROXYEORROR  = "gRPC proxying error"
-	GRPCPATHEORROR   = "path is wrong"
-	SYSTEMERROR      = "sysem error"
-	CONFIGFILEERROR  = "fatal error config file: %v"
-	RELOADROUTER     = "DO not reload the router"
-	IPADDRERROR      = "Bad data"
-	NOPROTOMESSAGE   = "the proto message name : %v not in the prototable"
+	NOHOST            = "no host here"
+	NOROUTER          = "no router here"
+	NOROUTERHOST      = "no host for the router : %v"
+	NOCLUSTER         = "no cluster %v for the router : %v"
+	NOCLUSTERHOST     = "no host for the cluster : %v"
+	WRONGCLUSTER      = "the cluster name : %q is empty or duplicated"
+	WRONGSPLIT        = "the split weight of the router : %v is negative or the total is 0"
+	WRONGRETRY        = "the retry policy of the router : %v is wrong : %v"
+	WRONGTIMEOUT      = "the timeout of the router : %v is wrong : %v"
+	HOOKHOST          = "the host: %v not in the hookwhite list"
+	NOMESSAGETABLE    = "Please add the Proto Message Table"
+	IPLIMITED         = "the IP is limited"
+	BUCKETEMPTY       = "the token bucket is empty"
+	NOPOOL            = "no grpc connect pool"
+	WRONGPATHPATTERN  = "wrong url pattern"
+	WRONGPATH         = "%v is wrong url"
+	GRPCPROXYEORROR   = "gRPC proxying error"
+	GRPCPATHEORROR    = "path is wrong"
+	SYSTEMERROR       = "sysem error"
+	CONFIGFILEERROR   = "fatal error config file: %v"
+	RELOADROUTER      = "the router is reloaded, the old router is stopped"
+	IPADDRERROR       = "Bad data"
+	NOPROTOMESSAGE    = "the proto message name : %v not in the prototable"
+	WRONGTEMPLATE     = "%v is wrong http rule template"
+	NOPROTODESCRIPTOR = "the proto descriptor : %v not in the registry"
+	WEBSOCKETONLY     = "the client streaming method only can be called by the websocket"
+	WEBSOCKETORIGIN   = "the origin %v is not allowed to open the websocket"
+	WEBCONTENTTYPE    = "the content type : %v is not supported by the grpc web"
+	WEBMETHOD         = "the http method : %v is not supported by the grpc web"
+	WEBENCODING       = "the encoding : %v is not supported by the grpc web"
+	HOSTUNHEALTHY     = "the host %v is unhealthy : %v"
+	HOSTHEALTHY       = "the host %v is healthy"
+	HOSTKEPT          = "the host %v is kept in the balance, the healthy hosts would be under %v%% : %v"
+	HOSTNOTSERVING    = "the service %q is %v"
+	HOSTEJECTED       = "the host %v is ejected for %v : %v"
+	HOSTRETURNED      = "the host %v is returned to the balance"
+	MIRRORED          = "the request %v is mirrored to %v : %v in %v"
+	MIRRORSTOPPED     = "the mirror is stopped"
+	RETRYREQUEST      = "retry the request %v (attempt %v) on %v : %v"
+	CIRCUITOPEN       = "the circuit of the %v %v is open"
+	CIRCUITCHANGED    = "the circuit of the %v %v is changed from %v to %v"
+	CONCURRENCYFULL   = "the concurrency limit of the partition %v is full"
+	RATELIMITED       = "the rate limit is exceeded"
+	RATELIMITSTORE    = "the rate limit store is failed, the request is allowed : %v"
+	RULELIMITED       = "the rate limit of the rule %v is exceeded"
+	RATELIMITRULES    = "the rate limit rules %v are reloaded"
 )
 
 type MashType string
@@ -47,8 +77,11 @@ const (
 type BalanceType string
 
 const (
-	RoundRobin  BalanceType = "RoundRobin"
-	WeightRobin BalanceType = "WeightRobin"
+	RoundRobin     BalanceType = "RoundRobin"
+	WeightRobin    BalanceType = "WeightRobin"
+	LeastRequest   BalanceType = "LeastRequest"
+	P2CEWMA        BalanceType = "P2CEWMA"
+	ConsistentHash BalanceType = "ConsistentHash"
 )
 
 var (
@@ -0,0 +1,221 @@
+package mash
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"octopus/config"
+	meta "octopus/metadata"
+	"strings"
+	"unicode"
+
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	//the end stream flag of the connect envelope
+	connectendstream = 0x02
+)
+
+/*
+the error of the connect protocol
+*/
+type connecterror struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Details []connectdetail `json:"details,omitempty"`
+}
+
+type connectdetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func newconnecterror(st *status.Status) *connecterror {
+	ce := &connecterror{
+		Code:    connectcode(st.Code()),
+		Message: st.Message(),
+	}
+	for _, detail := range st.Proto().GetDetails() {
+		url := detail.GetTypeUrl()
+		ce.Details = append(ce.Details, connectdetail{
+			Type:  url[strings.LastIndex(url, "/")+1:],
+			Value: base64.RawStdEncoding.EncodeToString(detail.GetValue()),
+		})
+	}
+	return ce
+}
+
+/*
+the connect code is the snake case of the grpc code name, such as NotFound is not_found
+*/
+func connectcode(code codes.Code) string {
+	var sb strings.Builder
+	for i, r := range code.String() {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func connectcompressed(r *http.Request, key string) error {
+	if encoding := r.Header.Get(key); encoding != "" && encoding != "identity" {
+		return status.Errorf(codes.Unimplemented, config.WEBENCODING, encoding)
+	}
+	return nil
+}
+
+/*
+the unary call of the connect protocol (application/proto and application/json),
+the body is the message without the envelope and the error is written as the json with the http status code
+*/
+type connectunary struct {
+	contenttype string
+	codec       *messagecodec
+	respheader  http.Header
+	msg         []byte
+}
+
+func (p *connectunary) request(r *http.Request) (io.Reader, error) {
+	if err := connectcompressed(r, "Content-Encoding"); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if b, err = p.codec.decode(b); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(grpcframe(0, b)), nil
+}
+
+func (p *connectunary) header(w http.ResponseWriter, header http.Header) {
+	p.respheader = header
+}
+
+func (p *connectunary) message(w http.ResponseWriter, flag byte, msg []byte) error {
+	if flag&compressedflag != 0 {
+		return status.Errorf(codes.Internal, config.WEBENCODING, "grpc-encoding")
+	}
+	b, err := p.codec.encode(msg)
+	if err != nil {
+		return err
+	}
+	p.msg = b
+	return nil
+}
+
+func (p *connectunary) trailer(w http.ResponseWriter, st *status.Status, trailer metadata.MD) {
+	header := w.Header()
+	copyheader(header, p.respheader)
+	for k, vv := range trailer {
+		for _, v := range vv {
+			header.Add("Trailer-"+k, v)
+		}
+	}
+	if st.Code() != codes.OK {
+		json := jsoniter.ConfigCompatibleWithStandardLibrary
+		b, _ := json.Marshal(newconnecterror(st))
+		header.Set("Content-Type", "application/json")
+		w.WriteHeader(meta.HttpStatusFromCode(st.Code()))
+		w.Write(b)
+		return
+	}
+	header.Set("Content-Type", p.contenttype)
+	w.WriteHeader(http.StatusOK)
+	w.Write(p.msg)
+}
+
+/*
+the streaming call of the connect protocol (application/connect+proto and application/connect+json),
+the messages are in the envelopes and the end of the stream is a json envelope with the error and the trailers
+*/
+type connectstream struct {
+	contenttype string
+	codec       *messagecodec
+}
+
+func (p *connectstream) request(r *http.Request) (io.Reader, error) {
+	if err := connectcompressed(r, "Connect-Content-Encoding"); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		prefix := make([]byte, 5)
+		for {
+			if _, err := io.ReadFull(r.Body, prefix); err != nil {
+				if err == io.EOF {
+					pw.Close()
+				} else {
+					pw.CloseWithError(err)
+				}
+				return
+			}
+			if prefix[0]&compressedflag != 0 {
+				pw.CloseWithError(status.Errorf(codes.Unimplemented, config.WEBENCODING, "compressed envelope"))
+				return
+			}
+			b := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+			if _, err := io.ReadFull(r.Body, b); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			b, err := p.codec.decode(b)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(grpcframe(0, b)); err != nil {
+				return
+			}
+		}
+	}()
+	return pr, nil
+}
+
+func (p *connectstream) header(w http.ResponseWriter, header http.Header) {
+	copyheader(w.Header(), header)
+	w.Header().Set("Content-Type", p.contenttype)
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+}
+
+func (p *connectstream) message(w http.ResponseWriter, flag byte, msg []byte) error {
+	if flag&compressedflag != 0 {
+		return status.Errorf(codes.Internal, config.WEBENCODING, "grpc-encoding")
+	}
+	b, err := p.codec.encode(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(grpcframe(0, b))
+	flush(w)
+	return err
+}
+
+func (p *connectstream) trailer(w http.ResponseWriter, st *status.Status, trailer metadata.MD) {
+	end := struct {
+		Error    *connecterror `json:"error,omitempty"`
+		Metadata metadata.MD   `json:"metadata,omitempty"`
+	}{
+		Metadata: trailer,
+	}
+	if st.Code() != codes.OK {
+		end.Error = newconnecterror(st)
+	}
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	b, _ := json.Marshal(end)
+	w.Write(grpcframe(connectendstream, b))
+	flush(w)
+}
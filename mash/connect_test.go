@@ -0,0 +1,139 @@
+package mash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestConnectCode(t *testing.T) {
+	for code, want := range map[codes.Code]string{
+		codes.NotFound:           "not_found",
+		codes.DeadlineExceeded:   "deadline_exceeded",
+		codes.Unavailable:        "unavailable",
+		codes.FailedPrecondition: "failed_precondition",
+	} {
+		if got := connectcode(code); got != want {
+			t.Fatalf("the connect code of %v is %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestConnectUnary(t *testing.T) {
+	p := &connectunary{contenttype: "application/proto", codec: &messagecodec{}}
+	r := httptest.NewRequest(http.MethodPost, "/proto.Greeter/SayHello", strings.NewReader("req"))
+	body, err := p.request(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(body); !bytes.Equal(b, grpcframe(0, []byte("req"))) {
+		t.Fatalf("the request frame is %q", b)
+	}
+
+	w := httptest.NewRecorder()
+	servegrpc(newwebwriter(w, p), []byte("resp"), map[string]string{"Grpc-Status": "0", "X-Trace": "t"})
+	if w.Code != http.StatusOK || w.Body.String() != "resp" {
+		t.Fatalf("the response is %v %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Trailer-X-Trace") != "t" || w.Header().Get("X-Header") != "h" {
+		t.Fatalf("the headers are %v", w.Header())
+	}
+}
+
+func TestConnectUnaryError(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&connectunary{codec: &messagecodec{}}).trailer(w, status.New(codes.NotFound, "no user"), nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("the http code is %v", w.Code)
+	}
+	var ce connecterror
+	if err := jsoniter.Unmarshal(w.Body.Bytes(), &ce); err != nil {
+		t.Fatal(err)
+	}
+	if ce.Code != "not_found" || ce.Message != "no user" {
+		t.Fatalf("the error is %+v", ce)
+	}
+}
+
+func TestConnectUnaryEncoding(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/proto.Greeter/SayHello", strings.NewReader("req"))
+	r.Header.Set("Content-Encoding", "gzip")
+	if _, err := (&connectunary{codec: &messagecodec{}}).request(r); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("the compressed request is %v", err)
+	}
+}
+
+func envelope(flag byte, msg []byte) []byte {
+	b := make([]byte, 5+len(msg))
+	b[0] = flag
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(msg)))
+	copy(b[5:], msg)
+	return b
+}
+
+func TestConnectStreamRequest(t *testing.T) {
+	var body bytes.Buffer
+	body.Write(envelope(0, []byte("a")))
+	body.Write(envelope(0, []byte("bc")))
+	r := httptest.NewRequest(http.MethodPost, "/proto.Greeter/Chat", &body)
+	frames, err := (&connectstream{codec: &messagecodec{}}).request(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(grpcframe(0, []byte("a")), grpcframe(0, []byte("bc"))...); !bytes.Equal(b, want) {
+		t.Fatalf("the frames are %q", b)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/proto.Greeter/Chat", bytes.NewReader(envelope(compressedflag, []byte("a"))))
+	frames, _ = (&connectstream{codec: &messagecodec{}}).request(r)
+	if _, err := io.ReadAll(frames); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("the compressed envelope is %v", err)
+	}
+}
+
+func TestConnectStreamResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	p := &connectstream{contenttype: "application/connect+proto", codec: &messagecodec{}}
+	ww := newwebwriter(w, p)
+	ww.WriteHeader(http.StatusOK)
+	ww.Write(grpcframe(0, []byte("m")))
+	ww.Header().Set(http.TrailerPrefix+"Grpc-Status", "14")
+	ww.Header().Set(http.TrailerPrefix+"Grpc-Message", "down")
+	ww.Header().Set(http.TrailerPrefix+"X-Trace", "t")
+	ww.finish()
+
+	body := w.Body.Bytes()
+	if !bytes.HasPrefix(body, envelope(0, []byte("m"))) {
+		t.Fatalf("the message envelope is %q", body)
+	}
+	end := body[len(envelope(0, []byte("m"))):]
+	if end[0] != connectendstream {
+		t.Fatalf("the end flag is %x", end[0])
+	}
+	var msg struct {
+		Error    *connecterror `json:"error"`
+		Metadata metadata.MD   `json:"metadata"`
+	}
+	if err := jsoniter.Unmarshal(end[5:], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Error == nil || msg.Error.Code != "unavailable" || msg.Error.Message != "down" {
+		t.Fatalf("the error is %+v", msg.Error)
+	}
+	if v := msg.Metadata.Get("x-trace"); len(v) != 1 || v[0] != "t" {
+		t.Fatalf("the metadata is %v", msg.Metadata)
+	}
+}
@@ -0,0 +1,83 @@
+package mash
+
+import (
+	"net/http"
+	meta "octopus/metadata"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+the cors of the browser clients of grpc-web and connect, the cross-origin request is not allowed without it
+*/
+type CORSOptions struct {
+	//the origins allowed to call the gateway, such as https://example.com, "*" allows any origin
+	AllowedOrigins []string
+	//the request headers allowed by the preflight, the requested headers are allowed if it is empty
+	AllowedHeaders []string
+	//the response headers exposed to the browser besides the grpc status
+	ExposedHeaders   []string
+	AllowCredentials bool
+	//the preflight is cached by the browser in the max age
+	MaxAge time.Duration
+}
+
+// the grpc status of grpc-web is in the header if the response is trailers-only
+var corsexposed = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+/*
+this option is used to allow the browser clients of the other origins to call grpc-web and connect
+*/
+func WithGrpcWebCORS(options CORSOptions) meta.OptionBuilder[GrpcMash] {
+	return func(m *GrpcMash) {
+		m.cors = &options
+	}
+}
+
+func (c *CORSOptions) allowed(origin string) bool {
+	for _, v := range c.AllowedOrigins {
+		if v == "*" || strings.EqualFold(strings.TrimSuffix(v, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+set the cors headers of the allowed origin, the preflight is answered and true is returned,
+the request of the origin which is not allowed has no cors header so the browser blocks it
+*/
+func (c *CORSOptions) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if len(origin) == 0 || !c.allowed(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		header.Set("Access-Control-Expose-Headers", strings.Join(append(append([]string{}, corsexposed...), c.ExposedHeaders...), ", "))
+		return false
+	}
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	if len(c.AllowedHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); len(requested) > 0 {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
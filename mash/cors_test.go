@@ -0,0 +1,67 @@
+package mash
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsrequest(method, origin string) *http.Request {
+	r := httptest.NewRequest(method, "http://gateway/proto.Greeter/SayHello", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if method == http.MethodOptions {
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		r.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web,authorization")
+	}
+	return r
+}
+
+func TestCORSPreflight(t *testing.T) {
+	cors := &CORSOptions{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: time.Hour}
+	w := httptest.NewRecorder()
+	if !cors.handle(w, corsrequest(http.MethodOptions, "https://app.example.com")) {
+		t.Fatal("the preflight is not answered")
+	}
+	header := w.Header()
+	if w.Code != http.StatusNoContent || header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("the preflight is %v %v", w.Code, header)
+	}
+	if header.Get("Access-Control-Allow-Headers") != "content-type,x-grpc-web,authorization" {
+		t.Fatalf("the allowed headers are %q", header.Get("Access-Control-Allow-Headers"))
+	}
+	if header.Get("Access-Control-Max-Age") != "3600" || header.Get("Access-Control-Allow-Methods") != "POST, OPTIONS" {
+		t.Fatalf("the preflight headers are %v", header)
+	}
+
+	w = httptest.NewRecorder()
+	if !cors.handle(w, corsrequest(http.MethodOptions, "https://evil.example.com")) || w.Code != http.StatusForbidden {
+		t.Fatalf("the preflight of the other origin is %v", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("the other origin is allowed")
+	}
+}
+
+func TestCORSRequest(t *testing.T) {
+	cors := &CORSOptions{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"X-Trace"}, AllowCredentials: true}
+	w := httptest.NewRecorder()
+	if cors.handle(w, corsrequest(http.MethodPost, "https://app.example.com")) {
+		t.Fatal("the request is answered as the preflight")
+	}
+	header := w.Header()
+	if header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("the cors headers are %v", header)
+	}
+	if header.Get("Access-Control-Expose-Headers") != "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin, X-Trace" {
+		t.Fatalf("the exposed headers are %q", header.Get("Access-Control-Expose-Headers"))
+	}
+
+	//the same origin and the non-browser clients have no Origin header
+	w = httptest.NewRecorder()
+	if cors.handle(w, corsrequest(http.MethodPost, "")) || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("the request without the origin has the cors headers %v", w.Header())
+	}
+}
@@ -3,6 +3,7 @@ package mash
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -10,8 +11,13 @@ import (
 	meta "octopus/metadata"
 	"octopus/pool"
 	"octopus/service"
+	"octopus/service/regcenter"
 	"octopus/service/ware"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc"
@@ -31,43 +37,222 @@ var (
 
 type mashbase struct {
 	routerservice *service.RouterService
-	pools         map[string]pool.Pool
-	middlewares   map[config.MashType][]service.Service
-	logger        *zerolog.Logger
-	pooloptions   pool.Options
-	isdebug       bool
+	//the pools are copied on write, the request gets the pool from the snapshot
+	pools       atomic.Pointer[map[string]pool.Pool]
+	poolmu      sync.Mutex
+	middlewares map[config.MashType][]service.Service
+	logger      *zerolog.Logger
+	pooloptions pool.Options
+	isdebug     bool
 }
 
+/*
+the router can be set again, the old router service is stopped
+*/
 func (m *mashbase) setpathconfig(mashtype config.MashType, builders ...meta.OptionBuilder[service.RouterService]) {
 	if m.routerservice != nil {
-		m.logger.Fatal().Msg(config.RELOADROUTER)
+		m.logger.Warn().Msg(config.RELOADROUTER)
+		m.routerservice.Stop()
 	}
+	builders = append(builders, service.WithUpdateListener(m.syncpool))
 	m.routerservice = service.NewRouterService(m.logger, mashtype, builders...)
 }
 
-func (m *mashbase) setpool() {
-	pools := make(map[string]pool.Pool)
-	if len(m.routerservice.Hosts) > 0 {
-		for _, v := range m.routerservice.Hosts {
-			if v.Status {
-				if pool, err := pool.New(v.Host, m.pooloptions, m.logger); err == nil {
-					pools[v.Host] = pool
-				}
+/*
+the hosts need the connection pool, they are the available hosts or the hosts of the routers if no host is set,
+and the available hosts of the clusters with the pool options of the cluster (the first cluster by name wins if the host is shared)
+*/
+func poolhosts(router *regcenter.Router) map[string]*regcenter.PoolInfo {
+	hosts := make(map[string]*regcenter.PoolInfo)
+	names := make([]string, 0, len(router.Clusters))
+	for name := range router.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cluster := router.Clusters[name]
+		for _, v := range cluster.Hosts {
+			if _, ok := hosts[v.Host]; !ok && v.Status {
+				hosts[v.Host] = cluster.Pool
+			}
+		}
+	}
+	if len(router.Hosts) > 0 {
+		for _, v := range router.Hosts {
+			if _, ok := hosts[v.Host]; !ok && v.Status {
+				hosts[v.Host] = nil
 			}
 		}
 	} else {
-		for _, v := range m.routerservice.Descriptors {
-			if _, ok := pools[v.Host]; !ok {
-				if pool, err := pool.New(v.Host, m.pooloptions, m.logger); err == nil {
-					pools[v.Host] = pool
-				}
+		for _, v := range router.Descriptors {
+			if _, ok := hosts[v.Host]; !ok && len(v.Cluster) == 0 {
+				hosts[v.Host] = nil
 			}
 		}
 	}
+	return hosts
+}
+
+/*
+the pool options of the mash overridden by the pool options of the cluster
+*/
+func (m *mashbase) poolOptions(info *regcenter.PoolInfo) pool.Options {
+	options := m.pooloptions
+	if info == nil {
+		return options
+	}
+	if info.MaxIdle > 0 {
+		options.MaxIdle = info.MaxIdle
+	}
+	if info.MaxActive > 0 {
+		options.MaxActive = info.MaxActive
+	}
+	if info.MaxConcurrentStreams > 0 {
+		options.MaxConcurrentStreams = info.MaxConcurrentStreams
+	}
+	if info.Reuse != nil {
+		options.Reuse = *info.Reuse
+	}
+	return options
+}
+
+func (m *mashbase) setpool() {
+	m.poolmu.Lock()
+	defer m.poolmu.Unlock()
+	pools := make(map[string]pool.Pool)
+	for host, info := range poolhosts(m.routerservice.GetRouter()) {
+		if pool, err := pool.New(host, m.poolOptions(info), m.logger); err == nil {
+			pools[host] = pool
+		}
+	}
 	if len(pools) == 0 {
 		logger.Panic().Msg(config.NOPOOL)
 	}
-	m.pools = pools
+	m.pools.Store(&pools)
+}
+
+/*
+sync the pools with the router swapped in, the pools of the new hosts are created
+and the pools of the removed hosts are drained, so the requests in flight are not disturbed
+*/
+func (m *mashbase) syncpool(router *regcenter.Router) {
+	m.poolmu.Lock()
+	defer m.poolmu.Unlock()
+	old := m.getpools()
+	if old == nil {
+		//the pools are created by setpool after the options are loaded
+		return
+	}
+	hosts := poolhosts(router)
+	pools := make(map[string]pool.Pool)
+	for host, info := range hosts {
+		if p, ok := old[host]; ok {
+			pools[host] = p
+		} else if p, err := pool.New(host, m.poolOptions(info), m.logger); err == nil {
+			pools[host] = p
+		} else {
+			m.logger.Error().Err(err).Msg(err.Error())
+		}
+	}
+	m.pools.Store(&pools)
+	for host, p := range old {
+		if _, ok := hosts[host]; !ok {
+			go p.Drain(pool.DrainTimeout)
+		}
+	}
+}
+
+func (m *mashbase) getpools() map[string]pool.Pool {
+	if pools := m.pools.Load(); pools != nil {
+		return *pools
+	}
+	return nil
+}
+
+func (m *mashbase) getpool(host string) (pool.Pool, error) {
+	if p, ok := m.getpools()[host]; ok {
+		return p, nil
+	}
+	return nil, status.Error(codes.Unavailable, config.NOPOOL)
+}
+
+/*
+the connection of the target, the failure is recorded as the Unavailable of the host
+*/
+func (m *mashbase) conn(data *meta.MetaData) (pool.Conn, error) {
+	p, err := m.getpool(data.Target)
+	if err != nil {
+		return nil, err
+	}
+	gconn, err := p.Get()
+	if err != nil {
+		m.logger.Error().Err(err).Msg(err.Error())
+		err = status.Error(codes.Unavailable, err.Error())
+		m.routerservice.Record(data.Target, err, 0)
+		return nil, err
+	}
+	return gconn, nil
+}
+
+/*
+call with the connection of the target, the failed call is retried by the retry policy of the route,
+every retry goes to another host after the backoff. the call records the outcome of the host and
+the replayable reports whether the request can be sent again (nil is always)
+*/
+func (m *mashbase) retry(ctx context.Context, data *meta.MetaData, call func(ctx context.Context, conn *grpc.ClientConn) error, replayable func() bool) error {
+	tried := make([]string, 0, 1)
+	for attempt := 1; ; attempt++ {
+		tried = append(tried, data.Target)
+		err := m.try(ctx, data, call)
+		if err == nil || ctx.Err() != nil || (replayable != nil && !replayable()) || !m.routerservice.Retryable(data, attempt, err) {
+			return err
+		}
+		//the failed host is given back to the balance before the backoff
+		data.Finish(err)
+		select {
+		case <-time.After(data.Descriptor.Retry.Backoff(attempt)):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if !m.routerservice.Retarget(data, tried) {
+			return err
+		}
+		m.logger.Debug().Msg(fmt.Sprintf(config.RETRYREQUEST, data.Descriptor.GetFullMethod(), attempt+1, data.Target, err))
+	}
+}
+
+func (m *mashbase) try(ctx context.Context, data *meta.MetaData, call func(ctx context.Context, conn *grpc.ClientConn) error) error {
+	return m.guard(data, func() error {
+		gconn, err := m.conn(data)
+		if err != nil {
+			return err
+		}
+		defer gconn.Close()
+		if policy := data.Descriptor.Retry; policy != nil && policy.PerTryTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, policy.PerTryTimeout)
+			defer cancel()
+		}
+		return call(ctx, gconn.Value())
+	})
+}
+
+/*
+the request to the target is checked by the guard of the request (such as the circuit breaker),
+the call is refused if it is not allowed, otherwise its outcome is reported
+*/
+func (m *mashbase) guard(data *meta.MetaData, call func() error) error {
+	guard := data.Guard
+	if guard == nil {
+		return call()
+	}
+	if err := guard.Allow(data.Target); err != nil {
+		m.logger.Debug().Msg(err.Error())
+		return err
+	}
+	err := call()
+	guard.Report(data.Target, err)
+	return err
 }
 
 func (m *mashbase) use(mashtype config.MashType, services ...service.Service) *mashbase {
@@ -76,12 +261,18 @@ func (m *mashbase) use(mashtype config.MashType, services ...service.Service) *m
 }
 
 func (m *mashbase) stoppool() {
-	for i, p := range m.pools {
+	m.poolmu.Lock()
+	defer m.poolmu.Unlock()
+	pools := m.getpools()
+	m.pools.Store(&map[string]pool.Pool{})
+	for _, p := range pools {
 		p.Close()
-		delete(m.pools, i)
 	}
 }
 func (m *mashbase) stop() {
+	if m.routerservice != nil {
+		m.routerservice.Stop()
+	}
 	m.stoppool()
 	for _, wares := range m.middlewares {
 		for _, service := range wares {
@@ -107,7 +298,10 @@ func (m *mashbase) errhandler(w http.ResponseWriter) {
 		if !m.isdebug {
 			msg = config.SYSTEMERROR
 		}
-		http.Error(w, msg, http.StatusInternalServerError)
+		b, _ := meta.NewErrorMeta(codes.Internal, msg).Marshal()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(b)
 	}
 }
 
@@ -118,7 +312,6 @@ func newmash() *mashbase {
 	}
 	return &mashbase{
 		logger:      initlog(),
-		pools:       make(map[string]pool.Pool),
 		middlewares: make(map[config.MashType][]service.Service),
 		isdebug:     isdebug,
 		pooloptions: pool.DefaultOptions,
@@ -131,6 +324,9 @@ type GrpcMash struct {
 	handler ware.HandlerUnit
 	opts    []grpc.ServerOption
 	port    string
+	//the sibling http listener of grpc-web and connect
+	webserver *http.Server
+	cors      *CORSOptions
 }
 
 func NewGrpcMash(builders ...meta.OptionBuilder[GrpcMash]) *GrpcMash {
@@ -165,6 +361,18 @@ func WithGrpcListenPort(port string) meta.OptionBuilder[GrpcMash] {
 	}
 }
 
+/*
+listen grpc-web (application/grpc-web, application/grpc-web-text) and connect (application/proto, application/json,
+application/connect+proto, application/connect+json) on the port, they go through the same middlewares as the grpc
+*/
+func WithGrpcWebListenPort(port string) meta.OptionBuilder[GrpcMash] {
+	return func(m *GrpcMash) {
+		m.webserver = &http.Server{
+			Addr: port,
+		}
+	}
+}
+
 func WithGrpcTLS(credit credentials.TransportCredentials) meta.OptionBuilder[GrpcMash] {
 	return func(m *GrpcMash) {
 		m.opts = append(m.opts, grpc.Creds(credit))
@@ -182,7 +390,27 @@ func (m *GrpcMash) Listen() error {
 	if err != nil {
 		return err
 	}
-	return m.server.Serve(lis)
+	if m.webserver == nil {
+		return m.server.Serve(lis)
+	}
+	//the web listener fails the Listen as the grpc listener, such as the port conflict
+	m.webserver.Handler = m.webhandler()
+	weblis, err := net.Listen("tcp", m.webserver.Addr)
+	if err != nil {
+		lis.Close()
+		return err
+	}
+	ret := make(chan error, 2)
+	go func() {
+		ret <- m.webserver.Serve(weblis)
+	}()
+	go func() {
+		ret <- m.server.Serve(lis)
+	}()
+	if err = <-ret; err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
 func (m *GrpcMash) buildServer() *GrpcMash {
@@ -200,6 +428,9 @@ func (m *GrpcMash) buildServer() *GrpcMash {
 func (m *GrpcMash) Stop() {
 	m.mashbase.stop()
 	m.server.Stop()
+	if m.webserver != nil {
+		m.webserver.Close()
+	}
 }
 
 func (m *GrpcMash) transhandler() grpc.StreamHandler {
@@ -211,7 +442,7 @@ func (m *GrpcMash) transhandler() grpc.StreamHandler {
 		data := buildmeta(path, m.logger)
 		if data == nil {
 			m.logger.Error().Msg(meta.LoggerTrace())
-			return errors.New(path)
+			return status.Errorf(codes.Unimplemented, config.WRONGPATH, path)
 		}
 		incomingCtx := serverStream.Context()
 		clientCtx, clientCancel := context.WithCancel(incomingCtx)
@@ -220,6 +451,8 @@ func (m *GrpcMash) transhandler() grpc.StreamHandler {
 				m.logger.Error().Any("Panic", err).Msg(config.GRPCPROXYEORROR)
 				e = status.Errorf(codes.Internal, "gRPC proxying should never reach this stage.")
 			}
+			//the outcome of the whole request is reported to the middlewares
+			data.Complete(e)
 			clientCancel()
 		}()
 		header, _ := metadata.FromIncomingContext(clientCtx)
@@ -228,65 +461,98 @@ func (m *GrpcMash) transhandler() grpc.StreamHandler {
 			GrpcContext: incomingCtx,
 		}
 		err := m.handler(clientCtx, data)
+		defer func() {
+			data.Finish(e)
+		}()
 		if err != nil {
 			m.logger.Error().Err(err).Msg(err.Error())
+			if _, ok := status.FromError(err); ok {
+				return err
+			}
 			return status.Errorf(codes.Internal, err.Error())
 		}
 		if v, ok := data.Result.(meta.ErrorMeta); ok {
-			return status.Errorf(codes.ResourceExhausted, v.Error)
+			return v.Err()
 		}
-		newCtx := metadata.NewOutgoingContext(clientCtx, *data.Header)
+		//the effective timeout of the route, the deadline is propagated to the backend
+		deadlineCtx, deadlineCancel := data.WithDeadline(clientCtx)
+		defer deadlineCancel()
+		newCtx := metadata.NewOutgoingContext(deadlineCtx, *data.Header)
 
-		//connection by grpc
-		gconn, err := m.pools[data.Target].Get()
-		if err != nil {
-			m.logger.Error().Err(err).Msg(err.Error())
-			m.logger.Error().Msg(meta.LoggerTrace())
-			return err
+		//the frames of the client are kept for the retry until the first response is relayed
+		frames := newreplay(data.Descriptor.Retry != nil)
+		go frames.read(newCtx, serverStream, data.Tee)
+		err = m.retry(newCtx, data, func(ctx context.Context, conn *grpc.ClientConn) error {
+			return m.proxy(ctx, conn, serverStream, data, path, frames)
+		}, frames.replayable)
+		if trailer := frames.gettrailer(); trailer != nil {
+			serverStream.SetTrailer(trailer)
 		}
-		defer gconn.Close()
+		return err
+	}
+}
 
-		clientStream, err := grpc.NewClientStream(newCtx, clientStreamDescForProxying, gconn.Value(), path)
-		if err != nil {
-			m.logger.Error().Err(err).Msg(err.Error())
-			m.logger.Error().Msg(meta.LoggerTrace())
-			return err
-		}
+/*
+proxy the frames of the client to the target and the responses back to the client,
+the attempt can be retried only if no response is relayed
+*/
+func (m *GrpcMash) proxy(ctx context.Context, conn *grpc.ClientConn, serverStream grpc.ServerStream, data *meta.MetaData, path string, frames *replay) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	clientStream, err := grpc.NewClientStream(ctx, clientStreamDescForProxying, conn, path)
+	if err != nil {
+		m.logger.Error().Err(err).Msg(err.Error())
+		m.logger.Error().Msg(meta.LoggerTrace())
+		m.routerservice.Record(data.Target, err, 0)
+		return err
+	}
 
-		s2cErrChan := m.forwardServerToClient(serverStream, clientStream)
-		c2sErrChan := m.forwardClientToServer(clientStream, serverStream)
-		for i := 0; i < 2; i++ {
-			select {
-			case s2cErr := <-s2cErrChan:
-				if s2cErr == io.EOF {
-					// this is the happy case where the sender has encountered io.EOF, and won't be sending anymore./
-					// the clientStream>serverStream may continue pumping though.
-					clientStream.CloseSend()
-				} else {
-					// however, we may have gotten a receive error (stream disconnected, a read error etc) in which case we need
-					// to cancel the clientStream to the backend, let all of its goroutines be freed up by the CancelFunc and
-					// exit with an error to the stack
-					clientCancel()
-					m.logger.Error().Msg(meta.LoggerTrace())
-					return status.Errorf(codes.Internal, "failed proxying s2c: %v", s2cErr)
-				}
-			case c2sErr := <-c2sErrChan:
-				// This happens when the clientStream has nothing else to offer (io.EOF), returned a gRPC error. In those two
-				// cases we may have received Trailers as part of the call. In case of other errors (stream closed) the trailers
-				// will be nil.
-				serverStream.SetTrailer(clientStream.Trailer())
-				// c2sErr will contain RPC error from client code. If not io.EOF return the RPC error as server stream error.
-				if c2sErr != io.EOF {
-					return c2sErr
-				}
-				return nil
+	s2cErrChan := m.forwardServerToClient(ctx, frames, clientStream)
+	c2sErrChan := m.forwardClientToServer(clientStream, serverStream, frames)
+	for i := 0; i < 2; i++ {
+		select {
+		case s2cErr := <-s2cErrChan:
+			if s2cErr == io.EOF {
+				// this is the happy case where the sender has encountered io.EOF, and won't be sending anymore./
+				// the clientStream>serverStream may continue pumping though.
+				clientStream.CloseSend()
+			} else if err := ctx.Err(); err != nil {
+				// the deadline of the request (or the attempt) is exceeded or the client is gone
+				err = status.FromContextError(err).Err()
+				m.routerservice.Record(data.Target, err, 0)
+				return err
+			} else {
+				// however, we may have gotten a receive error (stream disconnected, a read error etc) in which case we need
+				// to cancel the clientStream to the backend, let all of its goroutines be freed up by the CancelFunc and
+				// exit with an error to the stack
+				frames.setbroken()
+				cancel()
+				m.logger.Error().Msg(meta.LoggerTrace())
+				return status.Errorf(codes.Internal, "failed proxying s2c: %v", s2cErr)
+			}
+		case c2sErr := <-c2sErrChan:
+			// This happens when the clientStream has nothing else to offer (io.EOF), returned a gRPC error. In those two
+			// cases we may have received Trailers as part of the call. In case of other errors (stream closed) the trailers
+			// will be nil.
+			frames.settrailer(clientStream.Trailer())
+			// c2sErr will contain RPC error from client code. If not io.EOF return the RPC error as server stream error.
+			if c2sErr == io.EOF {
+				c2sErr = nil
+			}
+			// only the latency of the unary call is counted by the outlier detection
+			var latency time.Duration
+			if !data.Descriptor.ClientStreaming && !data.Descriptor.ServerStreaming {
+				latency = time.Since(start)
 			}
+			m.routerservice.Record(data.Target, c2sErr, latency)
+			return c2sErr
 		}
-		return status.Errorf(codes.Internal, "gRPC proxying should never reach this stage.")
 	}
+	return status.Errorf(codes.Internal, "gRPC proxying should never reach this stage.")
 }
 
-func (m *GrpcMash) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream) chan error {
+func (m *GrpcMash) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerStream, frames *replay) chan error {
 	ret := make(chan error, 1)
 	go func() {
 		f := &emptypb.Empty{}
@@ -296,6 +562,8 @@ func (m *GrpcMash) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerS
 				break
 			}
 			if i == 0 {
+				// the response is relayed, so the request can not be retried any more
+				frames.commit()
 				// This is a bit of a hack, but client to server headers are only readable after first client msg is
 				// received but must be written to server stream before the first msg is flushed.
 				// This is the only place to do it nicely.
@@ -318,12 +586,15 @@ func (m *GrpcMash) forwardClientToServer(src grpc.ClientStream, dst grpc.ServerS
 	return ret
 }
 
-func (m *GrpcMash) forwardServerToClient(src grpc.ServerStream, dst grpc.ClientStream) chan error {
+/*
+send the frames of the client to the target, the frames kept by the replay are sent again by the retry
+*/
+func (m *GrpcMash) forwardServerToClient(ctx context.Context, frames *replay, dst grpc.ClientStream) chan error {
 	ret := make(chan error, 1)
 	go func() {
-		f := &emptypb.Empty{}
-		for {
-			if err := src.RecvMsg(f); err != nil {
+		for i := 0; ; i++ {
+			f, err := frames.frame(ctx, i)
+			if err != nil {
 				ret <- err // this can be io.EOF which is happy case
 				break
 			}
@@ -0,0 +1,74 @@
+package mash
+
+import (
+	"errors"
+	"octopus/pool"
+	"octopus/service/regcenter"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/connectivity"
+)
+
+/*
+the pools of the kept hosts are reused, the new hosts get the pools and the removed pools are drained
+after the connections in flight are given back
+*/
+func TestSyncPool(t *testing.T) {
+	logger := zerolog.Nop()
+	m := &mashbase{logger: &logger, pooloptions: pool.Options{Dial: pool.Dial, MaxIdle: 1, MaxActive: 1, MaxConcurrentStreams: 8, Reuse: true}}
+	router := func(hosts ...string) *regcenter.Router {
+		infos := make(map[string]*regcenter.HostInfo)
+		for _, host := range hosts {
+			infos[host] = &regcenter.HostInfo{Host: host, Weight: 1, Status: true}
+		}
+		return &regcenter.Router{Hosts: infos}
+	}
+	//the pools are not created before setpool
+	m.syncpool(router("127.0.0.1:9000"))
+	if m.getpools() != nil {
+		t.Fatal("the pools are created before the options are loaded")
+	}
+
+	pools := make(map[string]pool.Pool)
+	for _, host := range []string{"127.0.0.1:9000", "127.0.0.1:9001"} {
+		p, err := pool.New(host, m.pooloptions, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[host] = p
+	}
+	m.pools.Store(&pools)
+	t.Cleanup(m.stoppool)
+	removed := pools["127.0.0.1:9001"]
+	conn, err := removed.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.syncpool(router("127.0.0.1:9000", "127.0.0.1:9002"))
+	synced := m.getpools()
+	if len(synced) != 2 || synced["127.0.0.1:9000"] != pools["127.0.0.1:9000"] || synced["127.0.0.1:9002"] == nil {
+		t.Fatalf("the pools are %v", synced)
+	}
+	if _, err := m.getpool("127.0.0.1:9001"); err == nil {
+		t.Fatal("the pool of the removed host is kept")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := removed.Get(); !errors.Is(err, pool.ErrClosed) {
+		t.Fatalf("the removed pool gives out the connection with %v", err)
+	}
+	if conn.Value().GetState() == connectivity.Shutdown {
+		t.Fatal("the connection in flight is closed by the drain")
+	}
+	cc := conn.Value()
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for cc.GetState() != connectivity.Shutdown {
+		if time.Now().After(deadline) {
+			t.Fatal("the removed pool is not closed after the connection is given back")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
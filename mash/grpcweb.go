@@ -0,0 +1,440 @@
+package mash
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"octopus/config"
+	meta "octopus/metadata"
+	"strconv"
+	"strings"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	//the trailer frame flag of grpc-web
+	grpcwebtrailer = 0x80
+	//the compressed flag of the grpc frame and the connect envelope
+	compressedflag = 0x01
+)
+
+/*
+the web protocol converts the request to the native grpc request and writes the grpc response in its own format,
+the grpc request is served by the grpc server of the mash so it goes through the same middlewares and transhandler
+*/
+type webprotocol interface {
+	//convert the request body to the grpc frames
+	request(r *http.Request) (io.Reader, error)
+	//the response header from the backend
+	header(w http.ResponseWriter, header http.Header)
+	//every response message, the flag is the grpc frame flag
+	message(w http.ResponseWriter, flag byte, msg []byte) error
+	//the grpc status and the trailers
+	trailer(w http.ResponseWriter, st *status.Status, trailer metadata.MD)
+}
+
+/*
+the response writer passed to the grpc server,
+it splits the grpc frames and the trailers (set after the header is written) for the web protocol
+*/
+type webwriter struct {
+	w         http.ResponseWriter
+	protocol  webprotocol
+	header    http.Header
+	committed bool
+	buf       []byte
+	err       error
+}
+
+func newwebwriter(w http.ResponseWriter, protocol webprotocol) *webwriter {
+	return &webwriter{
+		w:        w,
+		protocol: protocol,
+		header:   make(http.Header),
+	}
+}
+
+func (ww *webwriter) Header() http.Header {
+	return ww.header
+}
+
+func (ww *webwriter) WriteHeader(int) {
+	ww.commit()
+}
+
+func (ww *webwriter) Write(b []byte) (int, error) {
+	ww.commit()
+	ww.buf = append(ww.buf, b...)
+	for len(ww.buf) >= 5 {
+		n := int(binary.BigEndian.Uint32(ww.buf[1:5]))
+		if len(ww.buf) < 5+n {
+			break
+		}
+		if ww.err == nil {
+			ww.err = ww.protocol.message(ww.w, ww.buf[0], ww.buf[5:5+n])
+		}
+		ww.buf = ww.buf[5+n:]
+	}
+	return len(b), nil
+}
+
+/*
+the web protocol flushes the response itself, the unary call of connect is written after the status is received
+*/
+func (ww *webwriter) Flush() {
+	ww.commit()
+}
+
+/*
+the header is written on the first write, the values set after it are the trailers
+*/
+func (ww *webwriter) commit() {
+	if ww.committed {
+		return
+	}
+	ww.committed = true
+	header := ww.header
+	header.Del("Trailer")
+	ww.protocol.header(ww.w, header)
+	ww.header = make(http.Header)
+}
+
+func (ww *webwriter) finish() {
+	ww.commit()
+	st, trailer := parsetrailer(ww.header)
+	if ww.err != nil {
+		st = status.Convert(ww.err)
+	}
+	ww.protocol.trailer(ww.w, st, trailer)
+}
+
+/*
+parse the grpc status and the metadata from the trailers written by the grpc server
+*/
+func parsetrailer(header http.Header) (*status.Status, metadata.MD) {
+	var (
+		code    = codes.Unknown
+		msg     string
+		found   bool
+		details *spb.Status
+	)
+	trailer := metadata.MD{}
+	for k, vv := range header {
+		k = strings.ToLower(strings.TrimPrefix(k, http.TrailerPrefix))
+		if len(vv) == 0 {
+			continue
+		}
+		switch k {
+		case "grpc-status":
+			if c, err := strconv.ParseUint(vv[0], 10, 32); err == nil {
+				code, found = codes.Code(c), true
+			}
+		case "grpc-message":
+			if m, err := url.PathUnescape(vv[0]); err == nil {
+				msg = m
+			} else {
+				msg = vv[0]
+			}
+		case "grpc-status-details-bin":
+			if b, err := decodebin(vv[0]); err == nil {
+				s := &spb.Status{}
+				if proto.Unmarshal(b, s) == nil {
+					details = s
+				}
+			}
+		default:
+			trailer.Append(k, vv...)
+		}
+	}
+	if !found {
+		return status.New(codes.Unknown, "the grpc status is missing"), trailer
+	}
+	if details != nil && codes.Code(details.Code) == code {
+		return status.FromProto(details), trailer
+	}
+	return status.New(code, msg), trailer
+}
+
+func decodebin(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+func copyheader(dst, src http.Header) {
+	for k, vv := range src {
+		if len(vv) > 0 {
+			dst[k] = vv
+		}
+	}
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func grpcframe(flag byte, msg []byte) []byte {
+	frame := make([]byte, 5+len(msg))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	return frame
+}
+
+/*
+application/grpc-web and application/grpc-web-text (base64),
+the frames are same as the grpc except the trailers are sent as the final frame
+*/
+type grpcweb struct {
+	contenttype string
+	text        bool
+}
+
+func (p *grpcweb) request(r *http.Request) (io.Reader, error) {
+	if p.text {
+		return &base64reader{r: r.Body}, nil
+	}
+	return r.Body, nil
+}
+
+func (p *grpcweb) header(w http.ResponseWriter, header http.Header) {
+	copyheader(w.Header(), header)
+	w.Header().Set("Content-Type", p.contenttype)
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+}
+
+func (p *grpcweb) message(w http.ResponseWriter, flag byte, msg []byte) error {
+	return p.write(w, grpcframe(flag, msg))
+}
+
+func (p *grpcweb) trailer(w http.ResponseWriter, st *status.Status, trailer metadata.MD) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "grpc-status: %d\r\n", st.Code())
+	if m := st.Message(); m != "" {
+		fmt.Fprintf(&buf, "grpc-message: %s\r\n", url.PathEscape(m))
+	}
+	if s := st.Proto(); len(s.Details) > 0 {
+		if b, err := proto.Marshal(s); err == nil {
+			fmt.Fprintf(&buf, "grpc-status-details-bin: %s\r\n", base64.RawStdEncoding.EncodeToString(b))
+		}
+	}
+	for k, vv := range trailer {
+		for _, v := range vv {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	p.write(w, grpcframe(grpcwebtrailer, buf.Bytes()))
+}
+
+func (p *grpcweb) write(w http.ResponseWriter, frame []byte) error {
+	if p.text {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	_, err := w.Write(frame)
+	flush(w)
+	return err
+}
+
+/*
+decode the grpc-web-text body, the padded base64 chunks can be concatenated
+*/
+type base64reader struct {
+	r   io.Reader
+	in  []byte
+	out []byte
+	err error
+}
+
+func (b *base64reader) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			if b.err == io.EOF && len(b.in) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, b.err
+		}
+		buf := make([]byte, 4096)
+		n, err := b.r.Read(buf)
+		b.in = append(b.in, buf[:n]...)
+		b.err = err
+		k := len(b.in) / 4 * 4
+		for i := 0; i < k; i += 4 {
+			dst := make([]byte, 3)
+			n, err := base64.StdEncoding.Decode(dst, b.in[i:i+4])
+			if err != nil {
+				b.err = err
+				break
+			}
+			b.out = append(b.out, dst[:n]...)
+		}
+		b.in = b.in[k:]
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+/*
+convert the message between the json and the proto wire format, the proto message is passed as it is
+*/
+type messagecodec struct {
+	input  protoreflect.MessageType
+	output protoreflect.MessageType
+}
+
+func (c *messagecodec) decode(b []byte) ([]byte, error) {
+	if c.input == nil {
+		return b, nil
+	}
+	msg := c.input.New().Interface()
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, msg); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return proto.Marshal(msg)
+}
+
+func (c *messagecodec) encode(b []byte) ([]byte, error) {
+	if c.output == nil {
+		return b, nil
+	}
+	msg := c.output.New().Interface()
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return protojson.Marshal(msg)
+}
+
+/*
+find the message types of the method for the json codec
+*/
+func (m *GrpcMash) jsoncodec(path string) (*messagecodec, error) {
+	registry := m.routerservice.GetRouter().Registry
+	if registry == nil {
+		registry = meta.NewProtoRegistry()
+	}
+	method, err := registry.FindMethod(path)
+	if err != nil {
+		return nil, status.Errorf(codes.Unimplemented, config.WRONGPATH, path)
+	}
+	input, err := registry.FindMessageByName(method.Input().FullName())
+	if err != nil {
+		return nil, status.Error(codes.Unimplemented, err.Error())
+	}
+	output, err := registry.FindMessageByName(method.Output().FullName())
+	if err != nil {
+		return nil, status.Error(codes.Unimplemented, err.Error())
+	}
+	return &messagecodec{
+		input:  input,
+		output: output,
+	}, nil
+}
+
+/*
+choose the web protocol by the content type, nil is returned if it is not supported
+*/
+func (m *GrpcMash) webprotocol(r *http.Request) (webprotocol, error) {
+	contenttype := r.Header.Get("Content-Type")
+	mediatype, _, _ := mime.ParseMediaType(contenttype)
+	switch {
+	case strings.HasPrefix(mediatype, "application/grpc-web-text"):
+		return &grpcweb{contenttype: contenttype, text: true}, nil
+	case strings.HasPrefix(mediatype, "application/grpc-web"):
+		return &grpcweb{contenttype: contenttype}, nil
+	case mediatype == "application/connect+proto", mediatype == "application/connect+json":
+		codec := &messagecodec{}
+		if mediatype == "application/connect+json" {
+			var err error
+			if codec, err = m.jsoncodec(r.URL.Path); err != nil {
+				return &connectstream{contenttype: contenttype}, err
+			}
+		}
+		return &connectstream{contenttype: contenttype, codec: codec}, nil
+	case mediatype == "application/proto", mediatype == "application/json":
+		codec := &messagecodec{}
+		if mediatype == "application/json" {
+			var err error
+			if codec, err = m.jsoncodec(r.URL.Path); err != nil {
+				return &connectunary{contenttype: contenttype}, err
+			}
+		}
+		return &connectunary{contenttype: contenttype, codec: codec}, nil
+	}
+	return nil, nil
+}
+
+/*
+the handler of grpc-web and connect,
+the request is converted to the native grpc request and served by the grpc server of the mash
+*/
+func (m *GrpcMash) webhandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.cors != nil && m.cors.handle(w, r) {
+			return
+		}
+		protocol, err := m.webprotocol(r)
+		if protocol == nil {
+			http.Error(w, fmt.Sprintf(config.WEBCONTENTTYPE, r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err == nil && r.Method != http.MethodPost {
+			err = status.Errorf(codes.Unimplemented, config.WEBMETHOD, r.Method)
+		}
+		var body io.Reader
+		if err == nil {
+			body, err = protocol.request(r)
+		}
+		timeout := r.Header.Get("Connect-Timeout-Ms")
+		if err == nil && timeout != "" {
+			if ms, e := strconv.ParseUint(timeout, 10, 64); e != nil {
+				err = status.Error(codes.InvalidArgument, e.Error())
+			} else if ms < 1e8 {
+				timeout = fmt.Sprintf("%dm", ms)
+			} else {
+				timeout = fmt.Sprintf("%dS", ms/1000)
+			}
+		}
+		if err != nil {
+			m.logger.Error().Err(err).Msg(err.Error())
+			protocol.header(w, http.Header{})
+			protocol.trailer(w, status.Convert(err), nil)
+			return
+		}
+
+		req := r.Clone(r.Context())
+		req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2"
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		req.ContentLength = -1
+		//the connection-specific headers are not allowed in http2
+		for _, k := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Te", "Content-Length"} {
+			req.Header.Del(k)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		if timeout != "" {
+			req.Header.Set("Grpc-Timeout", timeout)
+		}
+
+		ww := newwebwriter(w, protocol)
+		m.server.ServeHTTP(ww, req)
+		ww.finish()
+	})
+}
@@ -0,0 +1,142 @@
+package mash
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// the response of the grpc server written to the webwriter, the frame is split to test the buffering
+func servegrpc(ww *webwriter, msg []byte, trailer map[string]string) {
+	ww.Header().Set("X-Header", "h")
+	ww.WriteHeader(http.StatusOK)
+	frame := grpcframe(0, msg)
+	ww.Write(frame[:3])
+	ww.Write(frame[3:])
+	for k, v := range trailer {
+		ww.Header().Set(http.TrailerPrefix+k, v)
+	}
+	ww.finish()
+}
+
+func TestGrpcWebResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	servegrpc(newwebwriter(w, &grpcweb{contenttype: "application/grpc-web+proto"}), []byte("hello"), map[string]string{
+		"Grpc-Status":  "0",
+		"X-Trailer":    "t",
+		"Grpc-Message": "",
+	})
+	if ct := w.Header().Get("Content-Type"); ct != "application/grpc-web+proto" {
+		t.Fatalf("the content type is %q", ct)
+	}
+	if h := w.Header().Get("X-Header"); h != "h" {
+		t.Fatalf("the header is %q", h)
+	}
+	body := w.Body.Bytes()
+	if !bytes.HasPrefix(body, grpcframe(0, []byte("hello"))) {
+		t.Fatalf("the message frame is wrong: %q", body)
+	}
+	trailer := body[len(grpcframe(0, []byte("hello"))):]
+	if trailer[0] != grpcwebtrailer {
+		t.Fatalf("the trailer flag is %x", trailer[0])
+	}
+	text := string(trailer[5:])
+	for _, want := range []string{"grpc-status: 0\r\n", "x-trailer: t\r\n"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("the trailer %q has no %q", text, want)
+		}
+	}
+}
+
+func TestGrpcWebTextResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	servegrpc(newwebwriter(w, &grpcweb{contenttype: "application/grpc-web-text", text: true}), []byte("hi"), map[string]string{
+		"Grpc-Status":  "5",
+		"Grpc-Message": "not%20found",
+	})
+	//every frame is encoded alone, so the body is the padded base64 chunks
+	decoded, err := io.ReadAll(&base64reader{r: w.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := grpcframe(0, []byte("hi"))
+	if !bytes.HasPrefix(decoded, frame) {
+		t.Fatalf("the message frame is wrong: %q", decoded)
+	}
+	st, _ := parseWebTrailer(t, decoded[len(frame):])
+	if st.Code() != codes.NotFound || st.Message() != "not found" {
+		t.Fatalf("the status is %v", st)
+	}
+}
+
+func parseWebTrailer(t *testing.T, frame []byte) (*status.Status, http.Header) {
+	t.Helper()
+	if frame[0] != grpcwebtrailer {
+		t.Fatalf("the trailer flag is %x", frame[0])
+	}
+	header := http.Header{}
+	for _, line := range strings.Split(strings.TrimSpace(string(frame[5:])), "\r\n") {
+		k, v, _ := strings.Cut(line, ": ")
+		header.Add(k, v)
+	}
+	st, _ := parsetrailer(header)
+	return st, header
+}
+
+func TestGrpcWebStatusDetails(t *testing.T) {
+	st, err := status.New(codes.InvalidArgument, "bad name").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	(&grpcweb{}).trailer(w, st, nil)
+	got, _ := parseWebTrailer(t, w.Body.Bytes())
+	if !proto.Equal(got.Proto(), st.Proto()) {
+		t.Fatalf("the status is %v, want %v", got.Proto(), st.Proto())
+	}
+}
+
+func TestParseTrailerMissingStatus(t *testing.T) {
+	st, trailer := parsetrailer(http.Header{"X-Trace": {"t"}})
+	if st.Code() != codes.Unknown {
+		t.Fatalf("the code is %v", st.Code())
+	}
+	if v := trailer.Get("x-trace"); len(v) != 1 || v[0] != "t" {
+		t.Fatalf("the trailer is %v", trailer)
+	}
+}
+
+func TestBase64Reader(t *testing.T) {
+	//the padded chunks are concatenated by the client which sends the messages separately
+	body := base64.StdEncoding.EncodeToString([]byte("a")) + base64.StdEncoding.EncodeToString([]byte("bcde"))
+	b, err := io.ReadAll(&base64reader{r: strings.NewReader(body)})
+	if err != nil || string(b) != "abcde" {
+		t.Fatalf("the body is %q (%v)", b, err)
+	}
+	if _, err := io.ReadAll(&base64reader{r: strings.NewReader("YWJj!")}); err == nil {
+		t.Fatal("the broken body is decoded")
+	}
+}
+
+func TestGrpcWebRequest(t *testing.T) {
+	frame := grpcframe(0, []byte("req"))
+	r := httptest.NewRequest(http.MethodPost, "/proto.Greeter/SayHello", strings.NewReader(base64.StdEncoding.EncodeToString(frame)))
+	body, err := (&grpcweb{text: true}).request(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(body); !bytes.Equal(b, frame) {
+		t.Fatalf("the frames are %q", b)
+	}
+}
@@ -14,7 +14,6 @@ import (
 	"sync"
 	"time"
 
-	jsoniter "github.com/json-iterator/go"
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
@@ -39,6 +38,8 @@ type HttpMash struct {
 	afterhandler ware.AfterHandlerUnit
 	//http mash work mode
 	mode config.HttpType
+	//the origins allowed to open the websocket besides the same origin
+	origins []string
 }
 
 func NewHttpMash(builders ...meta.OptionBuilder[HttpMash]) *HttpMash {
@@ -191,14 +192,13 @@ start the http mash server
 func (m *HttpMash) Listen() error {
 	mux := &http.ServeMux{}
 	if m.mode != config.Onlyhook {
-		m.handler = func(ctx context.Context, data *meta.MetaData) error {
-			//connection by grpc
-			gconn, err := m.pools[data.Target].Get()
-			if err != nil {
-				return err
-			}
-			defer gconn.Close()
-
+		m.handler = func(ctx context.Context, data *meta.MetaData) (err error) {
+			defer func() {
+				data.Finish(err)
+			}()
+			//the effective timeout of the route, the deadline is propagated to the backend
+			ctx, cancel := data.WithDeadline(ctx)
+			defer cancel()
 			//build the grpc metadata
 			//head filter
 			md := metadata.MD{}
@@ -207,15 +207,44 @@ func (m *HttpMash) Listen() error {
 					md.Append(v, peek)
 				}
 			}
-			context := metadata.NewOutgoingContext(ctx, md)
+			outgoing := metadata.NewOutgoingContext(ctx, md)
 			in, out, err := data.GetProtoMessage(m.routerservice.GetDic())
+			if err == nil && data.Tee != nil {
+				//the websocket frames of the client streaming are not mirrored
+				if !data.Descriptor.ClientStreaming {
+					data.Tee.Send(outgoing, in)
+				}
+				data.Tee.Close(nil)
+			}
 
 			if err != nil {
 				return err
+			} else if data.Descriptor.ClientStreaming || data.Descriptor.ServerStreaming {
+				//connection by grpc, the stream is not retried
+				return m.guard(data, func() error {
+					gconn, err := m.conn(data)
+					if err != nil {
+						return err
+					}
+					defer gconn.Close()
+					if data.Descriptor.ClientStreaming {
+						err = m.websocketstream(outgoing, gconn.Value(), data, in, out)
+					} else {
+						err = m.serverstream(outgoing, gconn.Value(), data, in, out)
+					}
+					m.routerservice.Record(data.Target, err, 0)
+					return err
+				})
 			} else {
 				var callbackheader metadata.MD
-				//invoke the server moethod by grpc
-				if err = gconn.Value().Invoke(context, data.Descriptor.GetFullMethod(), in, out, grpc.Header(&callbackheader)); err != nil {
+				//invoke the server moethod by grpc, the failed call is retried by the retry policy of the route
+				err = m.retry(outgoing, data, func(ctx context.Context, conn *grpc.ClientConn) error {
+					start := time.Now()
+					err := conn.Invoke(ctx, data.Descriptor.GetFullMethod(), in, out, grpc.Header(&callbackheader))
+					m.routerservice.Record(data.Target, err, time.Since(start))
+					return err
+				}, nil)
+				if err != nil {
 					return err
 				} else {
 					data.Callbackheader = &callbackheader
@@ -231,7 +260,8 @@ func (m *HttpMash) Listen() error {
 			m.handler = middlewares[i].BuildWare()(m.handler)
 		}
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			ctx, cancel := context.WithCancel(context.Background())
+			//the request context is canceled when the client disconnects
+			ctx, cancel := context.WithCancel(r.Context())
 			defer func() {
 				m.errhandler(w)
 				cancel()
@@ -244,35 +274,47 @@ func (m *HttpMash) Listen() error {
 				},
 				Logger: m.logger,
 			}
-			err := data.FormatAll(m.pathhandler)
+			//the outcome of the whole request is reported to the middlewares
+			defer func() {
+				data.Complete(data.Err())
+			}()
+			var err error
+			if rule, vars, ok := m.routerservice.MatchRule(r.Method, r.URL.EscapedPath()); ok {
+				err = data.FormatRule(rule, vars)
+			} else {
+				err = data.FormatAll(m.pathhandler)
+			}
 			if err != nil {
 				m.logger.Error().Msg(err.Error())
-				data.Result = meta.ErrorMeta{
-					Error: err.Error(),
-				}
+				data.Result = meta.ToErrorMeta(err)
 			} else {
 				if err = m.handler(ctx, data); err != nil {
-					data.Errorf(err.Error(), m.isdebug)
-				} else if msg, ok := data.Result.(proto.Message); ok && m.afterhandler != nil {
+					data.SetError(err, m.isdebug)
+				} else if msg, ok := data.Result.(proto.Message); ok && m.afterhandler != nil && !data.Streamed {
 					if err = m.afterhandler(ctx, msg, w, *data.Callbackheader); err != nil {
-						data.Errorf(err.Error(), m.isdebug)
+						data.SetError(err, m.isdebug)
 					}
 				}
 			}
 
-			json := jsoniter.ConfigCompatibleWithStandardLibrary
-			b, err := json.Marshal(data.Result)
+			if data.Streamed {
+				return
+			}
+			b, err := data.MarshalResult()
 			if err != nil {
 				m.logger.Panic().Err(err).Msg(err.Error())
 			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(data.HttpCode())
 				w.Write(b)
 			}
 		})
 	}
 	if m.mode != config.Nohook {
 		mux.HandleFunc("/watcher", func(w http.ResponseWriter, r *http.Request) {
-			m.routerservice.Watcher(w, r, m.pools)
+			m.routerservice.Watcher(w, r, m.getpools())
 		})
+		mux.HandleFunc("/health", m.routerservice.Health)
 	}
 	m.server.Handler = mux
 	return m.server.ListenAndServe()
@@ -312,6 +354,9 @@ func (container *MashContainer) Stop(ctx context.Context) {
 	container.mashbase.stop()
 	container.httpmash.server.Shutdown(ctx)
 	container.grpcmash.server.Stop()
+	if container.grpcmash.webserver != nil {
+		container.grpcmash.webserver.Close()
+	}
 }
 
 func (container *MashContainer) GetHttpMash() *HttpMash {
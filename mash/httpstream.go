@@ -0,0 +1,155 @@
+package mash
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	meta "octopus/metadata"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var serverStreamDesc = &grpc.StreamDesc{
+	ServerStreams: true,
+}
+
+/*
+the writer of the server streaming response,
+the messages are written as Server-Sent Events if the client accepts text/event-stream, otherwise as newline-delimited JSON
+*/
+type streamwriter struct {
+	data    *meta.MetaData
+	flusher http.Flusher
+	sse     bool
+}
+
+func newstreamwriter(data *meta.MetaData) *streamwriter {
+	flusher, _ := data.Response.(http.Flusher)
+	return &streamwriter{
+		data:    data,
+		flusher: flusher,
+		sse:     strings.Contains(data.Request.Header.Get("Accept"), "text/event-stream"),
+	}
+}
+
+func (sw *streamwriter) start() {
+	header := sw.data.Response.Header()
+	if sw.sse {
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Connection", "keep-alive")
+	} else {
+		header.Set("Content-Type", "application/x-ndjson")
+	}
+	sw.data.Response.WriteHeader(http.StatusOK)
+	sw.data.Streamed = true
+}
+
+func (sw *streamwriter) message(msg proto.Message) error {
+	if !sw.data.Streamed {
+		sw.start()
+	}
+	sw.data.Result = msg
+	b, err := sw.data.MarshalResult()
+	if err != nil {
+		return err
+	}
+	if sw.sse {
+		_, err = fmt.Fprintf(sw.data.Response, "data: %s\n\n", b)
+	} else {
+		_, err = fmt.Fprintf(sw.data.Response, "{\"result\":%s}\n", b)
+	}
+	if err == nil && sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+	return err
+}
+
+/*
+write the grpc status and the trailers as the final event
+*/
+func (sw *streamwriter) trailer(trailer metadata.MD, err error) error {
+	if !sw.data.Streamed {
+		sw.start()
+	}
+	b, e := trailerjson(trailer, err)
+	if e != nil {
+		return e
+	}
+	if sw.sse {
+		_, e = fmt.Fprintf(sw.data.Response, "event: trailer\ndata: %s\n\n", b)
+	} else {
+		_, e = fmt.Fprintf(sw.data.Response, "%s\n", b)
+	}
+	if e == nil && sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+	return e
+}
+
+/*
+the final event of the stream, it has the grpc status (google.rpc.Status) and the trailers
+*/
+func trailerjson(trailer metadata.MD, err error) ([]byte, error) {
+	st, e := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(status.Convert(err).Proto())
+	if e != nil {
+		return nil, e
+	}
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	md, e := json.Marshal(trailer)
+	if e != nil {
+		return nil, e
+	}
+	return []byte(fmt.Sprintf("{\"status\":%s,\"trailer\":%s}", st, md)), nil
+}
+
+/*
+call the server streaming method and push every response message to the http client,
+the context is canceled when the client disconnects so the backend stream is canceled too.
+the error before the first message is returned as the normal error response
+*/
+func (m *HttpMash) serverstream(ctx context.Context, conn *grpc.ClientConn, data *meta.MetaData, in, out proto.Message) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := grpc.NewClientStream(ctx, serverStreamDesc, conn, data.Descriptor.GetFullMethod())
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(in); err != nil && err != io.EOF {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return err
+	}
+	data.Callbackheader = &header
+
+	writer := newstreamwriter(data)
+	for {
+		msg := out.ProtoReflect().New().Interface()
+		err := stream.RecvMsg(msg)
+		if err == io.EOF {
+			return writer.trailer(stream.Trailer(), nil)
+		}
+		if err != nil {
+			if !data.Streamed {
+				return err
+			}
+			return writer.trailer(stream.Trailer(), err)
+		}
+		if err := writer.message(msg); err != nil {
+			//the client is gone
+			return nil
+		}
+	}
+}
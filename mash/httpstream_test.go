@@ -0,0 +1,178 @@
+package mash
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	meta "octopus/metadata"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+/*
+the grpc server of the streaming test, the request decides the stream:
+"two" sends two messages with the trailer, "fail" sends one message and fails, "refuse" fails before the first message
+*/
+func streamserver(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv any, stream grpc.ServerStream) error {
+		in := &wrapperspb.StringValue{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		switch in.Value {
+		case "refuse":
+			return status.Error(codes.PermissionDenied, "refused")
+		case "fail":
+			if err := stream.SendMsg(wrapperspb.String("a")); err != nil {
+				return err
+			}
+			return status.Error(codes.NotFound, "gone")
+		}
+		stream.SetTrailer(metadata.Pairs("x-trailer", "t"))
+		for _, v := range []string{"a", "b"} {
+			if err := stream.SendMsg(wrapperspb.String(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// the server stream pushed to the recorder with the accept header
+func streamto(t *testing.T, conn *grpc.ClientConn, accept, value string) (*httptest.ResponseRecorder, *meta.MetaData, error) {
+	t.Helper()
+	logger := zerolog.Nop()
+	r := httptest.NewRequest(http.MethodGet, "/v1/stream", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	data := &meta.MetaData{
+		Descriptor: &meta.Descriptor{URI: &meta.URI{ServiceName: "test.Stream", Method: "Watch"}, ServerStreaming: true},
+		HttpMeta:   &meta.HttpMeta{Request: r, Response: w},
+		Logger:     &logger,
+	}
+	err := (&HttpMash{}).serverstream(context.Background(), conn, data, wrapperspb.String(value), &wrapperspb.StringValue{})
+	return w, data, err
+}
+
+type streamtrailer struct {
+	Status struct {
+		Code    int32  `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+	Trailer map[string][]string `json:"trailer"`
+}
+
+func streamstatus(t *testing.T, b string) streamtrailer {
+	t.Helper()
+	var trailer streamtrailer
+	if err := json.Unmarshal([]byte(b), &trailer); err != nil {
+		t.Fatalf("the trailer %q is %v", b, err)
+	}
+	return trailer
+}
+
+/*
+the messages are the data events and the status with the trailers is the trailer event
+*/
+func TestServerStreamSSE(t *testing.T) {
+	conn := streamserver(t)
+	w, data, err := streamto(t, conn, "application/json, text/event-stream", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !data.Streamed || w.Code != http.StatusOK {
+		t.Fatalf("the stream is %v with %v", data.Streamed, w.Code)
+	}
+	if ct, cc := w.Header().Get("Content-Type"), w.Header().Get("Cache-Control"); ct != "text/event-stream" || cc != "no-cache" {
+		t.Fatalf("the headers are %q and %q", ct, cc)
+	}
+	events := strings.Split(w.Body.String(), "\n\n")
+	if len(events) != 4 || events[0] != `data: "a"` || events[1] != `data: "b"` || events[3] != "" {
+		t.Fatalf("the events are %q", events)
+	}
+	b, ok := strings.CutPrefix(events[2], "event: trailer\ndata: ")
+	if !ok {
+		t.Fatalf("the last event is %q", events[2])
+	}
+	trailer := streamstatus(t, b)
+	if trailer.Status.Code != int32(codes.OK) || len(trailer.Trailer["x-trailer"]) != 1 || trailer.Trailer["x-trailer"][0] != "t" {
+		t.Fatalf("the trailer is %+v", trailer)
+	}
+}
+
+/*
+the client without text/event-stream gets the newline-delimited json, the status is the last line
+*/
+func TestServerStreamNDJSON(t *testing.T) {
+	conn := streamserver(t)
+	w, _, err := streamto(t, conn, "", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("the content type is %q", ct)
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 3 || lines[0] != `{"result":"a"}` || lines[1] != `{"result":"b"}` {
+		t.Fatalf("the lines are %q", lines)
+	}
+	if trailer := streamstatus(t, lines[2]); trailer.Status.Code != int32(codes.OK) || trailer.Trailer["x-trailer"][0] != "t" {
+		t.Fatalf("the trailer is %+v", trailer)
+	}
+}
+
+/*
+the error after the first message is the trailing event because the status line is sent,
+the error before the first message is returned as the normal error response
+*/
+func TestServerStreamError(t *testing.T) {
+	conn := streamserver(t)
+	w, _, err := streamto(t, conn, "text/event-stream", "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := strings.Split(w.Body.String(), "\n\n")
+	if len(events) != 3 || events[0] != `data: "a"` {
+		t.Fatalf("the events are %q", events)
+	}
+	b, ok := strings.CutPrefix(events[1], "event: trailer\ndata: ")
+	if !ok {
+		t.Fatalf("the last event is %q", events[1])
+	}
+	if trailer := streamstatus(t, b); trailer.Status.Code != int32(codes.NotFound) || trailer.Status.Message != "gone" {
+		t.Fatalf("the trailer is %+v", trailer)
+	}
+
+	w, data, err := streamto(t, conn, "text/event-stream", "refuse")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("the error is %v", err)
+	}
+	if data.Streamed || w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Fatalf("the refused stream is written : %q", w.Body.String())
+	}
+}
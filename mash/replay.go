@@ -0,0 +1,153 @@
+package mash
+
+import (
+	"context"
+	"io"
+	meta "octopus/metadata"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// the frames kept for the retry at most, the longer client stream is not retried
+const maxreplayframes = 128
+
+/*
+the frames of the client in the grpc proxy, they are kept for the retry until the first response is relayed
+to the client (committed), after that the retry is not safe and the frames are dropped once they are sent
+*/
+type replay struct {
+	mu     sync.Mutex
+	frames []*emptypb.Empty
+	//the index of frames[0]
+	base int
+	//the end of the frames, io.EOF is the normal end
+	err error
+	//it is closed and renewed when a frame is pushed
+	notify    chan struct{}
+	keep      bool
+	committed bool
+	broken    bool
+	trailer   metadata.MD
+}
+
+func newreplay(keep bool) *replay {
+	return &replay{
+		notify: make(chan struct{}),
+		keep:   keep,
+	}
+}
+
+/*
+read the frames of the client, the frames are teed if the request is mirrored
+*/
+func (r *replay) read(ctx context.Context, src grpc.ServerStream, tee meta.Tee) {
+	for {
+		f := &emptypb.Empty{}
+		err := src.RecvMsg(f)
+		if tee != nil {
+			if err != nil {
+				tee.Close(err)
+			} else {
+				tee.Send(ctx, f)
+			}
+		}
+		r.push(f, err)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *replay) push(f *emptypb.Empty, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.err = err
+	} else {
+		r.frames = append(r.frames, f)
+		if len(r.frames) > maxreplayframes {
+			r.keep = false
+		}
+	}
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+/*
+the i-th frame of the client, it waits for the frame until the end of the frames or the ctx is done
+*/
+func (r *replay) frame(ctx context.Context, i int) (*emptypb.Empty, error) {
+	for {
+		r.mu.Lock()
+		if n := i - r.base; (!r.keep || r.committed) && n > 0 {
+			clear(r.frames[:n])
+			r.frames = r.frames[n:]
+			r.base = i
+		}
+		if i < r.base {
+			r.mu.Unlock()
+			return nil, status.Error(codes.Internal, "the frames of the client are not kept")
+		}
+		if i-r.base < len(r.frames) {
+			f := r.frames[i-r.base]
+			r.mu.Unlock()
+			return f, nil
+		}
+		if r.err != nil {
+			err := r.err
+			r.mu.Unlock()
+			return nil, err
+		}
+		notify := r.notify
+		r.mu.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+/*
+the first response is relayed to the client
+*/
+func (r *replay) commit() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.committed = true
+}
+
+func (r *replay) setbroken() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.broken = true
+}
+
+/*
+the request can be sent to another host again
+*/
+func (r *replay) replayable() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keep && !r.committed && !r.broken && (r.err == nil || r.err == io.EOF)
+}
+
+/*
+the trailer of the last attempt, it is set to the client when the request is finished
+*/
+func (r *replay) settrailer(trailer metadata.MD) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trailer = trailer
+}
+
+func (r *replay) gettrailer() metadata.MD {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.trailer
+}
@@ -0,0 +1,127 @@
+package mash
+
+import (
+	"context"
+	"octopus/config"
+	meta "octopus/metadata"
+	"octopus/pool"
+	"octopus/service"
+	"octopus/service/regcenter"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the static regcenter of the test
+type testcenter struct {
+	router *regcenter.Router
+}
+
+func (c *testcenter) LoadDic(logger *zerolog.Logger) (*regcenter.Router, meta.ProtoTable) {
+	return c.router, nil
+}
+
+func (c *testcenter) LoadDicNoTable(logger *zerolog.Logger) *regcenter.Router {
+	return c.router
+}
+
+func (c *testcenter) Watcher(*regcenter.RegContext) {}
+
+/*
+the mash with two hosts, the route is retried on Unavailable after the backoff of 100ms,
+the connections are not dialed until they are used so the hosts need not be up
+*/
+func retrymash(t *testing.T) (*mashbase, *meta.MetaData) {
+	t.Helper()
+	logger := zerolog.Nop()
+	hosts := map[string]*regcenter.HostInfo{
+		"127.0.0.1:9000": {Host: "127.0.0.1:9000", Weight: 1, Status: true},
+		"127.0.0.1:9001": {Host: "127.0.0.1:9001", Weight: 1, Status: true},
+	}
+	router := &regcenter.Router{
+		Descriptors: map[string]*meta.Descriptor{
+			"/proto.greeter/sayhello": {
+				URI:   &meta.URI{ServiceName: "proto.Greeter", Method: "SayHello"},
+				Retry: &meta.RetryPolicy{MaxAttempts: 3, Codes: []codes.Code{codes.Unavailable}, BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second},
+			},
+		},
+		Hosts: hosts,
+	}
+	m := &mashbase{logger: &logger}
+	m.routerservice = service.NewRouterService(&logger, config.Grpc, service.WithRegCenter(&testcenter{router: router}))
+	t.Cleanup(m.routerservice.Stop)
+	pools := make(map[string]pool.Pool)
+	for host := range hosts {
+		p, err := pool.New(host, pool.Options{Dial: pool.Dial, MaxIdle: 1, MaxActive: 1, MaxConcurrentStreams: 8, Reuse: true}, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[host] = p
+	}
+	m.pools.Store(&pools)
+	t.Cleanup(m.stoppool)
+
+	data := &meta.MetaData{
+		Descriptor: &meta.Descriptor{URI: &meta.URI{ServiceName: "proto.Greeter", Method: "SayHello"}},
+		Logger:     &logger,
+	}
+	if err := m.routerservice.MatcherUnit()(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	return m, data
+}
+
+/*
+the failed host is finished before the backoff, so the balance (such as LeastRequest) does not count it during the sleep
+*/
+func TestRetryFinishBeforeBackoff(t *testing.T) {
+	m, data := retrymash(t)
+	var failed, finished time.Time
+	done := data.Done
+	data.Done = func(err error) {
+		finished = time.Now()
+		if done != nil {
+			done(err)
+		}
+	}
+	targets := make([]string, 0, 2)
+	err := m.retry(context.Background(), data, func(ctx context.Context, conn *grpc.ClientConn) error {
+		targets = append(targets, data.Target)
+		if len(targets) == 1 {
+			failed = time.Now()
+			return status.Error(codes.Unavailable, "down")
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0] == targets[1] {
+		t.Fatalf("the targets are %v", targets)
+	}
+	//the backoff is 50ms at least
+	if finished.IsZero() || finished.Sub(failed) > 25*time.Millisecond {
+		t.Fatalf("the failed host is finished %v after the failure", finished.Sub(failed))
+	}
+	data.Finish(nil)
+}
+
+/*
+the request is canceled during the backoff, the error is of the ctx instead of the failed attempt
+*/
+func TestRetryCanceledInBackoff(t *testing.T) {
+	m, data := retrymash(t)
+	defer data.Finish(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := m.retry(ctx, data, func(ctx context.Context, conn *grpc.ClientConn) error {
+		return status.Error(codes.Unavailable, "down")
+	}, nil)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("the error is %v", err)
+	}
+}
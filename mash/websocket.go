@@ -0,0 +1,205 @@
+package mash
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"octopus/config"
+	meta "octopus/metadata"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// the inbound frame, the payload type is kept to answer in the same type
+type inframe struct {
+	msg         proto.Message
+	payloadtype byte
+}
+
+/*
+the codec of the websocket frame, the text frame is protojson and the binary frame is the proto wire format
+*/
+var protoframe = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, websocket.UnknownFrame, websocket.ErrNotSupported
+		}
+		return b, websocket.BinaryFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		frame, ok := v.(*inframe)
+		if !ok {
+			return websocket.ErrNotSupported
+		}
+		//the conn does not record the type of the received frame
+		frame.payloadtype = payloadType
+		if payloadType == websocket.BinaryFrame {
+			return proto.Unmarshal(data, frame.msg)
+		}
+		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, frame.msg)
+	},
+}
+
+/*
+this option is used to set the origins allowed to open the websocket, such as https://example.com, and "*" allows any origin.
+only the same origin and the client without the Origin header (not the browser) are allowed by default
+*/
+func WithWebsocketOrigins(origins ...string) meta.OptionBuilder[HttpMash] {
+	return func(m *HttpMash) {
+		m.origins = append(m.origins, origins...)
+	}
+}
+
+/*
+the handshake of the websocket rejects the cross-origin socket which is not allowed, so other sites can not open it
+*/
+func (m *HttpMash) checkorigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	cfg.Origin = u
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, v := range m.origins {
+		if v == "*" || strings.EqualFold(strings.TrimSuffix(v, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf(config.WEBSOCKETORIGIN, origin)
+}
+
+func isWebsocket(data *meta.MetaData) bool {
+	return strings.EqualFold(data.Request.Header.Get("Upgrade"), "websocket")
+}
+
+/*
+bridge the websocket to the client streaming or bidi streaming method,
+every inbound frame is sent as the request message and every response message is written back as a frame
+in the same type as the last inbound frame. the middlewares have been run before the upgrade.
+the grpc status and the trailers are sent as the final text frame, and the status of the stream is returned
+so it is recorded by the router and reported to the middlewares
+*/
+func (m *HttpMash) websocketstream(ctx context.Context, conn *grpc.ClientConn, data *meta.MetaData, in, out proto.Message) error {
+	if !isWebsocket(data) {
+		return status.Error(codes.InvalidArgument, config.WEBSOCKETONLY)
+	}
+	desc := &grpc.StreamDesc{
+		ClientStreams: true,
+		ServerStreams: data.Descriptor.ServerStreaming,
+	}
+	data.Streamed = true
+	var (
+		handshake error
+		streamerr error
+	)
+	websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			handshake = m.checkorigin(cfg, r)
+			return handshake
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			stream, err := grpc.NewClientStream(ctx, desc, conn, data.Descriptor.GetFullMethod())
+			if err != nil {
+				streamerr = err
+				m.sendtrailer(ws, nil, err)
+				return
+			}
+			//the client is gone if the frame can not be written
+			gone := func(err error) {
+				streamerr = status.Error(codes.Canceled, err.Error())
+			}
+
+			var frametype atomic.Int32
+			frametype.Store(websocket.TextFrame)
+			go func() {
+				for {
+					frame := &inframe{msg: in.ProtoReflect().New().Interface()}
+					if err := protoframe.Receive(ws, frame); err != nil {
+						if err == io.EOF {
+							stream.CloseSend()
+						} else {
+							//the frame can not be decoded or the client is gone
+							m.logger.Error().Err(err).Msg(err.Error())
+							cancel()
+						}
+						return
+					}
+					frametype.Store(int32(frame.payloadtype))
+					if err := stream.SendMsg(frame.msg); err != nil {
+						return
+					}
+				}
+			}()
+
+			for {
+				msg := out.ProtoReflect().New().Interface()
+				err := stream.RecvMsg(msg)
+				if err == io.EOF {
+					m.sendtrailer(ws, stream.Trailer(), nil)
+					return
+				}
+				if err != nil {
+					streamerr = err
+					m.sendtrailer(ws, stream.Trailer(), err)
+					return
+				}
+				if frametype.Load() == websocket.BinaryFrame {
+					b, err := proto.Marshal(msg)
+					if err == nil {
+						err = protoframe.Send(ws, b)
+					}
+					if err != nil {
+						gone(err)
+						return
+					}
+					continue
+				}
+				data.Result = msg
+				b, err := data.MarshalResult()
+				if err != nil {
+					streamerr = err
+					m.sendtrailer(ws, stream.Trailer(), err)
+					return
+				}
+				if err := websocket.Message.Send(ws, string(b)); err != nil {
+					gone(err)
+					return
+				}
+			}
+		},
+	}.ServeHTTP(data.Response, data.Request)
+	if handshake != nil {
+		return status.Error(codes.PermissionDenied, handshake.Error())
+	}
+	return streamerr
+}
+
+func (m *HttpMash) sendtrailer(ws *websocket.Conn, trailer metadata.MD, err error) {
+	b, e := trailerjson(trailer, err)
+	if e != nil {
+		m.logger.Error().Err(e).Msg(e.Error())
+		return
+	}
+	websocket.Message.Send(ws, string(b))
+}
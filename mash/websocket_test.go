@@ -0,0 +1,225 @@
+package mash
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	meta "octopus/metadata"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+/*
+the bidi streaming server of the websocket test, every message is sent back in upper case,
+"end" finishes the stream with the trailer and "fail" fails it
+*/
+func chatserver(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv any, stream grpc.ServerStream) error {
+		for {
+			in := &wrapperspb.StringValue{}
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+			switch in.Value {
+			case "end":
+				stream.SetTrailer(metadata.Pairs("x-trailer", "t"))
+				return nil
+			case "fail":
+				return status.Error(codes.NotFound, "gone")
+			}
+			if err := stream.SendMsg(wrapperspb.String(strings.ToUpper(in.Value))); err != nil {
+				return err
+			}
+		}
+	}))
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+/*
+the http server which bridges the websocket to the chat server, the status of every stream is sent to the channel
+*/
+func websocketserver(t *testing.T, origins ...string) (string, <-chan error) {
+	t.Helper()
+	logger := zerolog.Nop()
+	m := &HttpMash{mashbase: &mashbase{logger: &logger}, origins: origins}
+	conn := chatserver(t)
+	done := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := &meta.MetaData{
+			Descriptor: &meta.Descriptor{URI: &meta.URI{ServiceName: "test.Chat", Method: "Talk"}, ClientStreaming: true, ServerStreaming: true},
+			HttpMeta:   &meta.HttpMeta{Request: r, Response: w},
+			Logger:     &logger,
+		}
+		done <- m.websocketstream(r.Context(), conn, data, &wrapperspb.StringValue{}, &wrapperspb.StringValue{})
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, done
+}
+
+func dialwebsocket(url, origin string) (*websocket.Conn, error) {
+	cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(url, "http")+"/v1/chat", origin)
+	if err != nil {
+		return nil, err
+	}
+	return websocket.DialConfig(cfg)
+}
+
+/*
+the text frame is answered by the json frame and the binary frame by the proto frame,
+the status and the trailers are the final text frame and the status is returned by the bridge
+*/
+func TestWebsocketBridge(t *testing.T) {
+	url, done := websocketserver(t)
+	ws, err := dialwebsocket(url, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := websocket.Message.Send(ws, `"hello"`); err != nil {
+		t.Fatal(err)
+	}
+	var text string
+	if err := websocket.Message.Receive(ws, &text); err != nil || text != `"HELLO"` {
+		t.Fatalf("the text frame is %q with %v", text, err)
+	}
+	b, _ := proto.Marshal(wrapperspb.String("bin"))
+	if err := websocket.Message.Send(ws, b); err != nil {
+		t.Fatal(err)
+	}
+	var frame []byte
+	if err := websocket.Message.Receive(ws, &frame); err != nil {
+		t.Fatal(err)
+	}
+	msg := &wrapperspb.StringValue{}
+	if err := proto.Unmarshal(frame, msg); err != nil || msg.Value != "BIN" {
+		t.Fatalf("the binary frame %q is %v with %v", frame, msg, err)
+	}
+
+	websocket.Message.Send(ws, `"end"`)
+	if err := websocket.Message.Receive(ws, &text); err != nil {
+		t.Fatal(err)
+	}
+	trailer := streamstatus(t, text)
+	if trailer.Status.Code != int32(codes.OK) || len(trailer.Trailer["x-trailer"]) != 1 || trailer.Trailer["x-trailer"][0] != "t" {
+		t.Fatalf("the trailer is %+v", trailer)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("the status of the stream is %v", err)
+	}
+}
+
+/*
+the error of the backend is the final frame and the status of the stream
+*/
+func TestWebsocketError(t *testing.T) {
+	url, done := websocketserver(t)
+	ws, err := dialwebsocket(url, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	websocket.Message.Send(ws, `"fail"`)
+	var text string
+	if err := websocket.Message.Receive(ws, &text); err != nil {
+		t.Fatal(err)
+	}
+	if trailer := streamstatus(t, text); trailer.Status.Code != int32(codes.NotFound) || trailer.Status.Message != "gone" {
+		t.Fatalf("the trailer is %+v", trailer)
+	}
+	if err := <-done; status.Code(err) != codes.NotFound {
+		t.Fatalf("the status of the stream is %v", err)
+	}
+}
+
+/*
+the cross-origin socket is refused by the handshake unless the origin is allowed
+*/
+func TestWebsocketOrigin(t *testing.T) {
+	url, done := websocketserver(t)
+	if ws, err := dialwebsocket(url, "https://evil.example.com"); err == nil {
+		ws.Close()
+		t.Fatal("the cross-origin websocket is opened")
+	}
+	if err := <-done; status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("the status of the refused socket is %v", err)
+	}
+
+	url, done = websocketserver(t, "https://app.example.com/")
+	ws, err := dialwebsocket(url, "https://app.example.com")
+	if err != nil {
+		t.Fatalf("the allowed origin is refused : %v", err)
+	}
+	websocket.Message.Send(ws, `"end"`)
+	var text string
+	websocket.Message.Receive(ws, &text)
+	ws.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("the status of the stream is %v", err)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	for _, v := range []struct {
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		//the client which is not the browser
+		{nil, "", true},
+		{nil, "http://gateway.local:8080", true},
+		{nil, "http://GATEWAY.local:8080", true},
+		{nil, "http://gateway.local", false},
+		{nil, "https://evil.example.com", false},
+		{[]string{"https://app.example.com"}, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "http://app.example.com", false},
+		{[]string{"*"}, "https://evil.example.com", true},
+	} {
+		m := &HttpMash{origins: v.origins}
+		r := httptest.NewRequest(http.MethodGet, "http://gateway.local:8080/v1/chat", nil)
+		if v.origin != "" {
+			r.Header.Set("Origin", v.origin)
+		}
+		if err := m.checkorigin(&websocket.Config{}, r); (err == nil) != v.allowed {
+			t.Fatalf("the origin %q with %v is %v", v.origin, v.origins, err)
+		}
+	}
+}
+
+/*
+the streaming method is refused without the upgrade, as only the websocket can send the frames
+*/
+func TestWebsocketOnly(t *testing.T) {
+	logger := zerolog.Nop()
+	m := &HttpMash{mashbase: &mashbase{logger: &logger}}
+	data := &meta.MetaData{
+		Descriptor: &meta.Descriptor{URI: &meta.URI{ServiceName: "test.Chat", Method: "Talk"}, ClientStreaming: true},
+		HttpMeta:   &meta.HttpMeta{Request: httptest.NewRequest(http.MethodPost, "/v1/chat", nil), Response: httptest.NewRecorder()},
+	}
+	if err := m.websocketstream(context.Background(), nil, data, nil, nil); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("the request without the upgrade is %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package metadata
+
+import (
+	"fmt"
+	"net/url"
+	"octopus/config"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+type segmentKind int
+
+const (
+	literalSegment segmentKind = iota
+	wildSegment
+	deepWildSegment
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+type variable struct {
+	fieldPath string
+	start     int
+	end       int
+}
+
+// PathTemplate is the compiled form of a google.api.http path template, for example
+// /v1/users/{user_id} or /v1/{name=shelves/*/books/**}:publish
+type PathTemplate struct {
+	template  string
+	segments  []segment
+	variables []variable
+	verb      string
+	deepIndex int
+}
+
+type templateParser struct {
+	input string
+	pos   int
+	tpl   *PathTemplate
+}
+
+func ParseTemplate(template string) (*PathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf(config.WRONGTEMPLATE, template)
+	}
+	p := &templateParser{
+		input: template,
+		pos:   1,
+		tpl: &PathTemplate{
+			template:  template,
+			deepIndex: -1,
+		},
+	}
+	if err := p.parseSegments(false); err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.input) && p.input[p.pos] == ':' {
+		p.tpl.verb = p.input[p.pos+1:]
+		p.pos = len(p.input)
+	}
+	if p.pos != len(p.input) || strings.Contains(p.tpl.verb, "/") {
+		return nil, fmt.Errorf(config.WRONGTEMPLATE, template)
+	}
+	return p.tpl, nil
+}
+
+func (p *templateParser) parseSegments(invariable bool) error {
+	for {
+		if err := p.parseSegment(invariable); err != nil {
+			return err
+		}
+		if p.pos >= len(p.input) || p.input[p.pos] != '/' {
+			return nil
+		}
+		p.pos++
+	}
+}
+
+func (p *templateParser) parseSegment(invariable bool) error {
+	if p.pos >= len(p.input) {
+		return fmt.Errorf(config.WRONGTEMPLATE, p.input)
+	}
+	switch {
+	case strings.HasPrefix(p.input[p.pos:], "**"):
+		if p.tpl.deepIndex >= 0 {
+			return fmt.Errorf(config.WRONGTEMPLATE, p.input)
+		}
+		p.tpl.deepIndex = len(p.tpl.segments)
+		p.tpl.segments = append(p.tpl.segments, segment{kind: deepWildSegment})
+		p.pos += 2
+	case p.input[p.pos] == '*':
+		p.tpl.segments = append(p.tpl.segments, segment{kind: wildSegment})
+		p.pos++
+	case p.input[p.pos] == '{':
+		if invariable {
+			return fmt.Errorf(config.WRONGTEMPLATE, p.input)
+		}
+		return p.parseVariable()
+	default:
+		end := strings.IndexAny(p.input[p.pos:], "/:{}")
+		if end == -1 {
+			end = len(p.input) - p.pos
+		}
+		if end == 0 {
+			return fmt.Errorf(config.WRONGTEMPLATE, p.input)
+		}
+		p.tpl.segments = append(p.tpl.segments, segment{kind: literalSegment, value: p.input[p.pos : p.pos+end]})
+		p.pos += end
+	}
+	return nil
+}
+
+func (p *templateParser) parseVariable() error {
+	p.pos++
+	end := strings.IndexAny(p.input[p.pos:], "=}")
+	if end <= 0 {
+		return fmt.Errorf(config.WRONGTEMPLATE, p.input)
+	}
+	v := variable{
+		fieldPath: p.input[p.pos : p.pos+end],
+		start:     len(p.tpl.segments),
+	}
+	p.pos += end
+	if p.input[p.pos] == '=' {
+		p.pos++
+		if err := p.parseSegments(true); err != nil {
+			return err
+		}
+	} else {
+		p.tpl.segments = append(p.tpl.segments, segment{kind: wildSegment})
+	}
+	if p.pos >= len(p.input) || p.input[p.pos] != '}' {
+		return fmt.Errorf(config.WRONGTEMPLATE, p.input)
+	}
+	p.pos++
+	v.end = len(p.tpl.segments)
+	p.tpl.variables = append(p.tpl.variables, v)
+	return nil
+}
+
+/*
+Match checks the escaped url path against the template and returns the bound variables
+keyed by their field path
+*/
+func (t *PathTemplate) Match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+	if len(t.verb) > 0 {
+		if !strings.HasSuffix(path, ":"+t.verb) {
+			return nil, false
+		}
+		path = path[:len(path)-len(t.verb)-1]
+	}
+	parts := strings.Split(path, "/")
+
+	// index maps each template segment to the range of path parts it consumed
+	index := make([]int, len(t.segments)+1)
+	if t.deepIndex < 0 {
+		if len(parts) != len(t.segments) {
+			return nil, false
+		}
+		for i := range t.segments {
+			index[i] = i
+		}
+	} else {
+		tail := len(t.segments) - t.deepIndex - 1
+		if len(parts) < len(t.segments)-1 {
+			return nil, false
+		}
+		for i := 0; i <= t.deepIndex; i++ {
+			index[i] = i
+		}
+		for i := t.deepIndex + 1; i < len(t.segments); i++ {
+			index[i] = len(parts) - tail + i - t.deepIndex - 1
+		}
+	}
+	index[len(t.segments)] = len(parts)
+
+	for i, seg := range t.segments {
+		switch seg.kind {
+		case literalSegment:
+			if parts[index[i]] != seg.value {
+				return nil, false
+			}
+		case wildSegment:
+			if len(parts[index[i]]) == 0 {
+				return nil, false
+			}
+		}
+	}
+
+	vars := make(map[string]string, len(t.variables))
+	for _, v := range t.variables {
+		value := strings.Join(parts[index[v.start]:index[v.end]], "/")
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+		vars[v.fieldPath] = value
+	}
+	return vars, true
+}
+
+func (t *PathTemplate) String() string {
+	return t.template
+}
+
+/*
+HttpRule is one binding of a grpc method to a http method and path template,
+it is read from the google.api.http option of the method
+*/
+type HttpRule struct {
+	*Descriptor
+	Template *PathTemplate
+}
+
+func (r *HttpRule) Match(httpmethod, path string) (map[string]string, bool) {
+	if !strings.EqualFold(r.HttpMethod, httpmethod) {
+		return nil, false
+	}
+	return r.Template.Match(path)
+}
+
+/*
+BuildHttpRules converts the google.api.http option (including the additional bindings)
+to the http rules of the descriptor
+*/
+func BuildHttpRules(descriptor *Descriptor, rule *annotations.HttpRule) ([]*HttpRule, error) {
+	rules := make([]*HttpRule, 0, len(rule.GetAdditionalBindings())+1)
+	bindings := append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...)
+	for _, binding := range bindings {
+		var httpmethod, template string
+		switch pattern := binding.GetPattern().(type) {
+		case *annotations.HttpRule_Get:
+			httpmethod, template = "GET", pattern.Get
+		case *annotations.HttpRule_Put:
+			httpmethod, template = "PUT", pattern.Put
+		case *annotations.HttpRule_Post:
+			httpmethod, template = "POST", pattern.Post
+		case *annotations.HttpRule_Delete:
+			httpmethod, template = "DELETE", pattern.Delete
+		case *annotations.HttpRule_Patch:
+			httpmethod, template = "PATCH", pattern.Patch
+		case *annotations.HttpRule_Custom:
+			httpmethod, template = strings.ToUpper(pattern.Custom.GetKind()), pattern.Custom.GetPath()
+		default:
+			continue
+		}
+		tpl, err := ParseTemplate(template)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &HttpRule{
+			Descriptor: &Descriptor{
+				URI: &URI{
+					HttpMethod:  httpmethod,
+					ServiceName: descriptor.ServiceName,
+					Method:      descriptor.Method,
+					Host:        descriptor.Host,
+				},
+				RequestMessage:  descriptor.RequestMessage,
+				ResponseMessage: descriptor.ResponseMessage,
+				Body:            binding.GetBody(),
+				ResponseBody:    binding.GetResponseBody(),
+			},
+			Template: tpl,
+		})
+	}
+	return rules, nil
+}
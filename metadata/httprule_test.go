@@ -0,0 +1,124 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+func TestParseTemplate(t *testing.T) {
+	for _, template := range []string{
+		"/v1/users/{user_id}",
+		"/v1/{name=shelves/*/books/*}",
+		"/v1/{name=shelves/*/books/**}:publish",
+		"/v1/files/**",
+		"/v1/*/items:batchGet",
+	} {
+		tpl, err := ParseTemplate(template)
+		if err != nil {
+			t.Fatalf("the template %v is %v", template, err)
+		}
+		if tpl.String() != template {
+			t.Fatalf("the template %v is %v", template, tpl)
+		}
+	}
+	for _, template := range []string{
+		"",
+		"v1/users",
+		"/v1/{id",
+		"/v1/{}",
+		"/v1/{a={b}}",
+		"/v1/**/x/**",
+		"/v1//users",
+		"/v1/users/",
+		"/v1/users:a/b",
+		"/v1/users}",
+	} {
+		if _, err := ParseTemplate(template); err == nil {
+			t.Fatalf("the wrong template %q is parsed", template)
+		}
+	}
+}
+
+func TestTemplateMatch(t *testing.T) {
+	for _, v := range []struct {
+		template string
+		path     string
+		vars     map[string]string
+	}{
+		{"/v1/users/{user_id}", "/v1/users/42", map[string]string{"user_id": "42"}},
+		{"/v1/users/{user_id}", "/v1/users/42/books", nil},
+		{"/v1/users/{user_id}", "/v1/users/", nil},
+		{"/v1/users/{user_id}", "/v1/people/42", nil},
+		{"/v1/users/{user.id}/books/{book}", "/v1/users/7/books/go", map[string]string{"user.id": "7", "book": "go"}},
+		//the variable is unescaped
+		{"/v1/users/{name}", "/v1/users/a%20b", map[string]string{"name": "a b"}},
+		{"/v1/{name=shelves/*}", "/v1/shelves/1", map[string]string{"name": "shelves/1"}},
+		{"/v1/{name=shelves/*}", "/v1/books/1", nil},
+		//the ** takes the rest of the segments and the verb is matched first
+		{"/v1/{name=shelves/*/books/**}:publish", "/v1/shelves/1/books/a/b:publish", map[string]string{"name": "shelves/1/books/a/b"}},
+		{"/v1/{name=shelves/*/books/**}:publish", "/v1/shelves/1/books/a/b", nil},
+		{"/v1/{name=shelves/*/books/**}:publish", "/v1/shelves/1/books/a/b:delete", nil},
+		{"/v1/files/{path=**}/meta", "/v1/files/a/b/c/meta", map[string]string{"path": "a/b/c"}},
+		{"/v1/files/{path=**}/meta", "/v1/files/a/b/c", nil},
+		{"/v1/**", "/v1", map[string]string{}},
+		{"/v1/*/items:batchGet", "/v1/shop/items:batchGet", map[string]string{}},
+	} {
+		tpl, err := ParseTemplate(v.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars, ok := tpl.Match(v.path)
+		if ok != (v.vars != nil) || (ok && !reflect.DeepEqual(vars, v.vars)) {
+			t.Fatalf("the path %v of the template %v is matched by %v with %v", v.path, v.template, ok, vars)
+		}
+	}
+}
+
+func TestBuildHttpRules(t *testing.T) {
+	descriptor := &Descriptor{
+		URI:             &URI{ServiceName: "proto.Library", Method: "GetBook"},
+		RequestMessage:  "proto.GetBookRequest",
+		ResponseMessage: "proto.Book",
+	}
+	rules, err := BuildHttpRules(descriptor, &annotations.HttpRule{
+		Pattern:      &annotations.HttpRule_Get{Get: "/v1/books/{id}"},
+		ResponseBody: "book",
+		AdditionalBindings: []*annotations.HttpRule{
+			{Pattern: &annotations.HttpRule_Post{Post: "/v1/books:get"}, Body: "*"},
+			{Pattern: &annotations.HttpRule_Custom{Custom: &annotations.CustomHttpPattern{Kind: "head", Path: "/v1/books/{id}"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("the rules are %v", rules)
+	}
+	for i, v := range []struct {
+		httpmethod, template, body, responsebody string
+	}{
+		{"GET", "/v1/books/{id}", "", "book"},
+		{"POST", "/v1/books:get", "*", ""},
+		{"HEAD", "/v1/books/{id}", "", ""},
+	} {
+		rule := rules[i]
+		if rule.HttpMethod != v.httpmethod || rule.Template.String() != v.template || rule.Body != v.body || rule.ResponseBody != v.responsebody {
+			t.Fatalf("the rule %v is %v %v with the body %q and %q", i, rule.HttpMethod, rule.Template, rule.Body, rule.ResponseBody)
+		}
+		if rule.ServiceName != "proto.Library" || rule.Method != "GetBook" || rule.RequestMessage != "proto.GetBookRequest" {
+			t.Fatalf("the rule %v is %+v", i, rule.Descriptor)
+		}
+	}
+	if _, ok := rules[0].Match("get", "/v1/books/1"); !ok {
+		t.Fatal("the http method is not matched ignoring the case")
+	}
+	if _, ok := rules[0].Match("POST", "/v1/books/1"); ok {
+		t.Fatal("the other http method is matched")
+	}
+
+	if _, err := BuildHttpRules(descriptor, &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/{id"}}); err == nil {
+		t.Fatal("the rule of the wrong template is built")
+	}
+}
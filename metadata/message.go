@@ -0,0 +1,190 @@
+package metadata
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/*
+the raw json of the request message, the path is the field of the message such as the body of the http rule,
+it is empty for the whole message
+*/
+type rawfield struct {
+	path string
+	data []byte
+}
+
+/*
+the string values of the field, such as the path variables, the query and the form
+*/
+type valuefield struct {
+	path   string
+	values []string
+}
+
+/*
+decode the request into the message, the raw json is decoded by protojson so the 64-bit integers keep the precision,
+then the values are set by the field descriptors, so the bool and the numeric path variables are parsed by the type of the field
+*/
+func (h *HttpMeta) decode(msg proto.Message) error {
+	options := protojson.UnmarshalOptions{DiscardUnknown: true}
+	for _, raw := range h.bodies {
+		data := raw.data
+		if raw.path != "" && raw.path != "*" {
+			data = wrapfield(raw.path, data)
+		}
+		part := msg.ProtoReflect().New().Interface()
+		if err := options.Unmarshal(data, part); err != nil {
+			return err
+		}
+		proto.Merge(msg, part)
+	}
+	for _, field := range h.fields {
+		if err := setfield(msg.ProtoReflect(), field.path, field.values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the raw json of the field a.b is {"a":{"b":raw}}
+func wrapfield(path string, data []byte) []byte {
+	names := strings.Split(path, ".")
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("{" + strconv.Quote(name) + ":")
+	}
+	b.Write(data)
+	b.WriteString(strings.Repeat("}", len(names)))
+	return []byte(b.String())
+}
+
+/*
+set the field of the path such as user.id, the unknown field is discarded as protojson does,
+the repeated field takes all the values and the others take the first one
+*/
+func setfield(msg protoreflect.Message, path string, values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fields := msg.Descriptor().Fields()
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = fields.ByJSONName(name)
+		}
+		if fd == nil {
+			return nil
+		}
+		if i < len(names)-1 {
+			if fd.Message() == nil || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("the field %v of %v is not a message", name, path)
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+		switch {
+		case fd.IsMap():
+			return fmt.Errorf("the map field %v can not be set by %v", path, values)
+		case fd.IsList():
+			list := msg.Mutable(fd).List()
+			for _, v := range values {
+				value, ok, err := parsevalue(fd, func() protoreflect.Message { return list.NewElement().Message() }, v)
+				if err != nil {
+					return err
+				}
+				if ok {
+					list.Append(value)
+				}
+			}
+		default:
+			value, ok, err := parsevalue(fd, func() protoreflect.Message { return msg.NewField(fd).Message() }, values[0])
+			if err != nil {
+				return err
+			}
+			if ok {
+				msg.Set(fd, value)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+parse the string by the kind of the field, the empty string is ignored if the field is not a string,
+the message field (such as google.protobuf.Timestamp) is parsed as its json string
+*/
+func parsevalue(fd protoreflect.FieldDescriptor, newmessage func() protoreflect.Message, s string) (protoreflect.Value, bool, error) {
+	kind := fd.Kind()
+	if s == "" && kind != protoreflect.StringKind && kind != protoreflect.BytesKind {
+		return protoreflect.Value{}, false, nil
+	}
+	var (
+		value protoreflect.Value
+		err   error
+	)
+	switch kind {
+	case protoreflect.BoolKind:
+		var v bool
+		v, err = strconv.ParseBool(s)
+		value = protoreflect.ValueOfBool(v)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var v int64
+		v, err = strconv.ParseInt(s, 10, 32)
+		value = protoreflect.ValueOfInt32(int32(v))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var v int64
+		v, err = strconv.ParseInt(s, 10, 64)
+		value = protoreflect.ValueOfInt64(v)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 32)
+		value = protoreflect.ValueOfUint32(uint32(v))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 64)
+		value = protoreflect.ValueOfUint64(v)
+	case protoreflect.FloatKind:
+		var v float64
+		v, err = strconv.ParseFloat(s, 32)
+		value = protoreflect.ValueOfFloat32(float32(v))
+	case protoreflect.DoubleKind:
+		var v float64
+		v, err = strconv.ParseFloat(s, 64)
+		value = protoreflect.ValueOfFloat64(v)
+	case protoreflect.StringKind:
+		value = protoreflect.ValueOfString(s)
+	case protoreflect.BytesKind:
+		var v []byte
+		if v, err = base64.StdEncoding.DecodeString(s); err != nil {
+			v, err = base64.URLEncoding.DecodeString(s)
+		}
+		value = protoreflect.ValueOfBytes(v)
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			value = protoreflect.ValueOfEnum(ev.Number())
+		} else {
+			var v int64
+			v, err = strconv.ParseInt(s, 10, 32)
+			value = protoreflect.ValueOfEnum(protoreflect.EnumNumber(v))
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		msg := newmessage()
+		options := protojson.UnmarshalOptions{DiscardUnknown: true}
+		if err = options.Unmarshal([]byte(strconv.Quote(s)), msg.Interface()); err != nil {
+			err = options.Unmarshal([]byte(s), msg.Interface())
+		}
+		value = protoreflect.ValueOfMessage(msg)
+	}
+	if err != nil {
+		return protoreflect.Value{}, false, fmt.Errorf("the value %q of the field %v is wrong : %w", s, fd.Name(), err)
+	}
+	return value, true, nil
+}
@@ -0,0 +1,166 @@
+package metadata
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*
+the request message of the test, it has the 64-bit integers, the bool, the repeated field, the enum,
+the nested message and the well-known type which are set differently by the path and the query
+*/
+func testmessage(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, typename string, repeated bool) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Type: kind.Enum(), Label: label.Enum()}
+		if typename != "" {
+			f.TypeName = proto.String(typename)
+		}
+		return f
+	}
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test/request.proto"),
+		Package:    proto.String("test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Request"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, "", false),
+					field("active", 2, descriptorpb.FieldDescriptorProto_TYPE_BOOL, "", false),
+					field("tags", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", true),
+					field("kind", 4, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Kind", false),
+					field("inner", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Inner", false),
+					field("at", 6, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp", false),
+					field("count", 7, descriptorpb.FieldDescriptorProto_TYPE_UINT32, "", false),
+					field("user_name", 8, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+				},
+			},
+			{
+				Name: proto.String("Inner"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+					field("big", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64, "", false),
+				},
+			},
+		},
+		EnumType: []*descriptorpb.EnumDescriptorProto{
+			{
+				Name: proto.String("Kind"),
+				Value: []*descriptorpb.EnumValueDescriptorProto{
+					{Name: proto.String("KIND_UNKNOWN"), Number: proto.Int32(0)},
+					{Name: proto.String("KIND_BOOK"), Number: proto.Int32(1)},
+				},
+			},
+		},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Messages().ByName("Request")
+}
+
+// the request formatted by the rule and decoded into the message
+func transcode(t *testing.T, md protoreflect.MessageDescriptor, httpmethod, template, body, url, payload string) (*dynamicpb.Message, error) {
+	t.Helper()
+	tpl, err := ParseTemplate(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := &HttpRule{
+		Descriptor: &Descriptor{URI: &URI{HttpMethod: httpmethod, ServiceName: "test.Service", Method: "Get"}, Body: body},
+		Template:   tpl,
+	}
+	r := httptest.NewRequest(httpmethod, url, strings.NewReader(payload))
+	vars, ok := rule.Match(r.Method, r.URL.EscapedPath())
+	if !ok {
+		t.Fatalf("the url %v is not matched by %v", url, template)
+	}
+	data := &MetaData{HttpMeta: &HttpMeta{Request: r}}
+	if err := data.FormatRule(rule, vars); err != nil {
+		return nil, err
+	}
+	msg := dynamicpb.NewMessage(md)
+	return msg, data.HttpMeta.decode(msg)
+}
+
+func messagefield(msg *dynamicpb.Message, name string) protoreflect.Value {
+	return msg.Get(msg.Descriptor().Fields().ByName(protoreflect.Name(name)))
+}
+
+/*
+the path variables and the query are parsed by the types of the fields, the body is bound to the field of the rule
+*/
+func TestFormatRuleBinding(t *testing.T) {
+	md := testmessage(t)
+	msg, err := transcode(t, md, "POST", "/v1/requests/{id}", "inner", "/v1/requests/9007199254740993?active=true&tags=a&tags=b&kind=KIND_BOOK&at=2024-01-02T03:04:05Z&count=7&userName=x", `{"name":"n","big":"18446744073709551615"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := messagefield(msg, "id").Int(); id != 9007199254740993 {
+		t.Fatalf("the id of the path is %v", id)
+	}
+	if !messagefield(msg, "active").Bool() || messagefield(msg, "kind").Enum() != 1 || messagefield(msg, "count").Uint() != 7 || messagefield(msg, "user_name").String() != "x" {
+		t.Fatalf("the query is decoded to %v", msg)
+	}
+	if tags := messagefield(msg, "tags").List(); tags.Len() != 2 || tags.Get(0).String() != "a" || tags.Get(1).String() != "b" {
+		t.Fatalf("the repeated query is decoded to %v", msg)
+	}
+	at := &timestamppb.Timestamp{}
+	proto.Merge(at, messagefield(msg, "at").Message().Interface())
+	if !at.AsTime().Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("the timestamp of the query is %v", at.AsTime())
+	}
+	inner := messagefield(msg, "inner").Message()
+	if name, big := inner.Get(inner.Descriptor().Fields().ByName("name")).String(), inner.Get(inner.Descriptor().Fields().ByName("big")).Uint(); name != "n" || big != 18446744073709551615 {
+		t.Fatalf("the body field is decoded to %v and %v", name, big)
+	}
+}
+
+/*
+the whole body is the message, the query is not bound and the path variable is set over the body
+*/
+func TestFormatRuleBody(t *testing.T) {
+	md := testmessage(t)
+	msg, err := transcode(t, md, "PUT", "/v1/requests/{id}", "*", "/v1/requests/5?active=true", `{"id":1,"tags":["c"],"inner":{"name":"m"},"kind":"KIND_BOOK","unknown":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messagefield(msg, "id").Int() != 5 || messagefield(msg, "active").Bool() || messagefield(msg, "tags").List().Len() != 1 || messagefield(msg, "kind").Enum() != 1 {
+		t.Fatalf("the body is decoded to %v", msg)
+	}
+
+	for _, v := range []struct {
+		url, body, payload string
+	}{
+		{"/v1/requests/abc", "", ""},
+		{"/v1/requests/1?active=maybe", "", ""},
+		{"/v1/requests/1?count=-1", "", ""},
+		{"/v1/requests/1", "*", `{"id":"x"}`},
+	} {
+		if _, err := transcode(t, md, "POST", "/v1/requests/{id}", v.body, v.url, v.payload); err == nil {
+			t.Fatalf("the wrong request %v %v is decoded", v.url, v.payload)
+		}
+	}
+	//the body which is not the json is refused by the rule
+	if _, err := transcode(t, md, "POST", "/v1/requests/{id}", "*", "/v1/requests/1", "id=1"); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("the wrong body is %v", err)
+	}
+}
@@ -4,18 +4,28 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"octopus/config"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/modern-go/reflect2"
 	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 type OptionBuilder[T any] func(*T)
@@ -32,7 +42,36 @@ type MetaData struct {
 	Descriptor *Descriptor
 	Logger     *zerolog.Logger
 	Target     string
-	Result     any
+	//the feedback of the balance, it is called by Finish with the outcome when the request to the Target is finished
+	Done func(err error)
+	//the copy of the request messages, such as the shadow traffic of the mirror
+	Tee Tee
+	//the guard of the requests to the Target, such as the circuit breaker, it is added by AddGuard
+	Guard  Guard
+	Result any
+	//the callbacks of the finished request, such as the release of the concurrency limit
+	completes []func(err error)
+}
+
+/*
+the tee is set by the middleware and fed with the request messages by the mash,
+the messages are copied by the tee so they are not changed by the mash after Send
+*/
+type Tee interface {
+	//the ctx carries the outgoing metadata of the request
+	Send(ctx context.Context, msg proto.Message)
+	//the request messages are finished, the err is nil or io.EOF if the request is not broken
+	Close(err error)
+}
+
+/*
+the guard is set by the middleware, the mash asks it before every attempt to the Target
+and reports the outcome of the allowed attempt
+*/
+type Guard interface {
+	//the error is returned to the client if the request to the target is not allowed
+	Allow(target string) error
+	Report(target string, err error)
 }
 
 type HttpMeta struct {
@@ -40,6 +79,11 @@ type HttpMeta struct {
 	Payload        map[string]any
 	Response       http.ResponseWriter
 	Callbackheader *metadata.MD
+	//the response has been written by the stream
+	Streamed bool
+	//the request message in the raw json and the string values, it is decoded by GetProtoMessage
+	bodies []rawfield
+	fields []valuefield
 }
 
 type GrpcMeta struct {
@@ -49,10 +93,6 @@ type GrpcMeta struct {
 
 type PathHandler func(string, *zerolog.Logger) (*URI, error)
 
-type ErrorMeta struct {
-	Error string `json:"error"`
-}
-
 type URI struct {
 	HttpMethod  string
 	ServiceName string
@@ -63,8 +103,126 @@ type URI struct {
 
 type Descriptor struct {
 	*URI
+	//the upstream cluster of the route, it is empty if the route uses the global hosts
+	Cluster string
+	//the weighted clusters and the matched clusters of the canary release
+	Splits  []Split
+	Matches []SplitMatch
+	//the retry policy of the route, the request is not retried if it is nil
+	Retry *RetryPolicy
+	//the default timeout of the route and the max of the timeout requested by the client, zero is no limit,
+	//the Timeout of the request is the effective one set by the router
+	Timeout         time.Duration
+	MaxTimeout      time.Duration
 	RequestMessage  string
 	ResponseMessage string
+	//the body and response_body of the google.api.http rule
+	Body         string
+	ResponseBody string
+	//the streaming type of the grpc method
+	ClientStreaming bool
+	ServerStreaming bool
+}
+
+/*
+the weighted cluster of the route, such as 95 to v1 and 5 to v2
+*/
+type Split struct {
+	Cluster string
+	Weight  int
+}
+
+/*
+the request whose header (the http header or the grpc metadata) or cookie matches the value goes to the cluster,
+the empty value matches any request which has the header or the cookie
+*/
+type SplitMatch struct {
+	Header  string
+	Cookie  string
+	Value   string
+	Cluster string
+}
+
+func (m *SplitMatch) match(data *MetaData) bool {
+	var (
+		value string
+		ok    bool
+	)
+	if len(m.Header) > 0 {
+		value, ok = data.HeaderValue(m.Header)
+	} else if len(m.Cookie) > 0 {
+		value, ok = data.Cookie(m.Cookie)
+	}
+	return ok && (len(m.Value) == 0 || value == m.Value)
+}
+
+/*
+the cluster of the request, the matches are evaluated in order before the weighted splits,
+the Cluster is used if there is no split
+*/
+func (d *Descriptor) Destination(data *MetaData) string {
+	for i := range d.Matches {
+		if d.Matches[i].match(data) {
+			return d.Matches[i].Cluster
+		}
+	}
+	total := 0
+	for _, v := range d.Splits {
+		total += v.Weight
+	}
+	if total > 0 {
+		n := rand.Intn(total)
+		for _, v := range d.Splits {
+			if n < v.Weight {
+				return v.Cluster
+			}
+			n -= v.Weight
+		}
+	}
+	return d.Cluster
+}
+
+/*
+the failed request is retried on another host after the exponential backoff with the jitter,
+MaxAttempts includes the first try
+*/
+type RetryPolicy struct {
+	MaxAttempts   int
+	Codes         []codes.Code
+	PerTryTimeout time.Duration
+	BaseBackoff   time.Duration
+	MaxBackoff    time.Duration
+}
+
+/*
+the attempt (starting from 1) failed with the err can be retried
+*/
+func (p *RetryPolicy) Retryable(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	code := status.Code(err)
+	for _, v := range p.Codes {
+		if v == code {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+the backoff after the attempt, it is base * 2^(attempt-1) limited by the max, and the half of it is the random jitter
+*/
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, p.MaxBackoff)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
 }
 
 func (d *Descriptor) convertToMessage(dic map[string]proto.Message) (proto.Message, proto.Message, error) {
@@ -73,15 +231,13 @@ func (d *Descriptor) convertToMessage(dic map[string]proto.Message) (proto.Messa
 		ok            bool
 	)
 	if reqIn, ok = dic[d.RequestMessage]; !ok {
-		return nil, nil, fmt.Errorf(config.NOPROTOMESSAGE, d.RequestMessage)
+		return nil, nil, status.Errorf(codes.Internal, config.NOPROTOMESSAGE, d.RequestMessage)
 	} else if resOut, ok = dic[d.ResponseMessage]; !ok {
-		return nil, nil, fmt.Errorf(config.NOPROTOMESSAGE, d.ResponseMessage)
+		return nil, nil, status.Errorf(codes.Internal, config.NOPROTOMESSAGE, d.ResponseMessage)
 	}
-	req := reflect.New(reflect.TypeOf(reqIn).Elem()).Interface()
-	res := reflect.New(reflect.TypeOf(resOut).Elem()).Interface()
-
-	in := req.(proto.Message)
-	out := res.(proto.Message)
+	//the dynamic message has no go type, so the new message is created by the message type
+	in := reqIn.ProtoReflect().Type().New().Interface()
+	out := resOut.ProtoReflect().Type().New().Interface()
 	return in, out, nil
 }
 
@@ -98,7 +254,7 @@ func (m *MetaData) FormatAll(handler PathHandler) error {
 		m.Descriptor = &Descriptor{
 			URI: uri,
 		}
-		m.FormatPayload()
+		return m.FormatPayload()
 	}
 	return err
 }
@@ -106,7 +262,7 @@ func (m *MetaData) FormatAll(handler PathHandler) error {
 func DefaultPathHandler(path string, logger *zerolog.Logger) (*URI, error) {
 	st := strings.Split(path, "/")
 	if len(st) != 2 {
-		return nil, fmt.Errorf(config.WRONGPATH, path)
+		return nil, status.Errorf(codes.NotFound, config.WRONGPATH, path)
 	}
 	return &URI{
 		ServiceName: strings.Replace(st[0], "-", ".", 1),
@@ -117,24 +273,24 @@ func DefaultPathHandler(path string, logger *zerolog.Logger) (*URI, error) {
 func PathMatcher(key, path string, keytype config.ParamType) (*URI, error) {
 	urlcontext := strings.Split(path, "/")
 	if len(urlcontext) > 2 {
-		return nil, fmt.Errorf(config.WRONGPATH, path)
+		return nil, status.Errorf(codes.NotFound, config.WRONGPATH, path)
 	}
 	st := strings.Split(urlcontext[0], "-")
 	if len(st) != 3 {
-		return nil, fmt.Errorf(config.WRONGPATH, path)
+		return nil, status.Errorf(codes.NotFound, config.WRONGPATH, path)
 	}
 	params := make(map[string]any)
 	if len(urlcontext) == 2 && urlcontext[1] != "" {
 		switch keytype {
 		case config.Int:
 			if paramvalue, err := strconv.Atoi(urlcontext[1]); err != nil {
-				return nil, fmt.Errorf(config.WRONGPATH, path)
+				return nil, status.Errorf(codes.NotFound, config.WRONGPATH, path)
 			} else {
 				params[key] = paramvalue
 			}
 		case config.Float:
 			if paramvalue, err := strconv.ParseFloat(urlcontext[1], 64); err != nil {
-				return nil, fmt.Errorf(config.WRONGPATH, path)
+				return nil, status.Errorf(codes.NotFound, config.WRONGPATH, path)
 			} else {
 				params[key] = paramvalue
 			}
@@ -150,11 +306,12 @@ func PathMatcher(key, path string, keytype config.ParamType) (*URI, error) {
 	}, nil
 }
 
-func (m *MetaData) FormatPayload() {
+func (m *MetaData) FormatPayload() error {
 	m.Request.ParseForm()
 	payload := make(map[string]any)
 	fristload := make(map[string]any)
 	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	var formbodies []rawfield
 	for key, v := range m.Request.Form {
 		var data map[string]any
 		err := json.Unmarshal([]byte(key), &data)
@@ -162,7 +319,9 @@ func (m *MetaData) FormatPayload() {
 			for kk, vv := range data {
 				fristload[kk] = vv
 			}
+			formbodies = append(formbodies, rawfield{data: []byte(key)})
 		} else {
+			m.fields = append(m.fields, valuefield{path: key, values: v})
 			if len(v) > 0 {
 				fristload[key] = v[0]
 			} else {
@@ -175,20 +334,25 @@ func (m *MetaData) FormatPayload() {
 	if len(b) != 0 && err == nil {
 		err = json.Unmarshal(b, &payload)
 		if err != nil {
-			m.Logger.Panic().Msg(config.WRONGPATHPATTERN)
+			return status.Error(codes.InvalidArgument, config.WRONGPATHPATTERN)
 		}
 		for k, v := range fristload {
 			payload[k] = v
 		}
+		m.bodies = append(m.bodies, rawfield{data: b})
 	} else {
 		payload = fristload
 	}
+	//the form overrides the body and the params override both
+	m.bodies = append(m.bodies, formbodies...)
 
 	for key, value := range m.Descriptor.Params {
 		payload[key] = value
+		m.fields = append(m.fields, valuefield{path: key, values: []string{fmt.Sprint(value)}})
 	}
 
 	m.Payload = payload
+	return nil
 }
 
 func (m *MetaData) GetProtoMessage(dic map[string]proto.Message) (proto.Message, proto.Message, error) {
@@ -196,35 +360,305 @@ func (m *MetaData) GetProtoMessage(dic map[string]proto.Message) (proto.Message,
 	if err != nil {
 		return nil, nil, err
 	}
-	if len(m.Payload) > 0 {
+	if m.HttpMeta != nil {
+		if err := m.HttpMeta.decode(reqIn); err != nil {
+			return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	return reqIn, resOut, nil
+}
+
+/*
+format the request by the matched google.api.http rule,
+the path variables and query params fill the request message and the body is decoded as the rule.Body field
+*/
+func (m *MetaData) FormatRule(rule *HttpRule, vars map[string]string) error {
+	m.Descriptor = &Descriptor{
+		URI: &URI{
+			HttpMethod:  m.Request.Method,
+			ServiceName: rule.ServiceName,
+			Method:      rule.Method,
+			Params:      make(map[string]any),
+		},
+		Body:         rule.Body,
+		ResponseBody: rule.ResponseBody,
+	}
+	payload := make(map[string]any)
+	var queries []valuefield
+	if rule.Body != "*" {
+		for key, v := range m.Request.URL.Query() {
+			queries = append(queries, valuefield{path: key, values: v})
+			if len(v) == 1 {
+				setPayloadField(payload, key, v[0])
+			} else {
+				setPayloadField(payload, key, v)
+			}
+		}
+	}
+
+	b, err := io.ReadAll(m.Request.Body)
+	defer m.Request.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(rule.Body) > 0 && len(b) > 0 {
 		json := jsoniter.ConfigCompatibleWithStandardLibrary
-		b, err := json.Marshal(m.Payload)
-		if err != nil {
-			return nil, nil, err
+		var body any
+		if err := json.Unmarshal(b, &body); err != nil {
+			return status.Error(codes.InvalidArgument, config.WRONGPATHPATTERN)
 		}
-		err = json.Unmarshal(b, reqIn)
+		if rule.Body == "*" {
+			fields, ok := body.(map[string]any)
+			if !ok {
+				return status.Error(codes.InvalidArgument, config.WRONGPATHPATTERN)
+			}
+			for k, v := range fields {
+				payload[k] = v
+			}
+		} else {
+			setPayloadField(payload, rule.Body, body)
+		}
+		m.bodies = append(m.bodies, rawfield{path: rule.Body, data: b})
+	}
+	//the query and the path variables are set after the body, they are parsed by the type of the field
+	m.fields = append(m.fields, queries...)
 
-		if err != nil {
-			return nil, nil, err
+	for key, value := range vars {
+		setPayloadField(payload, key, value)
+		m.Descriptor.Params[key] = value
+		m.fields = append(m.fields, valuefield{path: key, values: []string{value}})
+	}
+	m.Payload = payload
+	return nil
+}
+
+func setPayloadField(payload map[string]any, fieldpath string, value any) {
+	names := strings.Split(fieldpath, ".")
+	for _, name := range names[:len(names)-1] {
+		child, ok := payload[name].(map[string]any)
+		if !ok {
+			child = make(map[string]any)
+			payload[name] = child
 		}
+		payload = child
 	}
+	payload[names[len(names)-1]] = value
+}
 
-	return reqIn, resOut, nil
+/*
+get the field of the payload by the path such as user.id
+*/
+func (m *MetaData) PayloadField(fieldpath string) (any, bool) {
+	if m.HttpMeta == nil {
+		return nil, false
+	}
+	var value any = m.Payload
+	for _, name := range strings.Split(fieldpath, ".") {
+		payload, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = payload[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+/*
+the value of the http header or the grpc metadata
+*/
+func (m *MetaData) HeaderValue(name string) (string, bool) {
+	if m.HttpMeta != nil && m.Request != nil {
+		if values := m.Request.Header.Values(name); len(values) > 0 {
+			return values[0], true
+		}
+	} else if m.GrpcMeta != nil && m.GrpcMeta.Header != nil {
+		if values := m.GrpcMeta.Header.Get(strings.ToLower(name)); len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+/*
+set the header of the http response or the header metadata of the grpc response, it is ignored after the header is sent
+*/
+func (m *MetaData) SetResponseHeader(name, value string) {
+	if m.HttpMeta != nil && m.Response != nil {
+		m.Response.Header().Set(name, value)
+	} else if m.GrpcMeta != nil && m.GrpcContext != nil {
+		grpc.SetHeader(m.GrpcContext, metadata.Pairs(name, value))
+	}
+}
+
+/*
+the value of the cookie, it is read from the cookie metadata of the grpc request
+*/
+func (m *MetaData) Cookie(name string) (string, bool) {
+	var header http.Header
+	if m.HttpMeta != nil && m.Request != nil {
+		header = m.Request.Header
+	} else if m.GrpcMeta != nil && m.GrpcMeta.Header != nil {
+		header = http.Header{"Cookie": m.GrpcMeta.Header.Get("cookie")}
+	}
+	if header == nil {
+		return "", false
+	}
+	if cookie, err := (&http.Request{Header: header}).Cookie(name); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+/*
+the ip of the client, it is empty if the peer is unknown
+*/
+func (m *MetaData) ClientIP() string {
+	var addr string
+	if m.HttpMeta != nil && m.Request != nil {
+		addr = m.Request.RemoteAddr
+	} else if m.GrpcMeta != nil && m.GrpcContext != nil {
+		if p, ok := peer.FromContext(m.GrpcContext); ok {
+			addr = p.Addr.String()
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
 }
 
-func (m *MetaData) Errorf(errormsg string, isDebug bool) {
-	if !isDebug {
-		errormsg = config.SYSTEMERROR
+/*
+marshal the result, proto messages are encoded by protojson and honor the response_body of the http rule
+*/
+func (m *MetaData) MarshalResult() ([]byte, error) {
+	if e, ok := m.Result.(ErrorMeta); ok {
+		return e.Marshal()
+	}
+	msg, ok := m.Result.(proto.Message)
+	if !ok {
+		json := jsoniter.ConfigCompatibleWithStandardLibrary
+		return json.Marshal(m.Result)
+	}
+	if m.Descriptor == nil || len(m.Descriptor.ResponseBody) == 0 {
+		return protojson.Marshal(msg)
+	}
+	field := msg.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(m.Descriptor.ResponseBody))
+	if field == nil {
+		return nil, fmt.Errorf(config.NOPROTODESCRIPTOR, m.Descriptor.ResponseBody)
+	}
+	b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	var fields map[string]jsoniter.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	return fields[field.JSONName()], nil
+}
+
+/*
+set the error as the result, the message of the error which is not a grpc status is hidden if it is not debug mode
+*/
+func (m *MetaData) SetError(err error, isDebug bool) {
+	e, ok := status.FromError(err)
+	if !isDebug && !ok {
+		e = status.New(e.Code(), config.SYSTEMERROR)
 	} else {
-		m.Logger.Error().Msg(errormsg)
+		m.Logger.Error().Msg(err.Error())
 	}
 	m.Logger.Error().Msg(LoggerTrace())
 
 	m.Result = ErrorMeta{
-		Error: errormsg,
+		Error:  e.Message(),
+		Status: e,
 	}
 }
 
+/*
+finish the request to the Target with its outcome, the Done is called only once
+*/
+func (m *MetaData) Finish(err error) {
+	if done := m.Done; done != nil {
+		m.Done = nil
+		done(err)
+	}
+}
+
+/*
+add the guard of the requests to the Target, the guards are asked in the order they are added
+and the first refusal is returned, the outcome of the allowed attempt is reported to all of them
+*/
+func (m *MetaData) AddGuard(guard Guard) {
+	switch g := m.Guard.(type) {
+	case nil:
+		m.Guard = guard
+	case guards:
+		m.Guard = append(g[:len(g):len(g)], guard)
+	default:
+		m.Guard = guards{g, guard}
+	}
+}
+
+type guards []Guard
+
+func (g guards) Allow(target string) error {
+	for _, v := range g {
+		if err := v.Allow(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g guards) Report(target string, err error) {
+	for _, v := range g {
+		v.Report(target, err)
+	}
+}
+
+/*
+the callback is called with the outcome when the whole request is finished (after the retries and the streaming)
+*/
+func (m *MetaData) OnComplete(complete func(err error)) {
+	m.completes = append(m.completes, complete)
+}
+
+/*
+the request is finished, it is called by the mash and the callbacks are called in the reverse order only once
+*/
+func (m *MetaData) Complete(err error) {
+	completes := m.completes
+	m.completes = nil
+	for i := len(completes) - 1; i >= 0; i-- {
+		completes[i](err)
+	}
+}
+
+/*
+the error of the result, it is nil if the result is not the ErrorMeta
+*/
+func (m *MetaData) Err() error {
+	if e, ok := m.Result.(ErrorMeta); ok {
+		return e.Err()
+	}
+	return nil
+}
+
+/*
+the http status code of the result
+*/
+func (m *MetaData) HttpCode() int {
+	if e, ok := m.Result.(ErrorMeta); ok {
+		return e.HttpCode()
+	}
+	return http.StatusOK
+}
+
 func LoggerTrace() string {
 	buf := make([]byte, 64<<10)
 	n := runtime.Stack(buf, false)
@@ -234,8 +668,29 @@ func LoggerTrace() string {
 
 type ProtoTable map[string]proto.Message
 
+/*
+add the message resolved by the registry, the message not in the registry is added by AddProtoMessage
+*/
+func (table ProtoTable) AddMessage(messageName string, registry *ProtoRegistry, logger *zerolog.Logger) error {
+	if _, ok := table[messageName]; ok {
+		return nil
+	}
+	if registry != nil {
+		if messageType, err := registry.FindMessageByName(protoreflect.FullName(messageName)); err == nil {
+			table[messageName] = messageType.New().Interface()
+			return nil
+		}
+	}
+	return table.AddProtoMessage(messageName, logger)
+}
+
 func (table ProtoTable) AddProtoMessage(messageName string, logger *zerolog.Logger) error {
 	if _, ok := table[messageName]; !ok {
+		//the message is registered in the proto registry by the generated package
+		if messageType, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(messageName)); err == nil {
+			table[messageName] = messageType.New().Interface()
+			return nil
+		}
 		defer func() {
 			if e := recover(); e != nil {
 				logger.Error().Any("Panic", e).Msg(fmt.Sprintf("%v package is not exits", messageName))
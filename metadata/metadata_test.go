@@ -0,0 +1,113 @@
+package metadata
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:52000"
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 52000}})
+	for _, v := range []struct {
+		data *MetaData
+		ip   string
+	}{
+		{&MetaData{HttpMeta: &HttpMeta{Request: r}}, "10.0.0.1"},
+		{&MetaData{GrpcMeta: &GrpcMeta{Header: &metadata.MD{}, GrpcContext: ctx}}, "fd00::1"},
+		//the metadata without the context, such as the shadow request of the mirror
+		{&MetaData{GrpcMeta: &GrpcMeta{Header: &metadata.MD{}}}, ""},
+		{&MetaData{}, ""},
+	} {
+		if ip := v.data.ClientIP(); ip != v.ip {
+			t.Fatalf("the client ip is %q instead of %q", ip, v.ip)
+		}
+	}
+}
+
+func TestDestination(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Canary", "on")
+	r.AddCookie(&http.Cookie{Name: "tier", Value: "gold"})
+	httpdata := &MetaData{HttpMeta: &HttpMeta{Request: r}}
+	header := metadata.Pairs("x-canary", "on", "cookie", "tier=silver")
+	grpcdata := &MetaData{GrpcMeta: &GrpcMeta{Header: &header}}
+	splits := []Split{{Cluster: "v1", Weight: 1}, {Cluster: "v2", Weight: 0}}
+	for _, v := range []struct {
+		name       string
+		descriptor *Descriptor
+		data       *MetaData
+		cluster    string
+	}{
+		{"cluster", &Descriptor{Cluster: "v1"}, httpdata, "v1"},
+		{"global hosts", &Descriptor{}, httpdata, ""},
+		{"header", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Header: "x-canary", Value: "on", Cluster: "v2"}}}, httpdata, "v2"},
+		{"grpc header", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Header: "X-Canary", Value: "on", Cluster: "v2"}}}, grpcdata, "v2"},
+		{"header value", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Header: "x-canary", Value: "off", Cluster: "v2"}}}, httpdata, "v1"},
+		{"any header value", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Header: "x-canary", Cluster: "v2"}}}, grpcdata, "v2"},
+		{"no header", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Header: "x-user", Cluster: "v2"}}}, httpdata, "v1"},
+		{"cookie", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Cookie: "tier", Value: "gold", Cluster: "v3"}}}, httpdata, "v3"},
+		{"grpc cookie", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Cookie: "tier", Value: "gold", Cluster: "v3"}}}, grpcdata, "v1"},
+		{"matches in order", &Descriptor{Matches: []SplitMatch{{Cookie: "tier", Cluster: "v3"}, {Header: "x-canary", Cluster: "v2"}}}, httpdata, "v3"},
+		{"matches before splits", &Descriptor{Splits: splits, Matches: []SplitMatch{{Header: "x-canary", Cluster: "v2"}}}, httpdata, "v2"},
+		{"splits before cluster", &Descriptor{Cluster: "v3", Splits: splits}, httpdata, "v1"},
+		{"no request", &Descriptor{Cluster: "v1", Matches: []SplitMatch{{Header: "x-canary", Cluster: "v2"}}}, &MetaData{}, "v1"},
+	} {
+		if cluster := v.descriptor.Destination(v.data); cluster != v.cluster {
+			t.Fatalf("the destination of the %v is %q instead of %q", v.name, cluster, v.cluster)
+		}
+	}
+
+	d := &Descriptor{Cluster: "v1", Splits: []Split{{Cluster: "v1", Weight: 95}, {Cluster: "v2", Weight: 5}}}
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[d.Destination(httpdata)]++
+	}
+	if len(counts) != 2 || counts["v2"] < 350 || counts["v2"] > 650 {
+		t.Fatalf("the requests of the 95/5 splits are %v", counts)
+	}
+}
+
+type testguard struct {
+	refused error
+	reports []error
+}
+
+func (g *testguard) Allow(target string) error {
+	return g.refused
+}
+
+func (g *testguard) Report(target string, err error) {
+	g.reports = append(g.reports, err)
+}
+
+/*
+the guards are asked in order and the allowed attempt is reported to all of them
+*/
+func TestAddGuard(t *testing.T) {
+	first, second := &testguard{}, &testguard{}
+	data := &MetaData{}
+	data.AddGuard(first)
+	if data.Guard != first {
+		t.Fatal("the only guard is wrapped")
+	}
+	data.AddGuard(second)
+	if err := data.Guard.Allow("127.0.0.1:9000"); err != nil {
+		t.Fatal(err)
+	}
+	data.Guard.Report("127.0.0.1:9000", io.EOF)
+	if len(first.reports) != 1 || len(second.reports) != 1 {
+		t.Fatalf("the reports are %v and %v", first.reports, second.reports)
+	}
+	second.refused = io.ErrClosedPipe
+	if err := data.Guard.Allow("127.0.0.1:9000"); err != io.ErrClosedPipe {
+		t.Fatalf("the refusal of the second guard is %v", err)
+	}
+}
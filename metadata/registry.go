@@ -0,0 +1,195 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"octopus/config"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+/*
+ProtoRegistry holds the proto descriptors loaded from the descriptor set files (protoc -o) or the proto files,
+the messages are built by dynamicpb so the gateway does not need the generated packages.
+the descriptors not found here are resolved from the global registry of the generated packages
+*/
+type ProtoRegistry struct {
+	files *protoregistry.Files
+}
+
+func NewProtoRegistry() *ProtoRegistry {
+	return &ProtoRegistry{
+		files: new(protoregistry.Files),
+	}
+}
+
+/*
+register the file descriptor, the file already in the registry is skipped
+*/
+func (r *ProtoRegistry) RegisterFile(fd protoreflect.FileDescriptor) error {
+	if _, err := r.FindFileByPath(fd.Path()); err == nil {
+		return nil
+	}
+	return r.files.RegisterFile(fd)
+}
+
+/*
+register the file descriptor protos, the dependencies can be in any order
+*/
+func (r *ProtoRegistry) RegisterFileProtos(fdps []*descriptorpb.FileDescriptorProto) error {
+	pending := fdps
+	for len(pending) > 0 {
+		var (
+			failed  []*descriptorpb.FileDescriptorProto
+			lasterr error
+		)
+		for _, fdp := range pending {
+			if _, err := r.FindFileByPath(fdp.GetName()); err == nil {
+				continue
+			}
+			fd, err := protodesc.NewFile(fdp, r)
+			if err != nil {
+				failed = append(failed, fdp)
+				lasterr = err
+				continue
+			}
+			if err := r.files.RegisterFile(fd); err != nil {
+				return err
+			}
+		}
+		if len(failed) == len(pending) {
+			return lasterr
+		}
+		pending = failed
+	}
+	return nil
+}
+
+/*
+load the descriptor set file created by protoc -o (use --include_imports if the imports are not in the gateway)
+*/
+func (r *ProtoRegistry) LoadDescriptorSet(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return err
+	}
+	return r.RegisterFileProtos(set.GetFile())
+}
+
+/*
+compile all the proto files in the dir, the imports are resolved from the dir,
+the standard imports and the global registry
+*/
+func (r *ProtoRegistry) LoadProtoFiles(dir string) error {
+	names := make([]string, 0)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".proto") {
+			name, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(protocompile.CompositeResolver{
+			&protocompile.SourceResolver{ImportPaths: []string{dir}},
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				fd, err := protoregistry.GlobalFiles.FindFileByPath(path)
+				if err != nil {
+					return protocompile.SearchResult{}, err
+				}
+				return protocompile.SearchResult{Desc: fd}, nil
+			}),
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		return err
+	}
+	for _, fd := range files {
+		if err := r.RegisterFile(fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ProtoRegistry) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r *ProtoRegistry) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+/*
+find the method by the grpc full method name (/package.Service/Method)
+*/
+func (r *ProtoRegistry) FindMethod(fullmethod string) (protoreflect.MethodDescriptor, error) {
+	name := protoreflect.FullName(strings.ReplaceAll(strings.TrimPrefix(fullmethod, "/"), "/", "."))
+	d, err := r.FindDescriptorByName(name)
+	if err != nil {
+		return nil, err
+	}
+	method, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, fmt.Errorf(config.NOPROTODESCRIPTOR, name)
+	}
+	return method, nil
+}
+
+/*
+find the message type, the message loaded in the registry is built by dynamicpb
+*/
+func (r *ProtoRegistry) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		if md, ok := d.(protoreflect.MessageDescriptor); ok {
+			return dynamicpb.NewMessageType(md), nil
+		}
+		return nil, fmt.Errorf(config.NOPROTODESCRIPTOR, name)
+	}
+	return protoregistry.GlobalTypes.FindMessageByName(name)
+}
+
+/*
+range all the services loaded in the registry (the global registry is not included)
+*/
+func (r *ProtoRegistry) RangeServices(f func(protoreflect.ServiceDescriptor) bool) {
+	r.files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		services := fd.Services()
+		for i := 0; i < services.Len(); i++ {
+			if !f(services.Get(i)) {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,166 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// the proto files of the test, the library imports the book and the well-known type
+func protofiles(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"common/book.proto": `syntax = "proto3";
+package common;
+import "google/protobuf/timestamp.proto";
+message Book {
+  int64 id = 1;
+  string title = 2;
+  google.protobuf.Timestamp published = 3;
+}`,
+		"library.proto": `syntax = "proto3";
+package library;
+import "common/book.proto";
+message GetBookRequest {
+  int64 id = 1;
+}
+service Library {
+  rpc GetBook(GetBookRequest) returns (common.Book);
+}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+/*
+the method and the messages of the registry are found by the names, the message is built by dynamicpb
+*/
+func checkregistry(t *testing.T, r *ProtoRegistry) {
+	t.Helper()
+	d, err := r.FindDescriptorByName("library.Library.GetBook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	method, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		t.Fatalf("the method is %T", d)
+	}
+	if method.Input().FullName() != "library.GetBookRequest" || method.Output().FullName() != "common.Book" {
+		t.Fatalf("the method is %v to %v", method.Input().FullName(), method.Output().FullName())
+	}
+	mt, err := r.FindMessageByName("common.Book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, ok := mt.New().Interface().(*dynamicpb.Message)
+	if !ok {
+		t.Fatalf("the message is %T", mt.New().Interface())
+	}
+	fields := book.Descriptor().Fields()
+	book.Set(fields.ByName("id"), protoreflect.ValueOfInt64(9007199254740993))
+	book.Set(fields.ByName("title"), protoreflect.ValueOfString("go"))
+	b, err := proto.Marshal(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := mt.New().Interface()
+	if err := proto.Unmarshal(b, decoded); err != nil || !proto.Equal(decoded, book) {
+		t.Fatalf("the message is decoded to %v with %v", decoded, err)
+	}
+	services := make([]protoreflect.FullName, 0)
+	r.RangeServices(func(sd protoreflect.ServiceDescriptor) bool {
+		services = append(services, sd.FullName())
+		return true
+	})
+	if len(services) != 1 || services[0] != "library.Library" {
+		t.Fatalf("the services are %v", services)
+	}
+	//the well-known type is resolved from the global registry
+	if mt, err := r.FindMessageByName("google.protobuf.Timestamp"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := mt.New().Interface().(*timestamppb.Timestamp); !ok {
+		t.Fatalf("the global message is %T", mt.New().Interface())
+	}
+	if _, err := r.FindMessageByName("library.Library"); err == nil {
+		t.Fatal("the service is found as the message")
+	}
+	if _, err := r.FindMessageByName("library.Book"); err == nil {
+		t.Fatal("the unknown message is found")
+	}
+}
+
+func TestProtoRegistryProtoFiles(t *testing.T) {
+	r := NewProtoRegistry()
+	if err := r.LoadProtoFiles(protofiles(t)); err != nil {
+		t.Fatal(err)
+	}
+	checkregistry(t, r)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.proto"), []byte(`syntax = "proto3"; message {`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProtoRegistry().LoadProtoFiles(dir); err == nil {
+		t.Fatal("the broken proto file is loaded")
+	}
+}
+
+/*
+the descriptor set has the dependencies after the files which import them, as protoc -o does not sort them
+*/
+func TestProtoRegistryDescriptorSet(t *testing.T) {
+	compiled := NewProtoRegistry()
+	if err := compiled.LoadProtoFiles(protofiles(t)); err != nil {
+		t.Fatal(err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, name := range []string{"library.proto", "common/book.proto"} {
+		fd, err := compiled.FindFileByPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "library.pb")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewProtoRegistry()
+	if err := r.LoadDescriptorSet(path); err != nil {
+		t.Fatal(err)
+	}
+	checkregistry(t, r)
+	//loading the same files again is skipped
+	if err := r.LoadDescriptorSet(path); err != nil {
+		t.Fatal(err)
+	}
+
+	//the import is missing without --include_imports
+	set.File = set.File[:1]
+	b, _ = proto.Marshal(set)
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProtoRegistry().LoadDescriptorSet(path); err == nil {
+		t.Fatal("the descriptor set without the import is loaded")
+	}
+}
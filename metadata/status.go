@@ -0,0 +1,103 @@
+package metadata
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+/*
+ErrorMeta is the error result of the request,
+the http mash writes it as the google.rpc.Status body with the mapped http status code
+and the grpc mash returns it as the grpc status.
+the Error is kept for the ErrorMeta{Error: msg} built without the Status, it is codes.Unknown
+*/
+type ErrorMeta struct {
+	Error  string         `json:"error"`
+	Status *status.Status `json:"-"`
+}
+
+func NewErrorMeta(code codes.Code, msg string) ErrorMeta {
+	return ErrorMeta{
+		Error:  msg,
+		Status: status.New(code, msg),
+	}
+}
+
+/*
+convert the error to ErrorMeta, the error which is not a grpc status is treated as codes.Unknown
+*/
+func ToErrorMeta(err error) ErrorMeta {
+	s := status.Convert(err)
+	return ErrorMeta{
+		Error:  s.Message(),
+		Status: s,
+	}
+}
+
+/*
+the status of the error, it is codes.Unknown with the Error if there is no Status,
+so the zero ErrorMeta is never OK
+*/
+func (e ErrorMeta) GRPCStatus() *status.Status {
+	if e.Status == nil {
+		return status.New(codes.Unknown, e.Error)
+	}
+	return e.Status
+}
+
+func (e ErrorMeta) Err() error {
+	return e.GRPCStatus().Err()
+}
+
+func (e ErrorMeta) HttpCode() int {
+	return HttpStatusFromCode(e.GRPCStatus().Code())
+}
+
+/*
+marshal the error as google.rpc.Status, the details which can not be resolved are dropped
+*/
+func (e ErrorMeta) Marshal() ([]byte, error) {
+	body := e.GRPCStatus().Proto()
+	b, err := protojson.Marshal(body)
+	if err != nil {
+		body.Details = nil
+		return protojson.Marshal(body)
+	}
+	return b, nil
+}
+
+/*
+map the grpc code to the http status code, it is same as the grpc-gateway
+*/
+func HttpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		//the client closed request, nginx uses it
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
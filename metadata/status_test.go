@@ -0,0 +1,110 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestHttpStatusFromCode(t *testing.T) {
+	for code, httpcode := range map[codes.Code]int{
+		codes.OK:                 http.StatusOK,
+		codes.Canceled:           499,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.DataLoss:           http.StatusInternalServerError,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+		codes.Code(100):          http.StatusInternalServerError,
+	} {
+		if c := HttpStatusFromCode(code); c != httpcode {
+			t.Fatalf("the http status of %v is %v instead of %v", code, c, httpcode)
+		}
+	}
+}
+
+type statusbody struct {
+	Code    int32            `json:"code"`
+	Message string           `json:"message"`
+	Details []map[string]any `json:"details"`
+}
+
+func marshalstatus(t *testing.T, e ErrorMeta) statusbody {
+	t.Helper()
+	b, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body statusbody
+	if err := json.Unmarshal(b, &body); err != nil {
+		t.Fatalf("the body %s is %v", b, err)
+	}
+	return body
+}
+
+func TestErrorMetaMarshal(t *testing.T) {
+	s, err := status.New(codes.NotFound, "no book").WithDetails(wrapperspb.String("book 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := ToErrorMeta(s.Err())
+	if e.Error != "no book" || e.HttpCode() != http.StatusNotFound {
+		t.Fatalf("the error is %+v with %v", e, e.HttpCode())
+	}
+	body := marshalstatus(t, e)
+	if body.Code != int32(codes.NotFound) || body.Message != "no book" || len(body.Details) != 1 || body.Details[0]["value"] != "book 1" {
+		t.Fatalf("the body is %+v", body)
+	}
+	if body.Details[0]["@type"] != "type.googleapis.com/google.protobuf.StringValue" {
+		t.Fatalf("the type of the detail is %v", body.Details[0]["@type"])
+	}
+
+	//the detail which can not be resolved is dropped instead of failing the body
+	unknown := status.FromProto(&spb.Status{
+		Code:    int32(codes.Internal),
+		Message: "broken",
+		Details: []*anypb.Any{{TypeUrl: "type.googleapis.com/octopus.Unknown", Value: []byte{1}}},
+	})
+	if body := marshalstatus(t, ErrorMeta{Error: "broken", Status: unknown}); body.Code != int32(codes.Internal) || body.Message != "broken" || len(body.Details) != 0 {
+		t.Fatalf("the body with the unknown detail is %+v", body)
+	}
+}
+
+/*
+the ErrorMeta built without the Status keeps the Error and it is never OK
+*/
+func TestErrorMetaWithoutStatus(t *testing.T) {
+	e := ErrorMeta{Error: "something is wrong"}
+	if code := status.Code(e.Err()); code != codes.Unknown || e.HttpCode() != http.StatusInternalServerError {
+		t.Fatalf("the error without the status is %v", code)
+	}
+	if body := marshalstatus(t, e); body.Code != int32(codes.Unknown) || body.Message != "something is wrong" {
+		t.Fatalf("the body is %+v", body)
+	}
+	if b, err := json.Marshal(e); err != nil || string(b) != `{"error":"something is wrong"}` {
+		t.Fatalf("the json of the error is %s", b)
+	}
+	if e := ToErrorMeta(errors.New("plain")); e.Status.Code() != codes.Unknown || e.Error != "plain" {
+		t.Fatalf("the plain error is %+v", e)
+	}
+	if e := NewErrorMeta(codes.Unavailable, "down"); e.Error != "down" || e.HttpCode() != http.StatusServiceUnavailable {
+		t.Fatalf("the error is %+v", e)
+	}
+}
@@ -0,0 +1,98 @@
+package metadata
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*
+the effective timeout of the request, the timeout requested by the client replaces the Timeout of the route
+and both are limited by the MaxTimeout, the stream without the timeout is not limited
+*/
+func (d *Descriptor) EffectiveTimeout(requested time.Duration) time.Duration {
+	timeout := d.Timeout
+	if requested > 0 {
+		timeout = requested
+	}
+	if timeout == 0 && (d.ClientStreaming || d.ServerStreaming) {
+		return 0
+	}
+	if d.MaxTimeout > 0 && (timeout == 0 || timeout > d.MaxTimeout) {
+		timeout = d.MaxTimeout
+	}
+	return timeout
+}
+
+/*
+the timeout requested by the client, it is the deadline of the grpc request, the grpc-timeout header
+or the X-Request-Timeout header (such as "500ms"), the shortest one is used and zero is not requested
+*/
+func (m *MetaData) RequestTimeout(ctx context.Context) time.Duration {
+	var timeout time.Duration
+	request := func(d time.Duration) {
+		if d > 0 && (timeout == 0 || d < timeout) {
+			timeout = d
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		//the expired deadline is kept as the shortest timeout
+		request(max(time.Until(deadline), 1))
+	}
+	if v, ok := m.HeaderValue("grpc-timeout"); ok {
+		if d, ok := ParseGrpcTimeout(v); ok {
+			request(d)
+		}
+	}
+	if v, ok := m.HeaderValue("X-Request-Timeout"); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			request(d)
+		}
+	}
+	return timeout
+}
+
+/*
+the ctx with the effective timeout of the request, the deadline is propagated to the backend by the grpc call
+*/
+func (m *MetaData) WithDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.Descriptor != nil && m.Descriptor.Timeout > 0 {
+		return context.WithTimeout(ctx, m.Descriptor.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+/*
+parse the grpc-timeout header, such as "100m" (the units are H, M, S, m, u and n)
+*/
+func ParseGrpcTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, false
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	if n > math.MaxInt64/int64(unit) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(n) * unit, true
+}
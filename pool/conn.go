@@ -26,8 +26,10 @@ func (c *conn) Value() *grpc.ClientConn {
 
 // Close see Conn interface.
 func (c *conn) Close() error {
+	// read it before giving back the reference, the pool can be closed after the reference is zero.
+	once := c.once
 	c.pool.decrRef()
-	if c.once {
+	if once {
 		return c.reset()
 	}
 	return nil
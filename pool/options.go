@@ -36,6 +36,9 @@ const (
 	// MaxRecvMsgSize set max gRPC receive message size received from server.
 	// If any message size is larger than current value, an error will be reported from gRPC.
 	MaxRecvMsgSize = 4 << 30
+
+	// DrainTimeout is the maximum time of waiting for the using connections when the pool is drained.
+	DrainTimeout = 30 * time.Second
 )
 
 // Options are params for creating grpc connect pool.
@@ -6,6 +6,7 @@ import (
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -28,6 +29,10 @@ type Pool interface {
 
 	// Status returns the current status of the pool.
 	Status() string
+
+	// Drain stops giving out the connections and closes the pool after all the using
+	// connections are given back or the timeout is reached.
+	Drain(timeout time.Duration) error
 }
 
 type pool struct {
@@ -53,6 +58,9 @@ type pool struct {
 	// closed set true when Close is called.
 	closed int32
 
+	// draining set true when Drain is called.
+	draining int32
+
 	logger *zerolog.Logger
 	// control the atomic var current's concurrent read write.
 	sync.RWMutex
@@ -112,8 +120,9 @@ func (p *pool) decrRef() {
 	if newRef == 0 && atomic.LoadInt32(&p.current) > int32(p.opt.MaxIdle) {
 		p.Lock()
 		if atomic.LoadInt32(&p.ref) == 0 {
+			current := atomic.LoadInt32(&p.current)
 			p.logger.Info().Msg(fmt.Sprintf("shrink pool: %d ---> %d, decrement: %d, maxActive: %d\n",
-				p.current, p.opt.MaxIdle, p.current-int32(p.opt.MaxIdle), p.opt.MaxActive))
+				current, p.opt.MaxIdle, current-int32(p.opt.MaxIdle), p.opt.MaxActive))
 			atomic.StoreInt32(&p.current, int32(p.opt.MaxIdle))
 			p.deleteFrom(p.opt.MaxIdle)
 		}
@@ -126,7 +135,8 @@ func (p *pool) reset(index int) {
 	if conn == nil {
 		return
 	}
-	conn.reset()
+	// the conn is not changed, it can still be held after the drain timeout and its calls fail on the closed connection.
+	conn.cc.Close()
 	p.conns[index] = nil
 }
 
@@ -138,33 +148,50 @@ func (p *pool) deleteFrom(begin int) {
 
 // Get see Pool interface.
 func (p *pool) Get() (Conn, error) {
+	if atomic.LoadInt32(&p.draining) == 1 {
+		return nil, ErrClosed
+	}
 	// the first selected from the created connections
 	nextRef := p.incrRef()
+	// check again after the reference is taken, the Drain either sees the reference and waits for it
+	// or the draining is seen here and the reference is given back, so the pool is never closed under the connection.
+	if atomic.LoadInt32(&p.draining) == 1 {
+		p.decrRef()
+		return nil, ErrClosed
+	}
 	p.RLock()
 	current := atomic.LoadInt32(&p.current)
 	p.RUnlock()
 	if current == 0 {
+		p.decrRef()
 		return nil, ErrClosed
 	}
 	if nextRef <= current*int32(p.opt.MaxConcurrentStreams) {
-		next := atomic.AddUint32(&p.index, 1) % uint32(current)
-		return p.conns[next], nil
+		return p.pick(current)
 	}
 
 	// the number connection of pool is reach to max active
 	if current == int32(p.opt.MaxActive) {
 		// the second if reuse is true, select from pool's connections
 		if p.opt.Reuse {
-			next := atomic.AddUint32(&p.index, 1) % uint32(current)
-			return p.conns[next], nil
+			return p.pick(current)
 		}
 		// the third create one-time connection
 		c, err := p.opt.Dial(p.address)
-		return p.wrapConn(c, true), err
+		if err != nil {
+			p.decrRef()
+			return nil, err
+		}
+		return p.wrapConn(c, true), nil
 	}
 
 	// the fourth create new connections given back to pool
 	p.Lock()
+	if atomic.LoadInt32(&p.closed) == 1 {
+		p.Unlock()
+		p.decrRef()
+		return nil, ErrClosed
+	}
 	current = atomic.LoadInt32(&p.current)
 	if current < int32(p.opt.MaxActive) && nextRef > current*int32(p.opt.MaxConcurrentStreams) {
 		// 2 times the incremental or the remain incremental
@@ -185,31 +212,56 @@ func (p *pool) Get() (Conn, error) {
 		}
 		current += i
 		p.logger.Info().Msg(fmt.Sprintf("grow pool: %d ---> %d, increment: %d, maxActive: %d\n",
-			p.current, current, increment, p.opt.MaxActive))
+			atomic.LoadInt32(&p.current), current, increment, p.opt.MaxActive))
 		atomic.StoreInt32(&p.current, current)
 		if err != nil {
 			p.Unlock()
+			p.decrRef()
 			return nil, err
 		}
 	}
 	p.Unlock()
+	return p.pick(current)
+}
+
+// pick one of the created connections, the pool can be closed by the drain timeout after the current is read.
+func (p *pool) pick(current int32) (Conn, error) {
 	next := atomic.AddUint32(&p.index, 1) % uint32(current)
-	return p.conns[next], nil
+	p.RLock()
+	c := p.conns[next]
+	p.RUnlock()
+	if c == nil {
+		p.decrRef()
+		return nil, ErrClosed
+	}
+	return c, nil
 }
 
 // Close see Pool interface.
 func (p *pool) Close() error {
 	atomic.StoreInt32(&p.closed, 1)
+	p.Lock()
 	atomic.StoreUint32(&p.index, 0)
 	atomic.StoreInt32(&p.current, 0)
 	atomic.StoreInt32(&p.ref, 0)
 	p.deleteFrom(0)
+	p.Unlock()
 	p.logger.Info().Msg(fmt.Sprintf("close pool success: %v\n", p.Status()))
 	return nil
 }
 
+// Drain see Pool interface.
+func (p *pool) Drain(timeout time.Duration) error {
+	atomic.StoreInt32(&p.draining, 1)
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&p.ref) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return p.Close()
+}
+
 // Status see Pool interface.
 func (p *pool) Status() string {
 	return fmt.Sprintf("address:%s, index:%d, current:%d, ref:%d. option:%v",
-		p.address, p.index, p.current, p.ref, p.opt)
+		p.address, atomic.LoadUint32(&p.index), atomic.LoadInt32(&p.current), atomic.LoadInt32(&p.ref), p.opt)
 }
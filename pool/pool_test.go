@@ -0,0 +1,92 @@
+package pool
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/connectivity"
+)
+
+/*
+the connections are taken while the pool is drained, the drain timeout closes the pool under the using connections,
+the Get either gives a connection or ErrClosed
+*/
+func TestPoolDrainWhileGet(t *testing.T) {
+	logger := zerolog.Nop()
+	for i := 0; i < 20; i++ {
+		p, err := New("127.0.0.1:9000", Options{Dial: Dial, MaxIdle: 1, MaxActive: 4, MaxConcurrentStreams: 2, Reuse: i%2 == 0}, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					conn, err := p.Get()
+					if err != nil {
+						if !errors.Is(err, ErrClosed) {
+							t.Errorf("the get is failed: %v", err)
+						}
+						return
+					}
+					if conn == nil || conn.Value() == nil {
+						t.Error("the connection is nil")
+						return
+					}
+					time.Sleep(time.Millisecond)
+					conn.Close()
+				}
+			}()
+		}
+		time.Sleep(5 * time.Millisecond)
+		p.Drain(time.Millisecond)
+		wg.Wait()
+	}
+}
+
+/*
+the drained pool gives out no connection and waits for the using one before it is closed
+*/
+func TestPoolDrainWait(t *testing.T) {
+	logger := zerolog.Nop()
+	p, err := New("127.0.0.1:9000", Options{Dial: Dial, MaxIdle: 1, MaxActive: 1, MaxConcurrentStreams: 8, Reuse: true}, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	drained := make(chan struct{})
+	go func() {
+		p.Drain(5 * time.Second)
+		close(drained)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := p.Get(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("the draining pool gives out the connection with %v", err)
+	}
+	select {
+	case <-drained:
+		t.Fatal("the pool is closed under the using connection")
+	default:
+	}
+	if conn.Value().GetState() == connectivity.Shutdown {
+		t.Fatal("the using connection is closed")
+	}
+	conn.Close()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("the pool is not closed after the connection is given back")
+	}
+	if ref := atomic.LoadInt32(&p.(*pool).ref); ref != 0 {
+		t.Fatalf("the reference of the drained pool is %v", ref)
+	}
+}
@@ -3,22 +3,42 @@ package balance
 import (
 	"fmt"
 	"octopus/config"
+	"octopus/metadata"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog"
 	"golang.org/x/exp/slices"
 )
 
+/*
+the done callback of Next is called with the outcome when the request to the address is finished,
+the balance uses it as the feedback of the in-flight requests and the latency,
+the err is context.Canceled if the address is not used (such as the tried host picked again by the retry)
+*/
+type Done func(err error)
+
+func nodone(err error) {}
+
 type Balance interface {
 	Add(addr string, weight int)
-	Next() string
+	Next(data *metadata.MetaData) (string, Done)
 	Remove(addr string)
 	SetWegiht(num int, addr string)
+	//take the outlier address out of Next, it is put back by Restore
+	Eject(addr string)
+	//put the ejected address back, the weighted balance starts it from the weight of step (0 is the full weight)
+	Restore(addr string, weight, step int)
 	GetAllAddress() []string
 }
 
+/*
+the address list is copied on write, so Next does not need the lock
+*/
 type roundRobinBalance struct {
-	curIndex int
-	addrList []string
+	curIndex atomic.Uint64
+	addrList atomic.Pointer[[]string]
+	mu       sync.Mutex
 	logger   *zerolog.Logger
 }
 
@@ -26,71 +46,84 @@ func NewBalance(balancetype config.BalanceType, logger *zerolog.Logger) Balance
 	var balance Balance
 	switch balancetype {
 	case config.RoundRobin:
-		balance = &roundRobinBalance{
-			addrList: make([]string, 0),
-			logger:   logger,
-		}
+		balance = newRoundRobinBalance(logger)
 	case config.WeightRobin:
 		balance = &weightRoundRobinBalance{
 			addrList: make(map[string]*node),
 			logger:   logger,
 		}
+	case config.LeastRequest:
+		balance = newLeastRequestBalance(logger)
+	case config.P2CEWMA:
+		balance = newP2CEWMABalance(logger)
+	case config.ConsistentHash:
+		balance = NewConsistentHash(ClientIPKey(), logger)
 	default:
-		balance = &roundRobinBalance{
-			addrList: make([]string, 0),
-			logger:   logger,
-		}
+		balance = newRoundRobinBalance(logger)
 	}
 	return balance
 }
 
+func newRoundRobinBalance(logger *zerolog.Logger) *roundRobinBalance {
+	b := &roundRobinBalance{
+		logger: logger,
+	}
+	b.addrList.Store(&[]string{})
+	return b
+}
+
 func (b *roundRobinBalance) Add(addr string, weight int) {
-	if !slices.Contains(b.addrList, addr) {
-		b.addrList = append(b.addrList, addr)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrList := *b.addrList.Load()
+	if !slices.Contains(addrList, addr) {
+		addrList = append(slices.Clip(addrList), addr)
+		b.addrList.Store(&addrList)
 	}
 }
 func (b *roundRobinBalance) SetWegiht(num int, addr string) {}
 
-func (b *roundRobinBalance) Remove(addr string) {
-	index := -1
-	for key, value := range b.addrList {
-		if value == addr {
-			index = key
-			break
-		}
-	}
+func (b *roundRobinBalance) Eject(addr string) {
+	b.Remove(addr)
+}
+
+func (b *roundRobinBalance) Restore(addr string, weight, step int) {
+	b.Add(addr, weight)
+}
 
+func (b *roundRobinBalance) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrList := *b.addrList.Load()
+	index := slices.Index(addrList, addr)
 	if index > -1 {
 		b.logger.Info().Msg(fmt.Sprintf("begin delete the host %v", addr))
-		if (index + 1) == len(b.addrList) {
-			b.addrList = b.addrList[:index]
-		} else {
-			b.addrList = append(b.addrList[:index], b.addrList[index+1:]...)
-		}
-		b.logger.Info().Msg(fmt.Sprintf("the addrlist %v", b.addrList))
+		addrList = slices.Delete(slices.Clone(addrList), index, index+1)
+		b.addrList.Store(&addrList)
+		b.logger.Info().Msg(fmt.Sprintf("the addrlist %v", addrList))
 	}
 }
 
-func (b *roundRobinBalance) Next() string {
-	len := len(b.addrList)
+func (b *roundRobinBalance) Next(data *metadata.MetaData) (string, Done) {
+	addrList := *b.addrList.Load()
+	len := uint64(len(addrList))
 	if len == 0 {
-		return ""
-	}
-	if b.curIndex >= len {
-		b.curIndex = 0
+		return "", nodone
 	}
-	addr := b.addrList[b.curIndex]
-	b.curIndex = (b.curIndex + 1) % len
-	return addr
+	return addrList[(b.curIndex.Add(1)-1)%len], nodone
 }
 
 func (b *roundRobinBalance) GetAllAddress() []string {
-	return b.addrList
+	return *b.addrList.Load()
 }
 
+/*
+the smooth weighted round robin changes the current weights on every Next, so it is guarded by the lock
+*/
 type weightRoundRobinBalance struct {
 	curAddr  string
 	addrList map[string]*node
+	mu       sync.Mutex
 	logger   *zerolog.Logger
 }
 
@@ -101,21 +134,35 @@ type node struct {
 	addr          string
 }
 
+/*
+add the address again to change the weight, the step weight which is not full (such as warming up) is kept under the new weight
+*/
 func (b *weightRoundRobinBalance) Add(addr string, weight int) {
-	if _, ok := b.addrList[addr]; !ok {
-		node := &node{
-			weght:         weight,
-			currentWeight: weight,
-			stepWeight:    weight,
-			addr:          addr,
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if node, ok := b.addrList[addr]; ok {
+		if node.weght != weight {
+			if node.stepWeight == node.weght || node.stepWeight > weight {
+				node.stepWeight = weight
+			}
+			node.weght = weight
 		}
-		b.addrList[addr] = node
+		return
 	}
+	node := &node{
+		weght:         weight,
+		currentWeight: weight,
+		stepWeight:    weight,
+		addr:          addr,
+	}
+	b.addrList[addr] = node
 }
 
-func (b *weightRoundRobinBalance) Next() string {
+func (b *weightRoundRobinBalance) Next(data *metadata.MetaData) (string, Done) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if len(b.addrList) == 0 {
-		return ""
+		return "", nodone
 	}
 	totalWight := 0
 	var maxWeghtNode *node
@@ -128,16 +175,20 @@ func (b *weightRoundRobinBalance) Next() string {
 		}
 	}
 	maxWeghtNode.currentWeight -= totalWight
-	return maxWeghtNode.addr
+	return maxWeghtNode.addr, nodone
 }
 
 func (b *weightRoundRobinBalance) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.logger.Info().Msg(fmt.Sprintf("begin delete the host %v", addr))
 	delete(b.addrList, addr)
 	b.logger.Info().Msg(fmt.Sprintf("the addrlist %v", b.addrList))
 }
 
 func (b *weightRoundRobinBalance) SetWegiht(num int, addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if node, ok := b.addrList[addr]; ok {
 		if num > 0 && node.weght > node.stepWeight {
 			if (node.stepWeight + num) > node.weght {
@@ -146,13 +197,37 @@ func (b *weightRoundRobinBalance) SetWegiht(num int, addr string) {
 				node.stepWeight += num
 			}
 		}
-		if num == -1 {
-			node.stepWeight = -1
-		}
+	}
+}
+
+func (b *weightRoundRobinBalance) Eject(addr string) {
+	b.Remove(addr)
+}
+
+/*
+the restored address starts from the weight of step and it is ramped to the full weight by SetWegiht
+*/
+func (b *weightRoundRobinBalance) Restore(addr string, weight, step int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.addrList[addr]; ok {
+		return
+	}
+	stepWeight := weight
+	if step > 0 && step < weight {
+		stepWeight = step
+	}
+	b.addrList[addr] = &node{
+		weght:         weight,
+		currentWeight: stepWeight,
+		stepWeight:    stepWeight,
+		addr:          addr,
 	}
 }
 
 func (b *weightRoundRobinBalance) GetAllAddress() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	addrList := make([]string, 0)
 	for addr := range b.addrList {
 		addrList = append(addrList, addr)
@@ -0,0 +1,172 @@
+package balance
+
+import (
+	"context"
+	"maps"
+	"octopus/metadata"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeastRequest(t *testing.T) {
+	logger := zerolog.Nop()
+	b := newLeastRequestBalance(&logger)
+	for _, addr := range []string{"10.0.0.1:9000", "10.0.0.2:9000", "10.0.0.3:9000"} {
+		b.Add(addr, 1)
+	}
+	picked := make(map[string]Done)
+	for i := 0; i < 3; i++ {
+		addr, done := b.Next(nil)
+		if _, ok := picked[addr]; ok {
+			t.Fatalf("the busy host %v is picked", addr)
+		}
+		picked[addr] = done
+	}
+	//the host finished first has the fewest in-flight requests
+	picked["10.0.0.2:9000"](nil)
+	for i := 0; i < 3; i++ {
+		addr, done := b.Next(nil)
+		if addr != "10.0.0.2:9000" {
+			t.Fatalf("the host %v is picked instead of the idle one", addr)
+		}
+		done(nil)
+	}
+	b.Remove("10.0.0.2:9000")
+	if addr, _ := b.Next(nil); addr == "10.0.0.2:9000" || addr == "" {
+		t.Fatalf("the host %v is picked after the removal", addr)
+	}
+}
+
+func p2chosts(t *testing.T) (*p2cEWMABalance, map[string]*ewmaload) {
+	t.Helper()
+	logger := zerolog.Nop()
+	b := newP2CEWMABalance(&logger)
+	b.Add("10.0.0.1:9000", 1)
+	b.Add("10.0.0.2:9000", 1)
+	hosts := make(map[string]*ewmaload)
+	for _, h := range *b.hosts.Load() {
+		hosts[h.addr] = h
+	}
+	return b, hosts
+}
+
+/*
+the host failing fast is penalized, so it does not draw the traffic by its low latency
+*/
+func TestP2CEWMAFailure(t *testing.T) {
+	b, hosts := p2chosts(t)
+	failed, done := b.Next(nil)
+	done(status.Error(codes.Unavailable, "connection refused"))
+	if ewma := hosts[failed].ewma; ewma < float64(ewmaPenalty) {
+		t.Fatalf("the ewma of the failed host is %v", time.Duration(ewma))
+	}
+	for i := 0; i < 20; i++ {
+		addr, done := b.Next(nil)
+		if addr == failed {
+			t.Fatalf("the failed host is picked by the request %v", i)
+		}
+		done(nil)
+	}
+	//the error answered by the host is its latency
+	for _, h := range hosts {
+		h.ewma = 0
+	}
+	_, done = b.Next(nil)
+	done(status.Error(codes.NotFound, "no user"))
+	for addr, h := range hosts {
+		if h.ewma >= float64(ewmaPenalty) {
+			t.Fatalf("the host %v is penalized by the error of the request", addr)
+		}
+	}
+}
+
+/*
+the streams and the requests not sent are not observed
+*/
+func TestP2CEWMANotObserved(t *testing.T) {
+	b, hosts := p2chosts(t)
+	stream := &metadata.MetaData{Descriptor: &metadata.Descriptor{ServerStreaming: true}}
+	_, done := b.Next(stream)
+	time.Sleep(20 * time.Millisecond)
+	done(status.Error(codes.Unavailable, "the stream is broken"))
+	_, done = b.Next(nil)
+	done(context.Canceled)
+	_, done = b.Next(nil)
+	done(status.Error(codes.Canceled, "the client is gone"))
+	for addr, h := range hosts {
+		if h.ewma != 0 || h.inflight.Load() != 0 {
+			t.Fatalf("the host %v is observed with %v and %v in flight", addr, time.Duration(h.ewma), h.inflight.Load())
+		}
+	}
+}
+
+func hashkeys(b Balance, n int) map[string]string {
+	keys := make(map[string]string)
+	for i := 0; i < n; i++ {
+		key := "user-" + strconv.Itoa(i)
+		data := &metadata.MetaData{Descriptor: &metadata.Descriptor{URI: &metadata.URI{Params: map[string]any{"id": key}}}}
+		keys[key], _ = b.Next(data)
+	}
+	return keys
+}
+
+/*
+only the keys of the removed host are moved, the other keys stay on their hosts
+*/
+func TestConsistentHashRemove(t *testing.T) {
+	logger := zerolog.Nop()
+	b := NewConsistentHash(ParamKey("id"), &logger)
+	for _, addr := range []string{"10.0.0.1:9000", "10.0.0.2:9000", "10.0.0.3:9000", "10.0.0.4:9000"} {
+		b.Add(addr, 1)
+	}
+	before := hashkeys(b, 2000)
+	b.Remove("10.0.0.2:9000")
+	after := hashkeys(b, 2000)
+	moved := 0
+	for key, addr := range before {
+		if addr == "10.0.0.2:9000" {
+			moved++
+			if after[key] == addr {
+				t.Fatalf("the key %v stays on the removed host", key)
+			}
+		} else if after[key] != addr {
+			t.Fatalf("the key %v of the host %v is moved to %v", key, addr, after[key])
+		}
+	}
+	if moved < 300 || moved > 700 {
+		t.Fatalf("the removed host had %v of 2000 keys", moved)
+	}
+	//the host joining again takes its keys back
+	b.Add("10.0.0.2:9000", 1)
+	if again := hashkeys(b, 2000); !maps.Equal(again, before) {
+		t.Fatal("the keys are not the same after the host joins again")
+	}
+}
+
+/*
+the share of the keys follows the weight of the host
+*/
+func TestConsistentHashWeight(t *testing.T) {
+	logger := zerolog.Nop()
+	b := NewConsistentHash(ParamKey("id"), &logger)
+	b.Add("10.0.0.1:9000", 1)
+	b.Add("10.0.0.2:9000", 3)
+	counts := make(map[string]int)
+	for _, addr := range hashkeys(b, 4000) {
+		counts[addr]++
+	}
+	if share := float64(counts["10.0.0.2:9000"]) / 4000; share < 0.68 || share > 0.82 {
+		t.Fatalf("the share of the host with the weight 3 of 4 is %v", share)
+	}
+	//the request without the key is balanced by round robin
+	first, _ := b.Next(&metadata.MetaData{})
+	second, _ := b.Next(&metadata.MetaData{})
+	if first == second {
+		t.Fatalf("the requests without the key are sent to %v", first)
+	}
+}
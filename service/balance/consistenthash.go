@@ -0,0 +1,192 @@
+package balance
+
+import (
+	"fmt"
+	"hash/fnv"
+	"octopus/metadata"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	//the virtual nodes of the host with the weight 1 on the ring
+	hashReplicas = 160
+)
+
+/*
+the key of the request for the consistent hash, the request without the key is balanced by round robin
+*/
+type HashKey func(data *metadata.MetaData) string
+
+/*
+the header of the http request or the metadata of the grpc request
+*/
+func HeaderKey(name string) HashKey {
+	return func(data *metadata.MetaData) string {
+		value, _ := data.HeaderValue(name)
+		return value
+	}
+}
+
+/*
+the field of the http payload by the path such as user.id
+*/
+func PayloadKey(fieldpath string) HashKey {
+	return func(data *metadata.MetaData) string {
+		if value, ok := data.PayloadField(fieldpath); ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+}
+
+/*
+the url param of the http request
+*/
+func ParamKey(name string) HashKey {
+	return func(data *metadata.MetaData) string {
+		if data.Descriptor == nil || data.Descriptor.URI == nil {
+			return ""
+		}
+		if value, ok := data.Descriptor.Params[name]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+}
+
+/*
+the ip of the client
+*/
+func ClientIPKey() HashKey {
+	return func(data *metadata.MetaData) string {
+		return data.ClientIP()
+	}
+}
+
+type hashring struct {
+	hashes []uint64
+	addrs  []string
+	hosts  []string
+}
+
+/*
+the ring hash, the host has the virtual nodes by its weight, so only the keys of the joined or left host are moved.
+the ring is rebuilt on write, so Next does not need the lock
+*/
+type consistentHashBalance struct {
+	key      HashKey
+	curIndex atomic.Uint64
+	ring     atomic.Pointer[hashring]
+	weights  map[string]int
+	mu       sync.Mutex
+	logger   *zerolog.Logger
+}
+
+func NewConsistentHash(key HashKey, logger *zerolog.Logger) Balance {
+	b := &consistentHashBalance{
+		key:     key,
+		weights: make(map[string]int),
+		logger:  logger,
+	}
+	b.ring.Store(&hashring{})
+	return b
+}
+
+func hashof(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	//the finalizer of splitmix64 spreads the similar keys
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (b *consistentHashBalance) build() {
+	ring := &hashring{}
+	for addr, weight := range b.weights {
+		ring.hosts = append(ring.hosts, addr)
+		for i := 0; i < hashReplicas*max(weight, 1); i++ {
+			ring.hashes = append(ring.hashes, hashof(addr+"#"+strconv.Itoa(i)))
+			ring.addrs = append(ring.addrs, addr)
+		}
+	}
+	sort.Strings(ring.hosts)
+	sort.Sort(ring)
+	b.ring.Store(ring)
+}
+
+func (r *hashring) Len() int { return len(r.hashes) }
+func (r *hashring) Less(i, j int) bool {
+	if r.hashes[i] == r.hashes[j] {
+		return r.addrs[i] < r.addrs[j]
+	}
+	return r.hashes[i] < r.hashes[j]
+}
+func (r *hashring) Swap(i, j int) {
+	r.hashes[i], r.hashes[j] = r.hashes[j], r.hashes[i]
+	r.addrs[i], r.addrs[j] = r.addrs[j], r.addrs[i]
+}
+
+func (b *consistentHashBalance) Add(addr string, weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w, ok := b.weights[addr]; !ok || w != weight {
+		b.weights[addr] = weight
+		b.build()
+	}
+}
+
+func (b *consistentHashBalance) SetWegiht(num int, addr string) {}
+
+func (b *consistentHashBalance) Eject(addr string) {
+	b.Remove(addr)
+}
+
+func (b *consistentHashBalance) Restore(addr string, weight, step int) {
+	b.Add(addr, weight)
+}
+
+func (b *consistentHashBalance) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.weights[addr]; ok {
+		b.logger.Info().Msg(fmt.Sprintf("begin delete the host %v", addr))
+		delete(b.weights, addr)
+		b.build()
+	}
+}
+
+func (b *consistentHashBalance) Next(data *metadata.MetaData) (string, Done) {
+	ring := b.ring.Load()
+	if len(ring.hosts) == 0 {
+		return "", nodone
+	}
+	var key string
+	if data != nil {
+		key = b.key(data)
+	}
+	if len(key) == 0 {
+		return ring.hosts[(b.curIndex.Add(1)-1)%uint64(len(ring.hosts))], nodone
+	}
+	hash := hashof(key)
+	index := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	if index == len(ring.hashes) {
+		index = 0
+	}
+	return ring.addrs[index], nodone
+}
+
+func (b *consistentHashBalance) GetAllAddress() []string {
+	return b.ring.Load().hosts
+}
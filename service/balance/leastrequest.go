@@ -0,0 +1,99 @@
+package balance
+
+import (
+	"fmt"
+	"octopus/metadata"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+)
+
+/*
+the load of the host, the in-flight requests are counted by Next and the done callback
+*/
+type hostload struct {
+	addr     string
+	inflight atomic.Int64
+}
+
+/*
+the host with the fewest in-flight requests is picked, the ties are broken by round robin.
+the host list is copied on write, so Next does not need the lock
+*/
+type leastRequestBalance struct {
+	curIndex atomic.Uint64
+	hosts    atomic.Pointer[[]*hostload]
+	mu       sync.Mutex
+	logger   *zerolog.Logger
+}
+
+func newLeastRequestBalance(logger *zerolog.Logger) *leastRequestBalance {
+	b := &leastRequestBalance{
+		logger: logger,
+	}
+	b.hosts.Store(&[]*hostload{})
+	return b
+}
+
+func (b *leastRequestBalance) Add(addr string, weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hosts := *b.hosts.Load()
+	if !slices.ContainsFunc(hosts, func(h *hostload) bool { return h.addr == addr }) {
+		hosts = append(slices.Clip(hosts), &hostload{addr: addr})
+		b.hosts.Store(&hosts)
+	}
+}
+
+func (b *leastRequestBalance) SetWegiht(num int, addr string) {}
+
+func (b *leastRequestBalance) Eject(addr string) {
+	b.Remove(addr)
+}
+
+func (b *leastRequestBalance) Restore(addr string, weight, step int) {
+	b.Add(addr, weight)
+}
+
+func (b *leastRequestBalance) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hosts := *b.hosts.Load()
+	index := slices.IndexFunc(hosts, func(h *hostload) bool { return h.addr == addr })
+	if index > -1 {
+		b.logger.Info().Msg(fmt.Sprintf("begin delete the host %v", addr))
+		hosts = slices.Delete(slices.Clone(hosts), index, index+1)
+		b.hosts.Store(&hosts)
+	}
+}
+
+func (b *leastRequestBalance) Next(data *metadata.MetaData) (string, Done) {
+	hosts := *b.hosts.Load()
+	length := uint64(len(hosts))
+	if length == 0 {
+		return "", nodone
+	}
+	start := b.curIndex.Add(1) - 1
+	var least *hostload
+	for i := uint64(0); i < length; i++ {
+		h := hosts[(start+i)%length]
+		if least == nil || h.inflight.Load() < least.inflight.Load() {
+			least = h
+		}
+	}
+	least.inflight.Add(1)
+	return least.addr, func(err error) {
+		least.inflight.Add(-1)
+	}
+}
+
+func (b *leastRequestBalance) GetAllAddress() []string {
+	hosts := *b.hosts.Load()
+	addrList := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		addrList = append(addrList, h.addr)
+	}
+	return addrList
+}
@@ -0,0 +1,175 @@
+package balance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"octopus/metadata"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	//the decay time of the latency ewma
+	ewmaDecay = 10 * time.Second
+	//the latency of the failed request, the host failing fast does not look faster than the others
+	ewmaPenalty = time.Second
+)
+
+/*
+the latency observed by the outcome of the request, the failure of the host costs the penalty at least,
+the request not sent or canceled by the client is not observed
+*/
+func ewmartt(rtt time.Duration, err error) (time.Duration, bool) {
+	if errors.Is(err, context.Canceled) {
+		return 0, false
+	}
+	switch status.Code(err) {
+	case codes.OK:
+		return rtt, true
+	case codes.Canceled:
+		return 0, false
+	case codes.Unknown, codes.DeadlineExceeded, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return max(rtt, ewmaPenalty), true
+	}
+	//the error of the request itself (such as NotFound) is answered by the host
+	return rtt, true
+}
+
+/*
+the peak ewma of the latency, the higher latency is taken at once and the lower one is decayed in
+*/
+type ewmaload struct {
+	hostload
+	mu    sync.Mutex
+	ewma  float64
+	stamp time.Time
+}
+
+func (h *ewmaload) observe(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	value := float64(rtt)
+	if value > h.ewma {
+		h.ewma = value
+	} else {
+		w := math.Exp(-float64(now.Sub(h.stamp)) / float64(ewmaDecay))
+		h.ewma = h.ewma*w + value*(1-w)
+	}
+	h.stamp = now
+}
+
+/*
+the cost is the latency multiplied by the load, the host without the latency costs by the load only
+*/
+func (h *ewmaload) cost() float64 {
+	h.mu.Lock()
+	ewma := h.ewma
+	h.mu.Unlock()
+	load := float64(h.inflight.Load() + 1)
+	if ewma == 0 {
+		return load
+	}
+	return ewma * load
+}
+
+/*
+the power of two choices, two hosts are picked at random and the one with the lower latency × load is used.
+the host list is copied on write, so Next does not need the lock
+*/
+type p2cEWMABalance struct {
+	hosts  atomic.Pointer[[]*ewmaload]
+	mu     sync.Mutex
+	logger *zerolog.Logger
+}
+
+func newP2CEWMABalance(logger *zerolog.Logger) *p2cEWMABalance {
+	b := &p2cEWMABalance{
+		logger: logger,
+	}
+	b.hosts.Store(&[]*ewmaload{})
+	return b
+}
+
+func (b *p2cEWMABalance) Add(addr string, weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hosts := *b.hosts.Load()
+	if !slices.ContainsFunc(hosts, func(h *ewmaload) bool { return h.addr == addr }) {
+		h := &ewmaload{stamp: time.Now()}
+		h.addr = addr
+		hosts = append(slices.Clip(hosts), h)
+		b.hosts.Store(&hosts)
+	}
+}
+
+func (b *p2cEWMABalance) SetWegiht(num int, addr string) {}
+
+func (b *p2cEWMABalance) Eject(addr string) {
+	b.Remove(addr)
+}
+
+func (b *p2cEWMABalance) Restore(addr string, weight, step int) {
+	b.Add(addr, weight)
+}
+
+func (b *p2cEWMABalance) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hosts := *b.hosts.Load()
+	index := slices.IndexFunc(hosts, func(h *ewmaload) bool { return h.addr == addr })
+	if index > -1 {
+		b.logger.Info().Msg(fmt.Sprintf("begin delete the host %v", addr))
+		hosts = slices.Delete(slices.Clone(hosts), index, index+1)
+		b.hosts.Store(&hosts)
+	}
+}
+
+func (b *p2cEWMABalance) Next(data *metadata.MetaData) (string, Done) {
+	hosts := *b.hosts.Load()
+	var picked *ewmaload
+	switch len(hosts) {
+	case 0:
+		return "", nodone
+	case 1:
+		picked = hosts[0]
+	default:
+		i := rand.Intn(len(hosts))
+		j := rand.Intn(len(hosts) - 1)
+		if j >= i {
+			j++
+		}
+		picked = hosts[i]
+		if hosts[j].cost() < picked.cost() {
+			picked = hosts[j]
+		}
+	}
+	picked.inflight.Add(1)
+	start := time.Now()
+	//the stream is finished at the end of its lifetime, so its latency is not observed
+	streaming := data != nil && data.Descriptor != nil && (data.Descriptor.ClientStreaming || data.Descriptor.ServerStreaming)
+	return picked.addr, func(err error) {
+		picked.inflight.Add(-1)
+		if rtt, ok := ewmartt(time.Since(start), err); ok && !streaming {
+			picked.observe(rtt)
+		}
+	}
+}
+
+func (b *p2cEWMABalance) GetAllAddress() []string {
+	hosts := *b.hosts.Load()
+	addrList := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		addrList = append(addrList, h.addr)
+	}
+	return addrList
+}
@@ -0,0 +1,348 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/service/ware"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+this option is used to open the circuit when the failures are ratio (0-1) of the requests in the window,
+and the requests are at least minrequests
+*/
+func WithBreakerRatio(ratio float64, minrequests int) metadata.OptionBuilder[CircuitBreaker] {
+	return func(cb *CircuitBreaker) {
+		cb.ratio = ratio
+		cb.minrequests = minrequests
+	}
+}
+
+/*
+this option is used to set the rolling window of the failures, it is counted by seconds
+*/
+func WithBreakerWindow(window time.Duration) metadata.OptionBuilder[CircuitBreaker] {
+	return func(cb *CircuitBreaker) {
+		cb.window = max(int(window/time.Second), 1)
+	}
+}
+
+/*
+this option is used to set the time of the open circuit before the half open
+*/
+func WithBreakerOpenTime(opentime time.Duration) metadata.OptionBuilder[CircuitBreaker] {
+	return func(cb *CircuitBreaker) {
+		cb.opentime = opentime
+	}
+}
+
+/*
+this option is used to set the probes of the half open circuit, the circuit is closed if all of them succeed
+*/
+func WithBreakerProbes(probes int) metadata.OptionBuilder[CircuitBreaker] {
+	return func(cb *CircuitBreaker) {
+		cb.probes = probes
+	}
+}
+
+/*
+this option is used to listen the changes of the circuits, such as the metrics
+*/
+func WithBreakerListener(listener func(kind, key string, from, to CircuitState)) metadata.OptionBuilder[CircuitBreaker] {
+	return func(cb *CircuitBreaker) {
+		cb.listener = listener
+	}
+}
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// the kinds of the circuits, the backend host (data.Target) and the route (the full method)
+const (
+	CircuitHost  = "host"
+	CircuitRoute = "route"
+)
+
+/*
+the circuit of the host or the route, the Requests and the Failures are counted in the window
+*/
+type CircuitStats struct {
+	Kind     string
+	Key      string
+	State    CircuitState
+	Requests int
+	Failures int
+	Opens    int
+	Changed  time.Time
+}
+
+type circuitbucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+type circuit struct {
+	state   CircuitState
+	buckets []circuitbucket
+	changed time.Time
+	//the probes admitted and succeeded in the half open
+	probes    int
+	successes int
+	opens     int
+}
+
+func (c *circuit) count(now int64) (requests, failures int) {
+	for _, v := range c.buckets {
+		if v.second > now-int64(len(c.buckets)) {
+			requests += v.requests
+			failures += v.failures
+		}
+	}
+	return
+}
+
+type transition struct {
+	kind, key string
+	from, to  CircuitState
+}
+
+/*
+the circuit breaker tracks the failures (the same as the outlier detection) of each backend host and each route,
+the open circuit fails fast with Unavailable, it goes half open after the open time and the limited probes close it again
+*/
+type CircuitBreaker struct {
+	ratio       float64
+	minrequests int
+	window      int
+	opentime    time.Duration
+	probes      int
+	listener    func(kind, key string, from, to CircuitState)
+	mu          sync.Mutex
+	circuits    map[string]map[string]*circuit
+}
+
+func NewCircuitBreaker(builders ...metadata.OptionBuilder[CircuitBreaker]) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		ratio:       0.5,
+		minrequests: 20,
+		window:      10,
+		opentime:    5 * time.Second,
+		probes:      3,
+		circuits: map[string]map[string]*circuit{
+			CircuitHost:  make(map[string]*circuit),
+			CircuitRoute: make(map[string]*circuit),
+		},
+	}
+	metadata.LoadOption(cb, builders...)
+	return cb
+}
+
+func (cb *CircuitBreaker) get(kind, key string) *circuit {
+	c, ok := cb.circuits[kind][key]
+	if !ok {
+		c = &circuit{buckets: make([]circuitbucket, cb.window)}
+		cb.circuits[kind][key] = c
+	}
+	return c
+}
+
+func (cb *CircuitBreaker) change(c *circuit, kind, key string, state CircuitState, now time.Time, logger *zerolog.Logger) transition {
+	t := transition{kind: kind, key: key, from: c.state, to: state}
+	if state == CircuitOpen {
+		logger.Warn().Msg(fmt.Sprintf(config.CIRCUITCHANGED, kind, key, c.state, state))
+		c.opens++
+	} else {
+		logger.Info().Msg(fmt.Sprintf(config.CIRCUITCHANGED, kind, key, c.state, state))
+	}
+	if state == CircuitClosed {
+		clear(c.buckets)
+	}
+	c.state, c.changed, c.probes, c.successes = state, now, 0, 0
+	return t
+}
+
+func (cb *CircuitBreaker) notify(changes []transition) {
+	if cb.listener == nil {
+		return
+	}
+	for _, v := range changes {
+		cb.listener(v.kind, v.key, v.from, v.to)
+	}
+}
+
+/*
+the request is allowed by the circuit, the open circuit goes half open after the open time
+*/
+func (cb *CircuitBreaker) allow(kind, key string, logger *zerolog.Logger) bool {
+	var changes []transition
+	defer func() {
+		cb.notify(changes)
+	}()
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c := cb.get(kind, key)
+	now := time.Now()
+	switch c.state {
+	case CircuitOpen:
+		if now.Sub(c.changed) < cb.opentime {
+			return false
+		}
+		changes = append(changes, cb.change(c, kind, key, CircuitHalfOpen, now, logger))
+	case CircuitHalfOpen:
+		//the probes never reported (such as the refused request) are given up after the open time
+		if now.Sub(c.changed) >= cb.opentime {
+			c.changed, c.probes, c.successes = now, 0, 0
+		}
+	}
+	if c.state == CircuitHalfOpen {
+		if c.probes >= cb.probes {
+			return false
+		}
+		c.probes++
+	}
+	return true
+}
+
+/*
+the outcome of the request, the errors of the request itself (such as NotFound, Canceled) are not failures
+*/
+func (cb *CircuitBreaker) report(kind, key string, err error, logger *zerolog.Logger) {
+	code := status.Code(err)
+	if code == codes.Canceled {
+		return
+	}
+	failure := hostfailure(code)
+	var changes []transition
+	defer func() {
+		cb.notify(changes)
+	}()
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c := cb.get(kind, key)
+	now := time.Now()
+	switch c.state {
+	case CircuitClosed:
+		second := now.Unix()
+		bucket := &c.buckets[second%int64(len(c.buckets))]
+		if bucket.second != second {
+			*bucket = circuitbucket{second: second}
+		}
+		bucket.requests++
+		if failure {
+			bucket.failures++
+		}
+		if requests, failures := c.count(second); requests >= cb.minrequests && float64(failures) >= cb.ratio*float64(requests) {
+			changes = append(changes, cb.change(c, kind, key, CircuitOpen, now, logger))
+		}
+	case CircuitHalfOpen:
+		if failure {
+			changes = append(changes, cb.change(c, kind, key, CircuitOpen, now, logger))
+		} else if c.successes++; c.successes >= cb.probes {
+			changes = append(changes, cb.change(c, kind, key, CircuitClosed, now, logger))
+		}
+	}
+}
+
+/*
+the circuits of the hosts and the routes
+*/
+func (cb *CircuitBreaker) Stats() []CircuitStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now().Unix()
+	stats := make([]CircuitStats, 0, len(cb.circuits[CircuitHost])+len(cb.circuits[CircuitRoute]))
+	for kind, circuits := range cb.circuits {
+		for key, c := range circuits {
+			requests, failures := c.count(now)
+			stats = append(stats, CircuitStats{
+				Kind:     kind,
+				Key:      key,
+				State:    c.state,
+				Requests: requests,
+				Failures: failures,
+				Opens:    c.opens,
+				Changed:  c.changed,
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Kind != stats[j].Kind {
+			return stats[i].Kind < stats[j].Kind
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+func (cb *CircuitBreaker) BuildWare() ware.Middleware {
+	return func(next ware.HandlerUnit) ware.HandlerUnit {
+		return func(ctx context.Context, data *metadata.MetaData) error {
+			route := strings.ToLower(data.Descriptor.GetFullMethod())
+			if !cb.allow(CircuitRoute, route, data.Logger) {
+				data.Result = metadata.NewErrorMeta(codes.Unavailable, fmt.Sprintf(config.CIRCUITOPEN, CircuitRoute, route))
+				return nil
+			}
+			guard := &breakerguard{
+				cb:     cb,
+				logger: data.Logger,
+			}
+			data.AddGuard(guard)
+			//the route counts the outcome of the whole request once, the retries are counted by the hosts
+			data.OnComplete(func(err error) {
+				if guard.attempted {
+					cb.report(CircuitRoute, route, err, data.Logger)
+				}
+			})
+			return next(ctx, data)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) Stop() {}
+
+/*
+the guard of the request, every attempt to the host is checked and counted by the circuit of the host,
+the request refused before any attempt (such as all the hosts are open) is not counted by the route
+*/
+type breakerguard struct {
+	cb        *CircuitBreaker
+	logger    *zerolog.Logger
+	attempted bool
+}
+
+func (g *breakerguard) Allow(target string) error {
+	if !g.cb.allow(CircuitHost, target, g.logger) {
+		return status.Errorf(codes.Unavailable, config.CIRCUITOPEN, CircuitHost, target)
+	}
+	return nil
+}
+
+func (g *breakerguard) Report(target string, err error) {
+	g.attempted = true
+	g.cb.report(CircuitHost, target, err, g.logger)
+}
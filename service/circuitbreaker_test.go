@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"octopus/metadata"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func circuitstats(cb *CircuitBreaker, kind, key string) CircuitStats {
+	for _, v := range cb.Stats() {
+		if v.Kind == kind && v.Key == key {
+			return v
+		}
+	}
+	return CircuitStats{}
+}
+
+/*
+the request is retried on the other host, the hosts count every attempt and the route counts the request once
+*/
+func TestCircuitBreakerRetry(t *testing.T) {
+	cb := NewCircuitBreaker()
+	logger := zerolog.Nop()
+	data := &metadata.MetaData{
+		Descriptor: &metadata.Descriptor{URI: &metadata.URI{ServiceName: "proto.Greeter", Method: "SayHello"}},
+		Logger:     &logger,
+	}
+	err := cb.BuildWare()(func(ctx context.Context, data *metadata.MetaData) error {
+		for target, err := range map[string]error{
+			"127.0.0.1:9000": status.Error(codes.Unavailable, "down"),
+			"127.0.0.1:9001": nil,
+		} {
+			if err := data.Guard.Allow(target); err != nil {
+				t.Fatal(err)
+			}
+			data.Guard.Report(target, err)
+		}
+		return nil
+	})(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := "/proto.greeter/sayhello"
+	if stats := circuitstats(cb, CircuitRoute, route); stats.Requests != 0 {
+		t.Fatalf("the route is counted before the request is completed: %+v", stats)
+	}
+	data.Complete(nil)
+	if stats := circuitstats(cb, CircuitRoute, route); stats.Requests != 1 || stats.Failures != 0 {
+		t.Fatalf("the route is %+v", stats)
+	}
+	if stats := circuitstats(cb, CircuitHost, "127.0.0.1:9000"); stats.Requests != 1 || stats.Failures != 1 {
+		t.Fatalf("the failed host is %+v", stats)
+	}
+	if stats := circuitstats(cb, CircuitHost, "127.0.0.1:9001"); stats.Requests != 1 || stats.Failures != 0 {
+		t.Fatalf("the host is %+v", stats)
+	}
+
+	//the request refused before any attempt is not counted by the route
+	data = &metadata.MetaData{Descriptor: data.Descriptor, Logger: &logger}
+	cb.BuildWare()(func(ctx context.Context, data *metadata.MetaData) error {
+		return nil
+	})(context.Background(), data)
+	data.Complete(status.Error(codes.Unavailable, "no host"))
+	if stats := circuitstats(cb, CircuitRoute, route); stats.Requests != 1 {
+		t.Fatalf("the route is %+v", stats)
+	}
+}
@@ -0,0 +1,345 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/service/ware"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+this option is used to set the initial, the min and the max of the concurrency limit
+*/
+func WithConcurrencyLimit(initial, min, max int) metadata.OptionBuilder[ConcurrencyLimitService] {
+	return func(cs *ConcurrencyLimitService) {
+		cs.initial, cs.min, cs.max = initial, min, max
+	}
+}
+
+/*
+this option is used to adjust the limit by the gradient of the min rtt (the latency without the load) and the rtt of the request (the default),
+the rtt in the tolerance (2 by default) times of the min rtt is not the overload and the limit is smoothed by the smoothing (0.2 by default)
+*/
+func WithGradientLimit(tolerance, smoothing float64) metadata.OptionBuilder[ConcurrencyLimitService] {
+	return func(cs *ConcurrencyLimitService) {
+		cs.algorithm = func() limitalgorithm {
+			return &gradientlimit{tolerance: tolerance, smoothing: smoothing}
+		}
+	}
+}
+
+/*
+this option is used to adjust the limit by the additive increase and the multiplicative decrease,
+the limit is multiplied by the backoff (such as 0.9) if the request is dropped or its rtt is over the timeout
+*/
+func WithAIMDLimit(backoff float64, timeout time.Duration) metadata.OptionBuilder[ConcurrencyLimitService] {
+	return func(cs *ConcurrencyLimitService) {
+		cs.algorithm = func() limitalgorithm {
+			return &aimdlimit{backoff: backoff, timeout: timeout}
+		}
+	}
+}
+
+/*
+this option is used to queue the size of the requests over the limit for the wait at most,
+the requests are rejected at once by default
+*/
+func WithConcurrencyQueue(size int, wait time.Duration) metadata.OptionBuilder[ConcurrencyLimitService] {
+	return func(cs *ConcurrencyLimitService) {
+		cs.queuesize, cs.wait = size, wait
+	}
+}
+
+/*
+this option is used to give the routes their own limits, the route is the full method (/proto.Greeter/SayHello)
+or the service (/proto.Greeter/*), the other routes share the limit of *
+*/
+func WithConcurrencyPartition(routes ...string) metadata.OptionBuilder[ConcurrencyLimitService] {
+	return func(cs *ConcurrencyLimitService) {
+		for _, v := range routes {
+			cs.partitions[strings.ToLower(v)] = struct{}{}
+		}
+	}
+}
+
+/*
+this option is used to give every route its own limit
+*/
+func WithConcurrencyPerRoute() metadata.OptionBuilder[ConcurrencyLimitService] {
+	return func(cs *ConcurrencyLimitService) {
+		cs.perroute = true
+	}
+}
+
+/*
+the algorithm of the limit, it is not shared by the partitions
+*/
+type limitalgorithm interface {
+	//the new limit by the rtt and the inflight of the finished request, the dropped request is overloaded
+	update(limit float64, rtt time.Duration, inflight int, dropped bool) float64
+}
+
+type aimdlimit struct {
+	backoff float64
+	timeout time.Duration
+}
+
+func (a *aimdlimit) update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	if dropped || (a.timeout > 0 && rtt > a.timeout) {
+		return limit * a.backoff
+	}
+	//the limit is not increased if it is not used
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// the samples of the window, the min rtt is the min of the last window so it follows the change of the backend
+const gradientwindow = 500
+
+type gradientlimit struct {
+	tolerance float64
+	smoothing float64
+	minrtt    float64
+	windowmin float64
+	samples   int
+}
+
+func (g *gradientlimit) update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	sample := float64(rtt)
+	if sample <= 0 {
+		return limit
+	}
+	if g.minrtt == 0 || sample < g.minrtt {
+		g.minrtt = sample
+	}
+	if g.windowmin == 0 || sample < g.windowmin {
+		g.windowmin = sample
+	}
+	if g.samples++; g.samples >= gradientwindow {
+		g.minrtt, g.windowmin, g.samples = g.windowmin, 0, 0
+	}
+	//the limit is not increased if it is not used
+	if !dropped && float64(inflight) < limit/2 {
+		return limit
+	}
+	gradient := max(0.5, min(1, g.tolerance*g.minrtt/sample))
+	if dropped {
+		gradient = 0.5
+	}
+	//the square root of the limit is the queue of the backend
+	newlimit := limit*gradient + math.Sqrt(limit)
+	return limit*(1-g.smoothing) + newlimit*g.smoothing
+}
+
+type concurrencylimit struct {
+	algorithm limitalgorithm
+	limit     float64
+	inflight  int
+	waiters   []chan struct{}
+	rejected  int
+}
+
+/*
+the concurrency limit of the partition, the Queued are waiting for the limit and the Rejected are counted from the start
+*/
+type ConcurrencyStats struct {
+	Partition string
+	Limit     int
+	Inflight  int
+	Queued    int
+	Rejected  int
+}
+
+/*
+the concurrency limit adjusts the requests in flight by the latency of the requests like the netflix concurrency-limits,
+the requests over the limit are queued or rejected with ResourceExhausted
+*/
+type ConcurrencyLimitService struct {
+	initial    int
+	min        int
+	max        int
+	algorithm  func() limitalgorithm
+	queuesize  int
+	wait       time.Duration
+	partitions map[string]struct{}
+	perroute   bool
+	mu         sync.Mutex
+	limits     map[string]*concurrencylimit
+}
+
+func NewConcurrencyLimit(builders ...metadata.OptionBuilder[ConcurrencyLimitService]) *ConcurrencyLimitService {
+	cs := &ConcurrencyLimitService{
+		initial: 20,
+		min:     5,
+		max:     1000,
+		algorithm: func() limitalgorithm {
+			return &gradientlimit{tolerance: 2, smoothing: 0.2}
+		},
+		partitions: make(map[string]struct{}),
+		limits:     make(map[string]*concurrencylimit),
+	}
+	metadata.LoadOption(cs, builders...)
+	return cs
+}
+
+func (cs *ConcurrencyLimitService) partition(fullmethod string) string {
+	if cs.perroute {
+		return strings.ToLower(fullmethod)
+	}
+	key, _, _ := matchroute(cs.partitions, fullmethod)
+	return key
+}
+
+func (cs *ConcurrencyLimitService) get(key string) *concurrencylimit {
+	l, ok := cs.limits[key]
+	if !ok {
+		l = &concurrencylimit{
+			algorithm: cs.algorithm(),
+			limit:     float64(cs.initial),
+		}
+		cs.limits[key] = l
+	}
+	return l
+}
+
+/*
+acquire the limit of the partition, the request waits in the queue if the limit is reached
+*/
+func (cs *ConcurrencyLimitService) acquire(ctx context.Context, key string) (*concurrencylimit, bool) {
+	cs.mu.Lock()
+	l := cs.get(key)
+	if l.inflight < int(l.limit) {
+		l.inflight++
+		cs.mu.Unlock()
+		return l, true
+	}
+	if cs.wait <= 0 || len(l.waiters) >= cs.queuesize {
+		l.rejected++
+		cs.mu.Unlock()
+		return l, false
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	cs.mu.Unlock()
+
+	timer := time.NewTimer(cs.wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return l, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if i := slices.Index(l.waiters, ch); i >= 0 {
+		l.waiters = slices.Delete(l.waiters, i, i+1)
+		l.rejected++
+		return l, false
+	}
+	//the limit is handed over at the same time
+	return l, true
+}
+
+/*
+release the limit and adjust it by the outcome of the request to the upstream, the request not sent to the upstream
+(such as rejected by the middlewares), the canceled request and the stream are not observed,
+the limit is handed over to the waiting requests
+*/
+func (cs *ConcurrencyLimitService) release(l *concurrencylimit, rtt time.Duration, err error, observed bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if code := status.Code(err); observed && code != codes.Canceled {
+		dropped := code == codes.DeadlineExceeded || code == codes.ResourceExhausted || code == codes.Unavailable
+		limit := l.algorithm.update(l.limit, rtt, l.inflight, dropped)
+		l.limit = min(max(limit, float64(cs.min), 1), float64(cs.max))
+	}
+	l.inflight--
+	cs.handover(l)
+}
+
+/*
+hand the limit over to the waiting requests in order, it is called with the lock
+*/
+func (cs *ConcurrencyLimitService) handover(l *concurrencylimit) {
+	for len(l.waiters) > 0 && l.inflight < int(l.limit) {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.inflight++
+	}
+}
+
+/*
+the guard records the outcome of the last attempt to the upstream, so the errors of the gateway
+(such as the rate limit or the open circuit) are not taken as the drops of the upstream
+*/
+type limitguard struct {
+	attempted bool
+	err       error
+}
+
+func (g *limitguard) Allow(target string) error {
+	return nil
+}
+
+func (g *limitguard) Report(target string, err error) {
+	g.attempted, g.err = true, err
+}
+
+/*
+the limits of the partitions
+*/
+func (cs *ConcurrencyLimitService) Stats() []ConcurrencyStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	stats := make([]ConcurrencyStats, 0, len(cs.limits))
+	for k, v := range cs.limits {
+		stats = append(stats, ConcurrencyStats{
+			Partition: k,
+			Limit:     int(v.limit),
+			Inflight:  v.inflight,
+			Queued:    len(v.waiters),
+			Rejected:  v.rejected,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Partition < stats[j].Partition
+	})
+	return stats
+}
+
+func (cs *ConcurrencyLimitService) BuildWare() ware.Middleware {
+	return func(next ware.HandlerUnit) ware.HandlerUnit {
+		return func(ctx context.Context, data *metadata.MetaData) error {
+			key := cs.partition(data.Descriptor.GetFullMethod())
+			l, ok := cs.acquire(ctx, key)
+			if !ok {
+				data.Result = metadata.NewErrorMeta(codes.ResourceExhausted, fmt.Sprintf(config.CONCURRENCYFULL, key))
+				return nil
+			}
+			start := time.Now()
+			guard := &limitguard{}
+			data.AddGuard(guard)
+			//the limit is released when the whole request is finished, the grpc mash proxies after the middlewares
+			data.OnComplete(func(error) {
+				streaming := data.Descriptor.ClientStreaming || data.Descriptor.ServerStreaming
+				cs.release(l, time.Since(start), guard.err, guard.attempted && !streaming)
+			})
+			return next(ctx, data)
+		}
+	}
+}
+
+func (cs *ConcurrencyLimitService) Stop() {}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"context"
+	"math"
+	"octopus/metadata"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// wait until the waiters of the partition are queued
+func queued(t *testing.T, cs *ConcurrencyLimitService, n int) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		if stats := cs.Stats(); len(stats) == 1 && stats[0].Queued == n {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("the waiters are not queued, the stats are %+v", cs.Stats())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+/*
+the released limit is handed over to the waiting requests in order, the request over the queue is rejected at once
+*/
+func TestConcurrencyLimitQueue(t *testing.T) {
+	cs := NewConcurrencyLimit(WithConcurrencyLimit(1, 1, 1), WithConcurrencyQueue(1, time.Minute))
+	l, ok := cs.acquire(context.Background(), "*")
+	if !ok {
+		t.Fatal("the first request is rejected")
+	}
+	acquired := make(chan bool)
+	go func() {
+		_, ok := cs.acquire(context.Background(), "*")
+		acquired <- ok
+	}()
+	queued(t, cs, 1)
+	if _, ok := cs.acquire(context.Background(), "*"); ok {
+		t.Fatal("the request over the queue is acquired")
+	}
+	cs.release(l, time.Millisecond, nil, false)
+	if !<-acquired {
+		t.Fatal("the waiting request is rejected after the release")
+	}
+	if stats := cs.Stats(); stats[0].Inflight != 1 || stats[0].Queued != 0 || stats[0].Rejected != 1 {
+		t.Fatalf("the stats are %+v", stats)
+	}
+}
+
+/*
+the waiting request is rejected by the wait or the ctx, unless the limit is handed over to it at the same time
+*/
+func TestConcurrencyLimitWait(t *testing.T) {
+	cs := NewConcurrencyLimit(WithConcurrencyLimit(1, 1, 1), WithConcurrencyQueue(1, 20*time.Millisecond))
+	l, _ := cs.acquire(context.Background(), "*")
+	if _, ok := cs.acquire(context.Background(), "*"); ok {
+		t.Fatal("the request is acquired after the wait")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := cs.acquire(ctx, "*"); ok {
+		t.Fatal("the canceled request is acquired")
+	}
+	if stats := cs.Stats(); stats[0].Inflight != 1 || stats[0].Queued != 0 || stats[0].Rejected != 2 {
+		t.Fatalf("the stats are %+v", stats)
+	}
+
+	cs.wait = time.Minute
+	ctx, cancel = context.WithCancel(context.Background())
+	acquired := make(chan bool)
+	go func() {
+		_, ok := cs.acquire(ctx, "*")
+		acquired <- ok
+	}()
+	queued(t, cs, 1)
+	//the ctx is canceled while the limit is handed over under the lock
+	cs.mu.Lock()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	l.inflight--
+	cs.handover(l)
+	cs.mu.Unlock()
+	if !<-acquired {
+		t.Fatal("the request is rejected after the limit is handed over to it")
+	}
+	if stats := cs.Stats(); stats[0].Inflight != 1 || stats[0].Rejected != 2 {
+		t.Fatalf("the limit is leaked, the stats are %+v", stats)
+	}
+}
+
+func TestAIMDLimit(t *testing.T) {
+	a := &aimdlimit{backoff: 0.9, timeout: 100 * time.Millisecond}
+	for _, v := range []struct {
+		inflight int
+		rtt      time.Duration
+		dropped  bool
+		limit    float64
+	}{
+		{10, 10 * time.Millisecond, false, 21},
+		//the limit not used is not increased
+		{9, 10 * time.Millisecond, false, 20},
+		{10, 10 * time.Millisecond, true, 18},
+		{10, 200 * time.Millisecond, false, 18},
+	} {
+		if limit := a.update(20, v.rtt, v.inflight, v.dropped); math.Abs(limit-v.limit) > 1e-9 {
+			t.Fatalf("the limit of %+v is %v", v, limit)
+		}
+	}
+}
+
+func TestGradientLimit(t *testing.T) {
+	g := &gradientlimit{tolerance: 2, smoothing: 0.2}
+	//the min rtt is 10ms, the rtt in the tolerance increases the limit by the square root
+	if limit := g.update(100, 10*time.Millisecond, 60, false); math.Abs(limit-102) > 1e-9 {
+		t.Fatalf("the limit in the tolerance is %v", limit)
+	}
+	if limit := g.update(100, 15*time.Millisecond, 60, false); math.Abs(limit-102) > 1e-9 {
+		t.Fatalf("the limit of the rtt 15ms in the tolerance is %v", limit)
+	}
+	//the gradient of 2*10ms/40ms is 0.5
+	if limit := g.update(100, 40*time.Millisecond, 60, false); math.Abs(limit-92) > 1e-9 {
+		t.Fatalf("the limit over the tolerance is %v", limit)
+	}
+	if limit := g.update(100, 10*time.Millisecond, 60, true); math.Abs(limit-92) > 1e-9 {
+		t.Fatalf("the limit of the dropped request is %v", limit)
+	}
+	if limit := g.update(100, 40*time.Millisecond, 40, false); limit != 100 {
+		t.Fatalf("the limit not used is changed to %v", limit)
+	}
+	if g.minrtt != float64(10*time.Millisecond) {
+		t.Fatalf("the min rtt is %v", time.Duration(g.minrtt))
+	}
+	//the min rtt follows the min of the last window
+	for i := 0; i < 2*gradientwindow; i++ {
+		g.update(100, 30*time.Millisecond, 60, false)
+	}
+	if g.minrtt != float64(30*time.Millisecond) {
+		t.Fatalf("the min rtt after the windows is %v", time.Duration(g.minrtt))
+	}
+}
+
+func TestConcurrencyPartition(t *testing.T) {
+	cs := NewConcurrencyLimit(WithConcurrencyPartition("/proto.Greeter/SayHello", "/proto.Other/*"))
+	for fullmethod, partition := range map[string]string{
+		"/proto.Greeter/SayHello": "/proto.greeter/sayhello",
+		"/proto.Greeter/SayHi":    "*",
+		"/proto.Other/Get":        "/proto.other/*",
+	} {
+		if key := cs.partition(fullmethod); key != partition {
+			t.Fatalf("the partition of %v is %v", fullmethod, key)
+		}
+	}
+	cs = NewConcurrencyLimit(WithConcurrencyPerRoute())
+	if key := cs.partition("/proto.Greeter/SayHi"); key != "/proto.greeter/sayhi" {
+		t.Fatalf("the partition of the route is %v", key)
+	}
+}
+
+/*
+only the outcomes of the upstream are observed, the rejection by the middleware after the limit is not the drop
+*/
+func TestConcurrencyLimitUpstream(t *testing.T) {
+	logger := zerolog.Nop()
+	cs := NewConcurrencyLimit(WithConcurrencyLimit(20, 5, 100), WithAIMDLimit(0.5, 0))
+	request := func(next func(data *metadata.MetaData)) {
+		data := &metadata.MetaData{
+			Descriptor: &metadata.Descriptor{URI: &metadata.URI{ServiceName: "proto.Greeter", Method: "SayHello"}},
+			Logger:     &logger,
+		}
+		cs.BuildWare()(func(ctx context.Context, data *metadata.MetaData) error {
+			next(data)
+			return nil
+		})(context.Background(), data)
+		data.Complete(data.Err())
+	}
+	//the rate limit after the concurrency limit
+	request(func(data *metadata.MetaData) {
+		data.Result = metadata.NewErrorMeta(codes.ResourceExhausted, "rate limited")
+	})
+	//the open circuit of the host refuses the attempt
+	request(func(data *metadata.MetaData) {
+		if err := data.Guard.Allow("127.0.0.1:9000"); err != nil {
+			t.Fatal(err)
+		}
+		data.Result = metadata.NewErrorMeta(codes.Unavailable, "the circuit is open")
+	})
+	if limit := cs.Stats()[0].Limit; limit != 20 {
+		t.Fatalf("the limit is changed to %v by the gateway", limit)
+	}
+	request(func(data *metadata.MetaData) {
+		err := status.Error(codes.ResourceExhausted, "the backend is busy")
+		data.Guard.Report("127.0.0.1:9000", err)
+		data.Result = metadata.ToErrorMeta(err)
+	})
+	if stats := cs.Stats()[0]; stats.Limit != 10 || stats.Inflight != 0 {
+		t.Fatalf("the limit is %+v after the drop of the upstream", stats)
+	}
+}
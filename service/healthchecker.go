@@ -0,0 +1,362 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/pool"
+	"octopus/service/regcenter"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+/*
+this option is used to set the interval of the probes
+*/
+func WithHealthInterval(interval time.Duration) metadata.OptionBuilder[HealthChecker] {
+	return func(hc *HealthChecker) {
+		hc.interval = interval
+	}
+}
+
+/*
+this option is used to set the timeout of every probe
+*/
+func WithHealthTimeout(timeout time.Duration) metadata.OptionBuilder[HealthChecker] {
+	return func(hc *HealthChecker) {
+		hc.timeout = timeout
+	}
+}
+
+/*
+this option is used to set the thresholds, the host is healthy after the healthy times of consecutive successes
+and it is unhealthy after the unhealthy times of consecutive failures
+*/
+func WithHealthThreshold(healthy, unhealthy int) metadata.OptionBuilder[HealthChecker] {
+	return func(hc *HealthChecker) {
+		hc.healthy = healthy
+		hc.unhealthy = unhealthy
+	}
+}
+
+/*
+this option is used to set the min percent of the healthy hosts (the panic threshold), the host is kept in the balance
+if it would take the healthy hosts of its cluster under the percent, 0 is no limit
+*/
+func WithHealthMinPercent(percent int) metadata.OptionBuilder[HealthChecker] {
+	return func(hc *HealthChecker) {
+		hc.minPercent = percent
+	}
+}
+
+/*
+this option is used to set the service names of the probe, the "" is the whole server,
+the service names of the routers are checked by default
+*/
+func WithHealthServices(services ...string) metadata.OptionBuilder[HealthChecker] {
+	return func(hc *HealthChecker) {
+		hc.services = append(hc.services, services...)
+	}
+}
+
+/*
+this option is used to set the dial of the probe connection, pool.Dial is used by default
+*/
+func WithHealthDial(dial func(address string) (*grpc.ClientConn, error)) metadata.OptionBuilder[HealthChecker] {
+	return func(hc *HealthChecker) {
+		hc.dial = dial
+	}
+}
+
+/*
+the health state of the host, it is shown by the admin endpoint /health
+*/
+type HostHealth struct {
+	Host      string
+	Healthy   bool
+	Successes int
+	Failures  int
+	LastCheck time.Time
+	LastError string `json:",omitempty"`
+}
+
+type hoststate struct {
+	HostHealth
+	conn *grpc.ClientConn
+	//the failed host is kept by the min percent
+	kept bool
+}
+
+/*
+the active health checker probes the available hosts of the router by grpc.health.v1.Health/Check,
+the host is healthy until it is probed failed, the unhealthy host is removed from the balance and added back on recovery
+*/
+type HealthChecker struct {
+	interval   time.Duration
+	timeout    time.Duration
+	healthy    int
+	unhealthy  int
+	minPercent int
+	services   []string
+	dial       func(address string) (*grpc.ClientConn, error)
+	mu         sync.Mutex
+	states     map[string]*hoststate
+	stop       chan struct{}
+	once       sync.Once
+}
+
+func NewHealthChecker(builders ...metadata.OptionBuilder[HealthChecker]) *HealthChecker {
+	hc := &HealthChecker{
+		interval:   5 * time.Second,
+		timeout:    time.Second,
+		healthy:    2,
+		unhealthy:  3,
+		minPercent: 50,
+		dial:       pool.Dial,
+		states:     make(map[string]*hoststate),
+		stop:       make(chan struct{}),
+	}
+	metadata.LoadOption(hc, builders...)
+	return hc
+}
+
+/*
+probe the hosts of the router every interval, the change is called when the host turns healthy or unhealthy
+*/
+func (hc *HealthChecker) start(router func() *regcenter.Router, change func(host string, healthy bool), logger *zerolog.Logger) {
+	go func() {
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				hc.check(router(), change, logger)
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+the service names routed to the host, the routes of the cluster are routed to the hosts of the cluster
+*/
+func (hc *HealthChecker) hostservices(router *regcenter.Router) map[string][]string {
+	sets := make(map[string]map[string]struct{})
+	for _, v := range router.Descriptors {
+		hosts, _ := router.ClusterHosts(v.Cluster)
+		for host := range hosts {
+			if _, ok := sets[host]; !ok {
+				sets[host] = make(map[string]struct{})
+			}
+			sets[host][v.ServiceName] = struct{}{}
+		}
+	}
+	services := make(map[string][]string, len(sets))
+	for host, set := range sets {
+		for service := range set {
+			services[host] = append(services[host], service)
+		}
+		sort.Strings(services[host])
+	}
+	return services
+}
+
+func (hc *HealthChecker) check(router *regcenter.Router, change func(host string, healthy bool), logger *zerolog.Logger) {
+	var services map[string][]string
+	if len(hc.services) == 0 {
+		services = hc.hostservices(router)
+	}
+	all := router.AllHosts()
+
+	hc.mu.Lock()
+	for host, state := range hc.states {
+		if v, ok := all[host]; !ok || !v.Status {
+			if state.conn != nil {
+				state.conn.Close()
+			}
+			delete(hc.states, host)
+		}
+	}
+	probes := make(map[string]*grpc.ClientConn)
+	errs := make(map[string]error)
+	for host, v := range all {
+		if !v.Status {
+			continue
+		}
+		state, ok := hc.states[host]
+		if !ok {
+			state = &hoststate{HostHealth: HostHealth{Host: host, Healthy: true}}
+			hc.states[host] = state
+		}
+		if state.conn == nil {
+			conn, err := hc.dial(host)
+			if err != nil {
+				errs[host] = err
+				continue
+			}
+			state.conn = conn
+		}
+		probes[host] = state.conn
+	}
+	hc.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var errmu sync.Mutex
+	for host, conn := range probes {
+		wg.Add(1)
+		go func(host string, conn *grpc.ClientConn) {
+			defer wg.Done()
+			names := hc.services
+			if services != nil {
+				names = services[host]
+			}
+			err := hc.probe(conn, names)
+			errmu.Lock()
+			errs[host] = err
+			errmu.Unlock()
+		}(host, conn)
+	}
+	wg.Wait()
+
+	changes := make(map[string]bool)
+	hc.mu.Lock()
+	for host, err := range errs {
+		state, ok := hc.states[host]
+		if !ok {
+			continue
+		}
+		state.LastCheck = time.Now()
+		if err != nil {
+			state.Successes = 0
+			state.Failures++
+			state.LastError = err.Error()
+			if state.Healthy && state.Failures >= hc.unhealthy {
+				if hc.allowed(host, router) {
+					state.Healthy, state.kept = false, false
+					changes[host] = false
+					logger.Warn().Msg(fmt.Sprintf(config.HOSTUNHEALTHY, host, err.Error()))
+				} else if !state.kept {
+					state.kept = true
+					logger.Warn().Msg(fmt.Sprintf(config.HOSTKEPT, host, hc.minPercent, err.Error()))
+				}
+			}
+		} else {
+			state.kept = false
+			state.Failures = 0
+			state.Successes++
+			state.LastError = ""
+			if !state.Healthy && state.Successes >= hc.healthy {
+				state.Healthy = true
+				changes[host] = true
+				logger.Info().Msg(fmt.Sprintf(config.HOSTHEALTHY, host))
+			}
+		}
+	}
+	hc.mu.Unlock()
+	for host, healthy := range changes {
+		change(host, healthy)
+	}
+}
+
+/*
+the host can turn unhealthy only if the healthy hosts of the global Hosts and the clusters having it are not under the min percent,
+so the probe failed on all the hosts (such as the service is not registered to the health server) does not empty the balance
+*/
+func (hc *HealthChecker) allowed(host string, router *regcenter.Router) bool {
+	if hc.minPercent <= 0 {
+		return true
+	}
+	groups := []map[string]*regcenter.HostInfo{router.Hosts}
+	for _, cluster := range router.Clusters {
+		groups = append(groups, cluster.Hosts)
+	}
+	for _, hosts := range groups {
+		if _, ok := hosts[host]; !ok {
+			continue
+		}
+		total, healthy := 0, 0
+		for k, v := range hosts {
+			if !v.Status {
+				continue
+			}
+			total++
+			if state, ok := hc.states[k]; !ok || state.Healthy {
+				healthy++
+			}
+		}
+		if (healthy-1)*100 < total*hc.minPercent {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+the host is healthy only if all the services are serving
+*/
+func (hc *HealthChecker) probe(conn *grpc.ClientConn, services []string) error {
+	if len(services) == 0 {
+		services = []string{""}
+	}
+	client := grpc_health_v1.NewHealthClient(conn)
+	for _, service := range services {
+		ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+		resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		cancel()
+		if err != nil {
+			return err
+		}
+		if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf(config.HOSTNOTSERVING, service, resp.GetStatus())
+		}
+	}
+	return nil
+}
+
+/*
+the host not probed yet is healthy
+*/
+func (hc *HealthChecker) Healthy(host string) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if state, ok := hc.states[host]; ok {
+		return state.Healthy
+	}
+	return true
+}
+
+/*
+the health states of the probed hosts
+*/
+func (hc *HealthChecker) Status() []HostHealth {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	status := make([]HostHealth, 0, len(hc.states))
+	for _, state := range hc.states {
+		status = append(status, state.HostHealth)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Host < status[j].Host
+	})
+	return status
+}
+
+func (hc *HealthChecker) Stop() {
+	hc.once.Do(func() {
+		close(hc.stop)
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+		for _, state := range hc.states {
+			if state.conn != nil {
+				state.conn.Close()
+			}
+		}
+	})
+}
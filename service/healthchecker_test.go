@@ -0,0 +1,95 @@
+package service
+
+import (
+	"net"
+	"octopus/service/regcenter"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// the grpc server of the health status of the service
+func healthserver(t *testing.T, service string, status grpc_health_v1.HealthCheckResponse_ServingStatus) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus(service, status)
+	grpc_health_v1.RegisterHealthServer(server, hs)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return l.Addr().String()
+}
+
+func healthhosts(t *testing.T, n int, status grpc_health_v1.HealthCheckResponse_ServingStatus) map[string]*regcenter.HostInfo {
+	hosts := make(map[string]*regcenter.HostInfo)
+	for i := 0; i < n; i++ {
+		addr := healthserver(t, "proto.Greeter", status)
+		hosts[addr] = &regcenter.HostInfo{Host: addr, Weight: 1, Status: true}
+	}
+	return hosts
+}
+
+func unhealthy(hc *HealthChecker, router *regcenter.Router) map[string]bool {
+	logger := zerolog.Nop()
+	changes := make(map[string]bool)
+	hc.check(router, func(host string, healthy bool) {
+		changes[host] = healthy
+	}, &logger)
+	return changes
+}
+
+/*
+the service is not serving on every host, the hosts are kept in the balance by the min percent
+*/
+func TestHealthCheckerMinPercent(t *testing.T) {
+	router := &regcenter.Router{Hosts: healthhosts(t, 4, grpc_health_v1.HealthCheckResponse_NOT_SERVING)}
+
+	hc := NewHealthChecker(WithHealthServices("proto.Greeter"), WithHealthThreshold(1, 1))
+	defer hc.Stop()
+	if changes := unhealthy(hc, router); len(changes) != 2 {
+		t.Fatalf("the unhealthy hosts are %v", changes)
+	}
+	healthy := 0
+	for host := range router.Hosts {
+		if hc.Healthy(host) {
+			healthy++
+		}
+	}
+	if healthy != 2 {
+		t.Fatalf("the healthy hosts are %v", healthy)
+	}
+	//the kept hosts fail again, they are still kept
+	if changes := unhealthy(hc, router); len(changes) != 0 {
+		t.Fatalf("the kept hosts are changed %v", changes)
+	}
+
+	hc = NewHealthChecker(WithHealthServices("proto.Greeter"), WithHealthThreshold(1, 1), WithHealthMinPercent(0))
+	defer hc.Stop()
+	if changes := unhealthy(hc, router); len(changes) != 4 {
+		t.Fatalf("the unhealthy hosts without the min percent are %v", changes)
+	}
+}
+
+/*
+the min percent is of the cluster, the hosts of the global Hosts do not count
+*/
+func TestHealthCheckerClusterMinPercent(t *testing.T) {
+	router := &regcenter.Router{
+		Hosts: healthhosts(t, 4, grpc_health_v1.HealthCheckResponse_SERVING),
+		Clusters: map[string]*regcenter.Cluster{
+			"canary": {Name: "canary", Hosts: healthhosts(t, 2, grpc_health_v1.HealthCheckResponse_NOT_SERVING)},
+		},
+	}
+	hc := NewHealthChecker(WithHealthServices("proto.Greeter"), WithHealthThreshold(1, 1))
+	defer hc.Stop()
+	if changes := unhealthy(hc, router); len(changes) != 1 {
+		t.Fatalf("the unhealthy hosts are %v", changes)
+	}
+}
@@ -5,11 +5,10 @@ import (
 	"octopus/config"
 	"octopus/metadata"
 	"octopus/service/ware"
-	"strings"
 	"sync"
 	"time"
 
-	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/codes"
 )
 
 type Service interface {
@@ -17,6 +16,10 @@ type Service interface {
 	Stop()
 }
 
+/*
+the token bucket of all the requests in the process memory, the limits by the routes, the keys and the rules are
+evaluated by the RateLimitService instead, such as service.NewRuleRateLimit(ratelimit.NewMemoryStore())
+*/
 type LimitService struct {
 	ticker   *time.Ticker
 	rate     int
@@ -102,9 +105,7 @@ func (ls *LimitService) BuildWare() ware.Middleware {
 			if ls.TryGetToken() {
 				return next(ctx, data)
 			} else {
-				data.Result = metadata.ErrorMeta{
-					Error: config.BUCKETEMPTY,
-				}
+				data.Result = metadata.NewErrorMeta(codes.ResourceExhausted, config.BUCKETEMPTY)
 				return nil
 			}
 		}
@@ -176,29 +177,15 @@ func (ls *LimitIPService) Stop() {
 func (ls *LimitIPService) BuildWare() ware.Middleware {
 	return func(next ware.HandlerUnit) ware.HandlerUnit {
 		return func(ctx context.Context, data *metadata.MetaData) error {
-			var ipAddr string
-			if data.HttpMeta != nil {
-				ipAddr = data.Request.RemoteAddr
-			} else if data.GrpcMeta != nil {
-				if peer, ok := peer.FromContext(data.GrpcContext); !ok {
-					data.Logger.Fatal().Msg(config.IPADDRERROR)
-				} else {
-					ipAddr = peer.Addr.String()
-				}
-			} else {
+			ipAddr := data.ClientIP()
+			if len(ipAddr) == 0 {
 				data.Logger.Fatal().Msg(config.IPADDRERROR)
 			}
 
-			if strings.Contains(ipAddr, ":") {
-				ipAddr = ipAddr[:strings.Index(ipAddr, ":")]
-			}
-
 			if ls.TryAdd(ipAddr) {
 				return next(ctx, data)
 			} else {
-				data.Result = metadata.ErrorMeta{
-					Error: config.IPLIMITED,
-				}
+				data.Result = metadata.NewErrorMeta(codes.ResourceExhausted, config.IPLIMITED)
 				return nil
 			}
 		}
@@ -0,0 +1,349 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/pool"
+	"octopus/service/ware"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	gmd "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+this option is used to mirror the percent (0-100) of the requests of the route to the shadow hosts,
+the route is the full method (/proto.Greeter/SayHello), the service (/proto.Greeter/*) or all the routes (*)
+*/
+func WithMirror(route string, percent float64, hosts ...string) metadata.OptionBuilder[MirrorService] {
+	return func(ms *MirrorService) {
+		ms.routes[strings.ToLower(route)] = &mirrorroute{
+			percent: percent,
+			hosts:   hosts,
+		}
+	}
+}
+
+/*
+this option is used to set the options of the pools of the shadow hosts
+*/
+func WithMirrorPoolOptions(options pool.Options) metadata.OptionBuilder[MirrorService] {
+	return func(ms *MirrorService) {
+		ms.options = options
+	}
+}
+
+/*
+this option is used to set the timeout of the shadow request
+*/
+func WithMirrorTimeout(timeout time.Duration) metadata.OptionBuilder[MirrorService] {
+	return func(ms *MirrorService) {
+		ms.timeout = timeout
+	}
+}
+
+/*
+this option is used to set the max shadow requests in flight, the request over it is not mirrored
+*/
+func WithMirrorMaxInflight(max int) metadata.OptionBuilder[MirrorService] {
+	return func(ms *MirrorService) {
+		ms.maxinflight = max
+	}
+}
+
+type mirrorroute struct {
+	percent float64
+	hosts   []string
+	next    atomic.Uint64
+}
+
+/*
+the outcomes of the shadow requests of the route, they are compared with the production traffic
+*/
+type MirrorStats struct {
+	Route string
+	//the shadow requests finished and the ones dropped by the max inflight, the full buffer or the broken request
+	Requests   int
+	Dropped    int
+	Codes      map[string]int
+	Latency    time.Duration
+	MaxLatency time.Duration
+	total      time.Duration
+}
+
+var mirrorStreamDesc = &grpc.StreamDesc{
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+var errMirrorAborted = errors.New("the mirrored request is broken")
+
+/*
+the mirror copies the requests to the shadow hosts asynchronously by its own pools,
+the responses of the shadow are discarded and the status and the latency are recorded
+*/
+type MirrorService struct {
+	routes      map[string]*mirrorroute
+	options     pool.Options
+	timeout     time.Duration
+	maxinflight int
+	inflight    atomic.Int64
+	mu          sync.Mutex
+	pools       map[string]pool.Pool
+	stats       map[string]*MirrorStats
+	stopped     bool
+}
+
+func NewMirror(builders ...metadata.OptionBuilder[MirrorService]) *MirrorService {
+	ms := &MirrorService{
+		routes:      make(map[string]*mirrorroute),
+		options:     pool.DefaultOptions,
+		timeout:     10 * time.Second,
+		maxinflight: 100,
+		pools:       make(map[string]pool.Pool),
+		stats:       make(map[string]*MirrorStats),
+	}
+	metadata.LoadOption(ms, builders...)
+	return ms
+}
+
+/*
+the route of the full method, then the service (/proto.Greeter/*) and then all the routes (*),
+the keys of the routes are lower case
+*/
+func matchroute[T any](routes map[string]T, fullmethod string) (string, T, bool) {
+	key := strings.ToLower(fullmethod)
+	if route, ok := routes[key]; ok {
+		return key, route, true
+	}
+	if i := strings.LastIndex(key, "/"); i > 0 {
+		if route, ok := routes[key[:i]+"/*"]; ok {
+			return key[:i] + "/*", route, true
+		}
+	}
+	route, ok := routes["*"]
+	return "*", route, ok
+}
+
+func (ms *MirrorService) BuildWare() ware.Middleware {
+	return func(next ware.HandlerUnit) ware.HandlerUnit {
+		return func(ctx context.Context, data *metadata.MetaData) error {
+			fullmethod := data.Descriptor.GetFullMethod()
+			if key, route, ok := matchroute(ms.routes, fullmethod); ok && len(route.hosts) > 0 && rand.Float64()*100 < route.percent {
+				data.Tee = &mirrortee{
+					ms:         ms,
+					route:      key,
+					host:       route.hosts[(route.next.Add(1)-1)%uint64(len(route.hosts))],
+					fullmethod: fullmethod,
+					logger:     data.Logger,
+				}
+			}
+			return next(ctx, data)
+		}
+	}
+}
+
+func (ms *MirrorService) getpool(host string, logger *zerolog.Logger) (pool.Pool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.stopped {
+		return nil, errors.New(config.MIRRORSTOPPED)
+	}
+	if p, ok := ms.pools[host]; ok {
+		return p, nil
+	}
+	p, err := pool.New(host, ms.options, logger)
+	if err != nil {
+		return nil, err
+	}
+	ms.pools[host] = p
+	return p, nil
+}
+
+func (ms *MirrorService) record(route string, err error, latency time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stats, ok := ms.stats[route]
+	if !ok {
+		stats = &MirrorStats{Route: route, Codes: make(map[string]int)}
+		ms.stats[route] = stats
+	}
+	if err == errMirrorAborted {
+		stats.Dropped++
+		return
+	}
+	stats.Requests++
+	stats.Codes[status.Code(err).String()]++
+	stats.total += latency
+	stats.Latency = stats.total / time.Duration(stats.Requests)
+	stats.MaxLatency = max(stats.MaxLatency, latency)
+}
+
+/*
+the stats of the shadow requests by the route
+*/
+func (ms *MirrorService) Stats() []MirrorStats {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	stats := make([]MirrorStats, 0, len(ms.stats))
+	for _, v := range ms.stats {
+		s := *v
+		s.Codes = make(map[string]int, len(v.Codes))
+		for code, n := range v.Codes {
+			s.Codes[code] = n
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Route < stats[j].Route
+	})
+	return stats
+}
+
+/*
+stop mirroring and drain the pools of the shadow hosts
+*/
+func (ms *MirrorService) Stop() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.stopped {
+		return
+	}
+	ms.stopped = true
+	for _, p := range ms.pools {
+		go p.Drain(pool.DrainTimeout)
+	}
+}
+
+/*
+the tee of the mirrored request, the shadow request is started by the first message and
+the messages are sent by the buffer, so the mash is never blocked by the shadow
+*/
+type mirrortee struct {
+	ms         *MirrorService
+	route      string
+	host       string
+	fullmethod string
+	logger     *zerolog.Logger
+	mu         sync.Mutex
+	msgs       chan proto.Message
+	closed     bool
+	aborted    atomic.Bool
+}
+
+func (t *mirrortee) Send(ctx context.Context, msg proto.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || t.aborted.Load() {
+		return
+	}
+	if t.msgs == nil {
+		if t.ms.inflight.Add(1) > int64(t.ms.maxinflight) {
+			t.ms.inflight.Add(-1)
+			t.closed = true
+			t.ms.record(t.route, errMirrorAborted, 0)
+			return
+		}
+		md, _ := gmd.FromOutgoingContext(ctx)
+		t.msgs = make(chan proto.Message, 64)
+		go t.run(md.Copy())
+	}
+	select {
+	case t.msgs <- proto.Clone(msg):
+	default:
+		//the shadow is too slow, the request is dropped instead of the partial messages
+		t.aborted.Store(true)
+		t.closed = true
+		close(t.msgs)
+	}
+}
+
+func (t *mirrortee) Close(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	if t.msgs != nil {
+		if err != nil && err != io.EOF {
+			t.aborted.Store(true)
+		}
+		close(t.msgs)
+	}
+}
+
+func (t *mirrortee) run(md gmd.MD) {
+	defer t.ms.inflight.Add(-1)
+	ctx, cancel := context.WithTimeout(gmd.NewOutgoingContext(context.Background(), md), t.ms.timeout)
+	defer cancel()
+	start := time.Now()
+	err := t.forward(ctx)
+	latency := time.Since(start)
+	t.ms.record(t.route, err, latency)
+	if err != errMirrorAborted {
+		t.logger.Debug().Msg(fmt.Sprintf(config.MIRRORED, t.fullmethod, t.host, status.Code(err), latency))
+	}
+}
+
+func (t *mirrortee) forward(ctx context.Context) error {
+	p, err := t.ms.getpool(t.host, t.logger)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	conn, err := p.Get()
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer conn.Close()
+	stream, err := grpc.NewClientStream(ctx, mirrorStreamDesc, conn.Value(), t.fullmethod)
+	if err != nil {
+		return err
+	}
+	//the messages left in the buffer are dropped with the tee, the Send never blocks
+loop:
+	for {
+		select {
+		case msg, ok := <-t.msgs:
+			if !ok {
+				break loop
+			}
+			if err := stream.SendMsg(msg); err != nil {
+				if err == io.EOF {
+					//the status of the stream is read by RecvMsg
+					break loop
+				}
+				return err
+			}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if t.aborted.Load() {
+		return errMirrorAborted
+	}
+	stream.CloseSend()
+	reply := &emptypb.Empty{}
+	for {
+		if err := stream.RecvMsg(reply); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"octopus/metadata"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	gmd "google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+/*
+the shadow host of the test, it accepts any method and records the messages,
+the requests wait for the hold before reading the messages if it is set
+*/
+type shadowserver struct {
+	addr  string
+	hold  chan struct{}
+	mu    sync.Mutex
+	calls map[string][]string
+	users []string
+}
+
+func newshadowserver(t *testing.T, hold chan struct{}) *shadowserver {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &shadowserver{addr: l.Addr().String(), hold: hold, calls: make(map[string][]string)}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(srv any, stream grpc.ServerStream) error {
+		if s.hold != nil {
+			select {
+			case <-s.hold:
+			case <-stream.Context().Done():
+				return stream.Context().Err()
+			}
+		}
+		method, _ := grpc.MethodFromServerStream(stream)
+		md, _ := gmd.FromIncomingContext(stream.Context())
+		for {
+			msg := &wrapperspb.StringValue{}
+			if err := stream.RecvMsg(msg); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.calls[method] = append(s.calls[method], msg.Value)
+			s.mu.Unlock()
+		}
+		s.mu.Lock()
+		s.users = append(s.users, md.Get("x-user")...)
+		s.mu.Unlock()
+		return stream.SendMsg(&wrapperspb.StringValue{Value: "shadow"})
+	}))
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return s
+}
+
+func mirrordata(service, method string) *metadata.MetaData {
+	logger := zerolog.Nop()
+	return &metadata.MetaData{
+		Descriptor: &metadata.Descriptor{URI: &metadata.URI{ServiceName: service, Method: method}},
+		Logger:     &logger,
+	}
+}
+
+// the request through the mirror, the tee is returned
+func mirrored(ms *MirrorService, data *metadata.MetaData) metadata.Tee {
+	ms.BuildWare()(func(ctx context.Context, data *metadata.MetaData) error {
+		return nil
+	})(context.Background(), data)
+	return data.Tee
+}
+
+// wait until the stats of the route are finished
+func mirrorstats(t *testing.T, ms *MirrorService, done func(stats MirrorStats) bool) MirrorStats {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		if stats := ms.Stats(); len(stats) == 1 && done(stats[0]) {
+			return stats[0]
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("the mirror is not finished, the stats are %+v", ms.Stats())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+/*
+the messages and the metadata of the request are copied to the shadow host and the outcome is recorded
+*/
+func TestMirrorShadow(t *testing.T) {
+	shadow := newshadowserver(t, nil)
+	ms := NewMirror(WithMirror("/proto.Greeter/*", 100, shadow.addr))
+	defer ms.Stop()
+	if tee := mirrored(ms, mirrordata("proto.Other", "Get")); tee != nil {
+		t.Fatal("the route without the mirror is mirrored")
+	}
+	tee := mirrored(ms, mirrordata("proto.Greeter", "Chat"))
+	if tee == nil {
+		t.Fatal("the route is not mirrored")
+	}
+	ctx := gmd.NewOutgoingContext(context.Background(), gmd.Pairs("x-user", "a"))
+	msg := &wrapperspb.StringValue{Value: "hello"}
+	tee.Send(ctx, msg)
+	//the message is copied, the change after Send is not mirrored
+	msg.Value = "changed"
+	tee.Send(ctx, &wrapperspb.StringValue{Value: "bye"})
+	tee.Close(io.EOF)
+
+	stats := mirrorstats(t, ms, func(stats MirrorStats) bool { return stats.Requests == 1 })
+	if stats.Route != "/proto.greeter/*" || stats.Codes["OK"] != 1 || stats.Dropped != 0 || stats.Latency <= 0 || stats.MaxLatency < stats.Latency {
+		t.Fatalf("the stats are %+v", stats)
+	}
+	shadow.mu.Lock()
+	defer shadow.mu.Unlock()
+	if calls := shadow.calls["/proto.Greeter/Chat"]; strings.Join(calls, ",") != "hello,bye" || strings.Join(shadow.users, ",") != "a" {
+		t.Fatalf("the shadow is called with %v by %v", shadow.calls, shadow.users)
+	}
+}
+
+func TestMirrorPercent(t *testing.T) {
+	ms := NewMirror(WithMirror("*", 30, "127.0.0.1:9000"), WithMirror("/proto.Greeter/SayHi", 0, "127.0.0.1:9000"))
+	defer ms.Stop()
+	n := 0
+	for i := 0; i < 2000; i++ {
+		if mirrored(ms, mirrordata("proto.Greeter", "SayHello")) != nil {
+			n++
+		}
+		if mirrored(ms, mirrordata("proto.Greeter", "SayHi")) != nil {
+			t.Fatal("the route of 0 percent is mirrored")
+		}
+	}
+	if n < 450 || n > 750 {
+		t.Fatalf("%v of 2000 requests are mirrored by 30 percent", n)
+	}
+}
+
+/*
+the slow shadow does not block the Send, the request is dropped when the buffer is full
+*/
+func TestMirrorSlowShadow(t *testing.T) {
+	hold := make(chan struct{})
+	defer close(hold)
+	shadow := newshadowserver(t, hold)
+	ms := NewMirror(WithMirror("*", 100, shadow.addr), WithMirrorTimeout(200*time.Millisecond))
+	defer ms.Stop()
+	tee := mirrored(ms, mirrordata("proto.Greeter", "Chat"))
+	//the large messages are blocked by the flow control of the shadow which does not read
+	msg := &wrapperspb.StringValue{Value: strings.Repeat("x", 256<<10)}
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		tee.Send(context.Background(), msg)
+	}
+	tee.Close(io.EOF)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the Send is blocked for %v by the slow shadow", elapsed)
+	}
+	stats := mirrorstats(t, ms, func(stats MirrorStats) bool { return stats.Dropped == 1 })
+	if stats.Requests != 0 {
+		t.Fatalf("the dropped shadow is recorded as %+v", stats)
+	}
+}
+
+/*
+the request over the max inflight is not mirrored
+*/
+func TestMirrorMaxInflight(t *testing.T) {
+	hold := make(chan struct{})
+	shadow := newshadowserver(t, hold)
+	ms := NewMirror(WithMirror("*", 100, shadow.addr), WithMirrorMaxInflight(1))
+	defer ms.Stop()
+	first := mirrored(ms, mirrordata("proto.Greeter", "SayHello"))
+	first.Send(context.Background(), &wrapperspb.StringValue{Value: "first"})
+	first.Close(nil)
+	second := mirrored(ms, mirrordata("proto.Greeter", "SayHello"))
+	second.Send(context.Background(), &wrapperspb.StringValue{Value: "second"})
+	second.Close(nil)
+	if stats := mirrorstats(t, ms, func(stats MirrorStats) bool { return stats.Dropped == 1 }); stats.Requests != 0 {
+		t.Fatalf("the stats are %+v", stats)
+	}
+	close(hold)
+	mirrorstats(t, ms, func(stats MirrorStats) bool { return stats.Requests == 1 && stats.Codes["OK"] == 1 })
+	if ms.inflight.Load() != 0 {
+		t.Fatalf("the inflight is %v after the shadow", ms.inflight.Load())
+	}
+	shadow.mu.Lock()
+	defer shadow.mu.Unlock()
+	if calls := shadow.calls["/proto.Greeter/SayHello"]; strings.Join(calls, ",") != "first" {
+		t.Fatalf("the shadow is called with %v", calls)
+	}
+}
@@ -0,0 +1,360 @@
+package service
+
+import (
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/service/regcenter"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+this option is used to set the consecutive failures (such as Unavailable, Internal, DeadlineExceeded)
+and the consecutive Unavailable (the gateway failures) to eject the host, 0 is disabled
+*/
+func WithConsecutiveErrors(errors, unavailable int) metadata.OptionBuilder[OutlierDetector] {
+	return func(od *OutlierDetector) {
+		od.consecutiveErrors = errors
+		od.consecutiveUnavailable = unavailable
+	}
+}
+
+/*
+this option is used to eject the host whose average latency of the interval is factor times more than the median of the hosts,
+only the hosts which have minrequests in the interval are counted and at least minhosts of them are needed
+*/
+func WithLatencyOutlier(factor float64, minrequests, minhosts int) metadata.OptionBuilder[OutlierDetector] {
+	return func(od *OutlierDetector) {
+		od.latencyFactor = factor
+		od.minRequests = minrequests
+		od.minHosts = minhosts
+	}
+}
+
+/*
+this option is used to set the interval of the latency analysis and the returning of the ejected hosts
+*/
+func WithOutlierInterval(interval time.Duration) metadata.OptionBuilder[OutlierDetector] {
+	return func(od *OutlierDetector) {
+		od.interval = interval
+	}
+}
+
+/*
+this option is used to set the ejection time, it is base times the ejections of the host and is limited by the max
+*/
+func WithEjectionTime(base, max time.Duration) metadata.OptionBuilder[OutlierDetector] {
+	return func(od *OutlierDetector) {
+		od.baseEjection = base
+		od.maxEjection = max
+	}
+}
+
+/*
+this option is used to set the max percent of the ejected hosts
+*/
+func WithMaxEjectionPercent(percent int) metadata.OptionBuilder[OutlierDetector] {
+	return func(od *OutlierDetector) {
+		od.maxEjectionPercent = percent
+	}
+}
+
+/*
+this option is used to ramp the returned host by the weight of step every duration (balance.Restore and balance.SetWegiht),
+it only works with the balance.WeightRobin
+*/
+func WithSlowStart(step int, every time.Duration) metadata.OptionBuilder[OutlierDetector] {
+	return func(od *OutlierDetector) {
+		od.step = step
+		od.every = every
+	}
+}
+
+type outlierhost struct {
+	errors      int
+	unavailable int
+	//the requests and the latency of the interval
+	requests  int
+	latency   time.Duration
+	ejected   bool
+	ejections int
+	until     time.Time
+}
+
+/*
+the passive outlier detector records the outcomes of the requests to the hosts,
+the host which crosses the threshold is ejected from the balance for the back-off time
+*/
+type OutlierDetector struct {
+	consecutiveErrors      int
+	consecutiveUnavailable int
+	latencyFactor          float64
+	minRequests            int
+	minHosts               int
+	interval               time.Duration
+	baseEjection           time.Duration
+	maxEjection            time.Duration
+	maxEjectionPercent     int
+	step                   int
+	every                  time.Duration
+	mu                     sync.Mutex
+	hosts                  map[string]*outlierhost
+	//the remaining ramp steps of the returned hosts
+	ramping map[string]int
+	router  func() *regcenter.Router
+	change  func(host string, ejected bool)
+	ramp    func(host string, step int)
+	logger  *zerolog.Logger
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func NewOutlierDetector(builders ...metadata.OptionBuilder[OutlierDetector]) *OutlierDetector {
+	od := &OutlierDetector{
+		consecutiveErrors:      5,
+		consecutiveUnavailable: 3,
+		minRequests:            10,
+		minHosts:               3,
+		interval:               10 * time.Second,
+		baseEjection:           30 * time.Second,
+		maxEjection:            5 * time.Minute,
+		maxEjectionPercent:     50,
+		every:                  time.Second,
+		hosts:                  make(map[string]*outlierhost),
+		ramping:                make(map[string]int),
+		stop:                   make(chan struct{}),
+	}
+	metadata.LoadOption(od, builders...)
+	return od
+}
+
+/*
+the failures of the host, the errors of the request itself (such as InvalidArgument, NotFound, Canceled) are not counted
+*/
+func hostfailure(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+func (od *OutlierDetector) start(router func() *regcenter.Router, change func(host string, ejected bool), ramp func(host string, step int), logger *zerolog.Logger) {
+	od.mu.Lock()
+	od.router, od.change, od.ramp, od.logger = router, change, ramp, logger
+	od.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(od.interval)
+		defer ticker.Stop()
+		var rampticker <-chan time.Time
+		if od.step > 0 {
+			t := time.NewTicker(od.every)
+			defer t.Stop()
+			rampticker = t.C
+		}
+		for {
+			select {
+			case <-ticker.C:
+				od.analyze()
+			case <-rampticker:
+				od.slowstart()
+			case <-od.stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+record the outcome of the request to the host, the latency of the streaming request is 0 and it is not counted
+*/
+func (od *OutlierDetector) record(host string, err error, latency time.Duration) {
+	code := status.Code(err)
+	failure := hostfailure(code)
+	od.mu.Lock()
+	if od.router == nil {
+		od.mu.Unlock()
+		return
+	}
+	h, ok := od.hosts[host]
+	if !ok {
+		h = &outlierhost{}
+		od.hosts[host] = h
+	}
+	if h.ejected {
+		od.mu.Unlock()
+		return
+	}
+	if failure {
+		h.errors++
+		if code == codes.Unavailable {
+			h.unavailable++
+		} else {
+			h.unavailable = 0
+		}
+	} else {
+		h.errors, h.unavailable = 0, 0
+		if latency > 0 {
+			h.requests++
+			h.latency += latency
+		}
+	}
+	var reason string
+	if od.consecutiveErrors > 0 && h.errors >= od.consecutiveErrors {
+		reason = fmt.Sprintf("%v consecutive errors", h.errors)
+	} else if od.consecutiveUnavailable > 0 && h.unavailable >= od.consecutiveUnavailable {
+		reason = fmt.Sprintf("%v consecutive unavailable", h.unavailable)
+	}
+	ejected := len(reason) > 0 && od.eject(host, h, od.router(), reason)
+	od.mu.Unlock()
+	if ejected {
+		od.change(host, true)
+	}
+}
+
+/*
+eject the host if the ejected hosts are under the max percent, at least one host can be ejected
+*/
+func (od *OutlierDetector) eject(host string, h *outlierhost, router *regcenter.Router, reason string) bool {
+	total, ejected := 0, 0
+	hosts := router.AllHosts()
+	for k, v := range hosts {
+		if v.Status {
+			total++
+			if h, ok := od.hosts[k]; ok && h.ejected {
+				ejected++
+			}
+		}
+	}
+	if _, ok := hosts[host]; !ok || (ejected+1)*100 > max(total*od.maxEjectionPercent, 100) {
+		return false
+	}
+	h.ejected = true
+	h.ejections++
+	h.errors, h.unavailable, h.requests, h.latency = 0, 0, 0, 0
+	duration := min(od.baseEjection*time.Duration(h.ejections), od.maxEjection)
+	h.until = time.Now().Add(duration)
+	delete(od.ramping, host)
+	od.logger.Warn().Msg(fmt.Sprintf(config.HOSTEJECTED, host, duration, reason))
+	return true
+}
+
+/*
+return the hosts whose ejection time is over and eject the latency outliers of the interval
+*/
+func (od *OutlierDetector) analyze() {
+	router := od.router()
+	hosts := router.AllHosts()
+	now := time.Now()
+	changes := make(map[string]bool)
+	od.mu.Lock()
+	for host, h := range od.hosts {
+		if _, ok := hosts[host]; !ok {
+			delete(od.hosts, host)
+			delete(od.ramping, host)
+			continue
+		}
+		if h.ejected {
+			if now.After(h.until) {
+				h.ejected = false
+				changes[host] = false
+				if od.step > 0 {
+					od.ramping[host] = (hosts[host].Weight + od.step - 1) / od.step
+				}
+				od.logger.Info().Msg(fmt.Sprintf(config.HOSTRETURNED, host))
+			}
+		} else if h.ejections > 0 && h.errors == 0 {
+			//the multiplier of the ejection time is decreased when the host is fine in the interval
+			h.ejections--
+		}
+	}
+
+	if od.latencyFactor > 0 {
+		averages := make(map[string]time.Duration)
+		for host, h := range od.hosts {
+			if !h.ejected && h.requests >= od.minRequests && h.requests > 0 {
+				averages[host] = h.latency / time.Duration(h.requests)
+			}
+		}
+		if len(averages) >= od.minHosts && len(averages) > 0 {
+			values := make([]time.Duration, 0, len(averages))
+			for _, v := range averages {
+				values = append(values, v)
+			}
+			sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+			median := values[len(values)/2]
+			for host, v := range averages {
+				if float64(v) > od.latencyFactor*float64(median) {
+					if od.eject(host, od.hosts[host], router, fmt.Sprintf("the latency %v is over the median %v", v, median)) {
+						changes[host] = true
+					}
+				}
+			}
+		}
+	}
+	for _, h := range od.hosts {
+		h.requests, h.latency = 0, 0
+	}
+	od.mu.Unlock()
+	for host, ejected := range changes {
+		od.change(host, ejected)
+	}
+}
+
+/*
+add the step to the weight of the returned hosts until the weight is full
+*/
+func (od *OutlierDetector) slowstart() {
+	od.mu.Lock()
+	ramps := make([]string, 0, len(od.ramping))
+	for host, n := range od.ramping {
+		ramps = append(ramps, host)
+		if n <= 1 {
+			delete(od.ramping, host)
+		} else {
+			od.ramping[host] = n - 1
+		}
+	}
+	od.mu.Unlock()
+	for _, host := range ramps {
+		od.ramp(host, od.step)
+	}
+}
+
+/*
+the host is ejected from the balance
+*/
+func (od *OutlierDetector) Ejected(host string) bool {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	h, ok := od.hosts[host]
+	return ok && h.ejected
+}
+
+/*
+the ejected hosts
+*/
+func (od *OutlierDetector) EjectedHosts() []string {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	hosts := make([]string, 0)
+	for host, h := range od.hosts {
+		if h.ejected {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (od *OutlierDetector) Stop() {
+	od.once.Do(func() {
+		close(od.stop)
+	})
+}
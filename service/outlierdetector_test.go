@@ -0,0 +1,193 @@
+package service
+
+import (
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/service/regcenter"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func outlierrouter(n, weight int) *regcenter.Router {
+	hosts := make(map[string]*regcenter.HostInfo)
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("127.0.0.1:%v", 9000+i)
+		hosts[addr] = &regcenter.HostInfo{Host: addr, Weight: weight, Status: true}
+	}
+	return &regcenter.Router{Hosts: hosts}
+}
+
+// the detector driven by the test, the changes and the ramps are recorded instead of the balance
+type outlierchanges struct {
+	mu      sync.Mutex
+	changes map[string][]bool
+	ramps   map[string]int
+}
+
+func newoutlier(router *regcenter.Router, builders ...metadata.OptionBuilder[OutlierDetector]) (*OutlierDetector, *outlierchanges) {
+	logger := zerolog.Nop()
+	od := NewOutlierDetector(builders...)
+	c := &outlierchanges{changes: make(map[string][]bool), ramps: make(map[string]int)}
+	od.router = func() *regcenter.Router { return router }
+	od.change = func(host string, ejected bool) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.changes[host] = append(c.changes[host], ejected)
+	}
+	od.ramp = func(host string, step int) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ramps[host] += step
+	}
+	od.logger = &logger
+	return od, c
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	od, c := newoutlier(outlierrouter(4, 1), WithConsecutiveErrors(3, 2))
+	internal := status.Error(codes.Internal, "panic")
+	//the success resets the consecutive errors and the errors of the request are not counted
+	for _, err := range []error{internal, internal, nil, internal, internal, status.Error(codes.NotFound, "no user")} {
+		od.record("127.0.0.1:9000", err, time.Millisecond)
+	}
+	if od.Ejected("127.0.0.1:9000") {
+		t.Fatal("the host is ejected without the consecutive errors")
+	}
+	od.record("127.0.0.1:9000", internal, time.Millisecond)
+	od.record("127.0.0.1:9000", internal, time.Millisecond)
+	od.record("127.0.0.1:9000", internal, time.Millisecond)
+	if !od.Ejected("127.0.0.1:9000") {
+		t.Fatal("the host is not ejected by the consecutive errors")
+	}
+
+	od.record("127.0.0.1:9001", status.Error(codes.Unavailable, "connection refused"), 0)
+	od.record("127.0.0.1:9001", status.Error(codes.Unavailable, "connection refused"), 0)
+	if !od.Ejected("127.0.0.1:9001") {
+		t.Fatal("the host is not ejected by the consecutive unavailable")
+	}
+	//the host not in the router is never ejected
+	for i := 0; i < 3; i++ {
+		od.record("127.0.0.1:8000", internal, 0)
+	}
+	if hosts := od.EjectedHosts(); len(hosts) != 2 {
+		t.Fatalf("the ejected hosts are %v", hosts)
+	}
+	if len(c.changes) != 2 || len(c.changes["127.0.0.1:9000"]) != 1 || !c.changes["127.0.0.1:9000"][0] {
+		t.Fatalf("the changes are %v", c.changes)
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	od, _ := newoutlier(outlierrouter(4, 1), WithConsecutiveErrors(1, 0), WithMaxEjectionPercent(50))
+	for i := 0; i < 4; i++ {
+		od.record(fmt.Sprintf("127.0.0.1:%v", 9000+i), status.Error(codes.Internal, "panic"), 0)
+	}
+	if hosts := od.EjectedHosts(); len(hosts) != 2 {
+		t.Fatalf("the ejected hosts over the max percent are %v", hosts)
+	}
+	//at least one host can be ejected
+	od, _ = newoutlier(outlierrouter(1, 1), WithConsecutiveErrors(1, 0), WithMaxEjectionPercent(10))
+	od.record("127.0.0.1:9000", status.Error(codes.Internal, "panic"), 0)
+	if !od.Ejected("127.0.0.1:9000") {
+		t.Fatal("the only host is not ejected")
+	}
+}
+
+/*
+the host is returned after the ejection time, the ejection time of the host ejected again is multiplied
+*/
+func TestOutlierReturn(t *testing.T) {
+	od, c := newoutlier(outlierrouter(2, 1), WithConsecutiveErrors(1, 0), WithEjectionTime(time.Minute, 3*time.Minute))
+	host := "127.0.0.1:9000"
+	od.record(host, status.Error(codes.Internal, "panic"), 0)
+	od.analyze()
+	if !od.Ejected(host) {
+		t.Fatal("the host is returned before the ejection time")
+	}
+	od.hosts[host].until = time.Now().Add(-time.Millisecond)
+	od.analyze()
+	if od.Ejected(host) || len(c.changes[host]) != 2 || c.changes[host][1] {
+		t.Fatalf("the host is not returned, the changes are %v", c.changes[host])
+	}
+	od.record(host, status.Error(codes.Internal, "panic"), 0)
+	if until := time.Until(od.hosts[host].until); until < time.Minute+50*time.Second {
+		t.Fatalf("the second ejection is %v", until)
+	}
+	od.hosts[host].until = time.Now().Add(-time.Millisecond)
+	od.analyze()
+	//the multiplier is decreased by the intervals without the errors
+	od.analyze()
+	od.analyze()
+	od.record(host, status.Error(codes.Internal, "panic"), 0)
+	if until := time.Until(od.hosts[host].until); until > time.Minute+10*time.Second {
+		t.Fatalf("the ejection after the fine interval is %v", until)
+	}
+}
+
+/*
+the returned host is ramped by the step until the weight is full
+*/
+func TestOutlierSlowStart(t *testing.T) {
+	od, c := newoutlier(outlierrouter(2, 5), WithConsecutiveErrors(1, 0), WithSlowStart(2, time.Second))
+	host := "127.0.0.1:9000"
+	od.record(host, status.Error(codes.Internal, "panic"), 0)
+	od.hosts[host].until = time.Now().Add(-time.Millisecond)
+	od.analyze()
+	//the ramp of the weight 5 by the step 2 takes 3 steps
+	for i := 0; i < 4; i++ {
+		od.slowstart()
+	}
+	if c.ramps[host] != 6 || len(c.ramps) != 1 {
+		t.Fatalf("the ramps are %v", c.ramps)
+	}
+}
+
+/*
+the ejected host is not picked by the balance, the returned host is picked by the weight of the slow start step
+*/
+func TestRouterServiceOutlier(t *testing.T) {
+	logger := zerolog.Nop()
+	router := outlierrouter(2, 4)
+	router.Descriptors = testrouter().Descriptors
+	od := NewOutlierDetector(WithConsecutiveErrors(1, 0), WithSlowStart(1, time.Hour))
+	rs := NewRouterService(&logger, config.Grpc, WithBalance(config.WeightRobin), WithRegCenter(&testcenter{router: router}), WithOutlierDetection(od))
+	defer rs.Stop()
+	picked := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			addr, done := rs.balance.Next(nil)
+			done(nil)
+			counts[addr]++
+		}
+		return counts
+	}
+	host := "127.0.0.1:9000"
+	rs.Record(host, status.Error(codes.Internal, "panic"), 0)
+	if counts := picked(10); counts[host] != 0 {
+		t.Fatalf("the ejected host is picked %v times", counts[host])
+	}
+	//the host is not added back by the router update while it is ejected
+	rs.Update(router, nil)
+	if counts := picked(10); counts[host] != 0 {
+		t.Fatalf("the ejected host is picked %v times after the update", counts[host])
+	}
+	od.mu.Lock()
+	od.hosts[host].until = time.Now().Add(-time.Millisecond)
+	od.mu.Unlock()
+	od.analyze()
+	if counts := picked(10); counts[host] < 1 || counts[host] > 3 {
+		t.Fatalf("the returned host with the weight 1 of 5 is picked %v times", counts[host])
+	}
+	od.slowstart()
+	od.slowstart()
+	od.slowstart()
+	if counts := picked(8); counts[host] < 3 || counts[host] > 5 {
+		t.Fatalf("the ramped host is picked %v times", counts[host])
+	}
+}
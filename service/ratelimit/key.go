@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"octopus/metadata"
+	"strings"
+)
+
+/*
+the part of the key of the request, the parts are composed into the key so the limit is counted by them,
+such as the route and the client ip
+*/
+type Key func(data *metadata.MetaData) string
+
+/*
+the full method of the request
+*/
+func RouteKey() Key {
+	return func(data *metadata.MetaData) string {
+		return "route=" + strings.ToLower(data.Descriptor.GetFullMethod())
+	}
+}
+
+/*
+the ip of the client
+*/
+func ClientIPKey() Key {
+	return func(data *metadata.MetaData) string {
+		return "ip=" + data.ClientIP()
+	}
+}
+
+/*
+the api key of the client in the header (the grpc metadata), or the url param of the http request
+*/
+func APIKey(name string) Key {
+	return func(data *metadata.MetaData) string {
+		value, ok := data.HeaderValue(name)
+		if !ok && data.HttpMeta != nil && data.Request != nil {
+			value = data.Request.URL.Query().Get(name)
+		}
+		return "apikey=" + value
+	}
+}
+
+/*
+the header of the http request or the metadata of the grpc request
+*/
+func HeaderKey(name string) Key {
+	return func(data *metadata.MetaData) string {
+		value, _ := data.HeaderValue(name)
+		return strings.ToLower(name) + "=" + value
+	}
+}
+
+/*
+compose the parts into the key, the missing part is empty so the requests without it share the limit
+*/
+func Compose(data *metadata.MetaData, keys ...Key) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key(data)
+	}
+	return strings.Join(parts, "|")
+}
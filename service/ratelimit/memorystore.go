@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// the expired counters are removed every sweep requests
+const memorysweep = 4096
+
+type memorycounter struct {
+	window     int64
+	curr, prev float64
+	tat        float64
+	//the microseconds when the counter is expired
+	expire float64
+}
+
+/*
+the store in the process memory, the limits are not shared by the gateways
+*/
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*memorycounter
+	requests int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		counters: make(map[string]*memorycounter),
+	}
+}
+
+func (s *MemoryStore) Allow(ctx context.Context, key string, limit Limit, n int) (Result, error) {
+	return s.take(key, limit, n, true)
+}
+
+func (s *MemoryStore) Peek(ctx context.Context, key string, limit Limit, n int) (Result, error) {
+	return s.take(key, limit, n, false)
+}
+
+// the counter is changed only if the requests are taken
+func (s *MemoryStore) take(key string, limit Limit, n int, taken bool) (Result, error) {
+	if err := limit.validate(); err != nil {
+		return Result{}, err
+	}
+	now := float64(time.Now().UnixMicro())
+	key = string(limit.Algorithm) + ":" + key
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requests++; s.requests >= memorysweep {
+		s.requests = 0
+		for k, v := range s.counters {
+			if v.expire < now {
+				delete(s.counters, k)
+			}
+		}
+	}
+	var c memorycounter
+	if counter, ok := s.counters[key]; ok {
+		c = *counter
+	}
+	var result Result
+	switch limit.Algorithm {
+	case SlidingWindow:
+		c.window, c.curr, c.prev, result = slidingwindow(c.window, c.curr, c.prev, now, limit, n)
+		c.expire = float64(c.window+2) * float64(limit.Period/time.Microsecond)
+	case GCRA:
+		c.tat, result = gcra(c.tat, now, limit, n)
+		c.expire = c.tat
+	}
+	if taken {
+		s.counters[key] = &c
+	}
+	return result, nil
+}
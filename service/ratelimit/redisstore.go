@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+the scripts return {allowed, remaining, retry after, reset after} in the microseconds, the state is not changed
+if the take is 0, the time of the redis is used so the gateways share the same clock
+*/
+var slidingwindowscript = redis.NewScript(`
+redis.replicate_commands()
+local rate, period, n, take = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local current = math.floor(now / period)
+local state = redis.call('HMGET', KEYS[1], 'window', 'curr', 'prev')
+local window = tonumber(state[1])
+local curr, prev = 0, 0
+if window == current then
+	curr, prev = tonumber(state[2]), tonumber(state[3])
+elseif window == current - 1 then
+	prev = tonumber(state[2])
+end
+local elapsed = now - current * period
+local count = prev * (period - elapsed) / period + curr
+local reset = math.ceil(period - elapsed)
+if count + n > rate then
+	local retry = reset
+	local free = rate - curr - n
+	if free >= 0 and prev > 0 then
+		retry = math.ceil(period - free * period / prev - elapsed)
+	end
+	return {0, math.max(math.floor(rate - count), 0), retry, reset}
+end
+if take == 1 then
+	redis.call('HSET', KEYS[1], 'window', current, 'curr', curr + n, 'prev', prev)
+	redis.call('PEXPIRE', KEYS[1], math.ceil(period * 2 / 1000))
+end
+return {1, math.floor(rate - count - n), 0, reset}
+`)
+
+var gcrascript = redis.NewScript(`
+redis.replicate_commands()
+local rate, period, burst, n, take = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4]), tonumber(ARGV[5])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = period / rate
+local tolerance = burst * interval
+local tat = math.max(tonumber(redis.call('GET', KEYS[1]) or now), now)
+local nexttat = tat + n * interval
+local allowat = nexttat - tolerance
+if now < allowat then
+	return {0, math.max(math.floor((now - tat + tolerance) / interval + 1e-6), 0), math.ceil(allowat - now), math.ceil(tat - now)}
+end
+if take == 1 then
+	-- the fraction of the interval is kept, so the tat is the same as the memory store
+	redis.call('SET', KEYS[1], string.format('%.17g', nexttat), 'PX', math.ceil((nexttat - now) / 1000) + 1)
+end
+return {1, math.floor((now - nexttat + tolerance) / interval + 1e-6), 0, math.ceil(nexttat - now)}
+`)
+
+/*
+the store in the redis, the limits are taken by the lua scripts atomically and shared by the gateways,
+the client is the redis.Client, the redis.ClusterClient or the redis.Ring
+*/
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+/*
+the keys of the counters start with the prefix, such as "octopus:ratelimit:"
+*/
+func NewRedisStore(client redis.UniversalClient, prefix string) *RedisStore {
+	return &RedisStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (s *RedisStore) Allow(ctx context.Context, key string, limit Limit, n int) (Result, error) {
+	return s.take(ctx, key, limit, n, 1)
+}
+
+func (s *RedisStore) Peek(ctx context.Context, key string, limit Limit, n int) (Result, error) {
+	return s.take(ctx, key, limit, n, 0)
+}
+
+func (s *RedisStore) take(ctx context.Context, key string, limit Limit, n int, take int) (Result, error) {
+	if err := limit.validate(); err != nil {
+		return Result{}, err
+	}
+	keys := []string{s.prefix + string(limit.Algorithm) + ":" + key}
+	period := int64(limit.Period / time.Microsecond)
+	var cmd *redis.Cmd
+	switch limit.Algorithm {
+	case SlidingWindow:
+		cmd = slidingwindowscript.Run(ctx, s.client, keys, limit.Rate, period, n, take)
+	case GCRA:
+		cmd = gcrascript.Run(ctx, s.client, keys, limit.Rate, period, limit.burst(), n, take)
+	}
+	values, err := cmd.Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		ResetAfter: time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
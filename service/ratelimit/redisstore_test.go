@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+the lua scripts run in the miniredis at the same times as the algorithms in go, the results must be the same,
+the peek before the take does not change the state
+*/
+func TestRedisStoreScripts(t *testing.T) {
+	for _, limit := range []Limit{
+		{Algorithm: SlidingWindow, Rate: 5, Period: time.Second},
+		{Algorithm: SlidingWindow, Rate: 7, Period: 300 * time.Millisecond},
+		{Algorithm: GCRA, Rate: 3, Period: time.Second, Burst: 2},
+		{Algorithm: GCRA, Rate: 10, Period: 100 * time.Millisecond},
+	} {
+		t.Run(limit.String(), func(t *testing.T) {
+			m := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+			defer client.Close()
+			store := NewRedisStore(client, "octopus:ratelimit:")
+
+			var (
+				window     int64
+				curr, prev float64
+				tat        float64
+			)
+			random := rand.New(rand.NewSource(1))
+			now := time.Unix(1700000000, 123456000)
+			for i := 0; i < 300; i++ {
+				now = now.Add(time.Duration(random.Int63n(int64(limit.Period)/4)) + time.Microsecond)
+				n := 1 + random.Intn(2)
+				m.SetTime(now)
+				peeked, err := store.Peek(context.Background(), "greeter", limit, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := store.Allow(context.Background(), "greeter", limit, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var want Result
+				micros := float64(now.UnixMicro())
+				switch limit.Algorithm {
+				case SlidingWindow:
+					window, curr, prev, want = slidingwindow(window, curr, prev, micros, limit, n)
+				case GCRA:
+					tat, want = gcra(tat, micros, limit, n)
+				}
+				if got != want || peeked != want {
+					t.Fatalf("the request %v of %v at %v is %+v (peeked %+v) by the script and %+v by go", i, n, now, got, peeked, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"octopus/metadata"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+/*
+the rule of the limit like the descriptor of the envoy rate limit, the request matched by the ServiceName, the Method,
+the Headers and the ClientIPs is counted in the bucket of the rule, the empty condition matches all the requests.
+the bucket is split by the descriptors of By: route, ip, apikey:<name> and header:<name>,
+such as {"Name":"hello","ServiceName":"proto.Greeter","Method":"SayHello","By":["apikey:x-api-key"],"Rate":10,"Period":"1s"}
+*/
+type Rule struct {
+	Name        string
+	ServiceName string
+	Method      string
+	Headers     []HeaderMatch
+	//the ips or the cidrs of the client, such as 10.0.0.1 and 10.0.0.0/8
+	ClientIPs []string
+	By        []string
+	//the algorithm is SlidingWindow if it is empty, the period is such as 1s and 1m
+	Algorithm Algorithm
+	Rate      int
+	Period    string
+	Burst     int
+}
+
+/*
+the header (the grpc metadata) is matched if it is present when the Value is empty
+*/
+type HeaderMatch struct {
+	Name  string
+	Value string
+}
+
+/*
+the rules of the config file, such as {"Rules":[...]}
+*/
+type RuleConfig struct {
+	Rules []Rule
+}
+
+/*
+read the rules from the config file, the format is json, yaml or toml by the extension
+*/
+func LoadRules(path string) ([]Rule, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var cfg RuleConfig
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	return cfg.Rules, nil
+}
+
+/*
+the compiled rule, the requests matched by it are counted in its own bucket
+*/
+type Policy struct {
+	Name        string
+	Limit       Limit
+	keys        []Key
+	serviceName string
+	method      string
+	headers     []HeaderMatch
+	nets        []*net.IPNet
+}
+
+/*
+the policy of all the requests, it is the limit of the rate limit service without the rules
+*/
+func NewPolicy(name string, limit Limit, keys ...Key) *Policy {
+	return &Policy{
+		Name:  name,
+		Limit: limit,
+		keys:  keys,
+	}
+}
+
+/*
+compile the rules into the policies, the names of the rules must be unique so the buckets are not shared
+*/
+func Compile(rules []Rule) ([]*Policy, error) {
+	policies := make([]*Policy, 0, len(rules))
+	names := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		if _, ok := names[rule.Name]; ok {
+			return nil, fmt.Errorf("the rule %q of the rate limit is duplicated", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+		policy, err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("the rule %q of the rate limit is wrong : %w", rule.Name, err)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (r Rule) compile() (*Policy, error) {
+	if r.Name == "" {
+		return nil, errors.New("the name of the rule is empty")
+	}
+	period, err := time.ParseDuration(r.Period)
+	if err != nil {
+		return nil, err
+	}
+	limit := Limit{Algorithm: r.Algorithm, Rate: r.Rate, Period: period, Burst: r.Burst}
+	if limit.Algorithm == "" {
+		limit.Algorithm = SlidingWindow
+	}
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+	policy := NewPolicy(r.Name, limit)
+	policy.serviceName, policy.method = r.ServiceName, r.Method
+	for _, header := range r.Headers {
+		if header.Name == "" {
+			return nil, errors.New("the name of the header is empty")
+		}
+		policy.headers = append(policy.headers, header)
+	}
+	for _, ip := range r.ClientIPs {
+		ipnet, err := parsenet(ip)
+		if err != nil {
+			return nil, err
+		}
+		policy.nets = append(policy.nets, ipnet)
+	}
+	for _, by := range r.By {
+		key, err := ParseKey(by)
+		if err != nil {
+			return nil, err
+		}
+		policy.keys = append(policy.keys, key)
+	}
+	return policy, nil
+}
+
+// the single ip is the network of its own
+func parsenet(ip string) (*net.IPNet, error) {
+	if !strings.Contains(ip, "/") {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return nil, fmt.Errorf("the client ip %q is wrong", ip)
+		}
+		bits := 8 * len(addr.To16())
+		if addr.To4() != nil {
+			addr, bits = addr.To4(), 32
+		}
+		return &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(ip)
+	return ipnet, err
+}
+
+/*
+the key of the descriptor of the rule: route, ip, apikey:<name> or header:<name>
+*/
+func ParseKey(descriptor string) (Key, error) {
+	kind, name, _ := strings.Cut(descriptor, ":")
+	switch strings.ToLower(kind) {
+	case "route":
+		return RouteKey(), nil
+	case "ip":
+		return ClientIPKey(), nil
+	case "apikey":
+		if name != "" {
+			return APIKey(name), nil
+		}
+	case "header":
+		if name != "" {
+			return HeaderKey(name), nil
+		}
+	}
+	return nil, fmt.Errorf("the descriptor %q of the rule is wrong", descriptor)
+}
+
+/*
+whether the request is matched by all the conditions of the rule
+*/
+func (p *Policy) Match(data *metadata.MetaData) bool {
+	if p.serviceName != "" && !strings.EqualFold(p.serviceName, data.Descriptor.ServiceName) {
+		return false
+	}
+	if p.method != "" && !strings.EqualFold(p.method, data.Descriptor.Method) {
+		return false
+	}
+	for _, header := range p.headers {
+		value, ok := data.HeaderValue(header.Name)
+		if !ok || (header.Value != "" && value != header.Value) {
+			return false
+		}
+	}
+	if len(p.nets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(data.ClientIP())
+	for _, ipnet := range p.nets {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+the key of the bucket in the store, the buckets of the rules are split by the name and the limit
+*/
+func (p *Policy) Key(data *metadata.MetaData) string {
+	key := p.Limit.String() + ":" + Compose(data, p.keys...)
+	if p.Name != "" {
+		key = p.Name + ":" + key
+	}
+	return key
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"net"
+	"net/http/httptest"
+	"octopus/metadata"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ruledata(service, method, ip string, headers map[string]string) *metadata.MetaData {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = net.JoinHostPort(ip, "52000")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return &metadata.MetaData{
+		Descriptor: &metadata.Descriptor{URI: &metadata.URI{ServiceName: service, Method: method}},
+		HttpMeta:   &metadata.HttpMeta{Request: r, Response: httptest.NewRecorder()},
+	}
+}
+
+func TestCompile(t *testing.T) {
+	policies, err := Compile([]Rule{
+		{Name: "hello", ServiceName: "proto.Greeter", Method: "SayHello", By: []string{"apikey:x-api-key"}, Rate: 10, Period: "1s"},
+		{Name: "global", Algorithm: GCRA, Rate: 1000, Period: "1s", Burst: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[0].Limit != (Limit{Algorithm: SlidingWindow, Rate: 10, Period: time.Second}) {
+		t.Fatalf("the policies are %+v", policies)
+	}
+	if policies[1].Limit != (Limit{Algorithm: GCRA, Rate: 1000, Period: time.Second, Burst: 100}) {
+		t.Fatalf("the limit is %+v", policies[1].Limit)
+	}
+
+	for name, rules := range map[string][]Rule{
+		"duplicated":  {{Name: "a", Rate: 1, Period: "1s"}, {Name: "a", Rate: 2, Period: "1s"}},
+		"empty name":  {{Rate: 1, Period: "1s"}},
+		"period":      {{Name: "a", Rate: 1, Period: "1"}},
+		"rate":        {{Name: "a", Rate: 0, Period: "1s"}},
+		"algorithm":   {{Name: "a", Algorithm: "TokenBucket", Rate: 1, Period: "1s"}},
+		"header":      {{Name: "a", Rate: 1, Period: "1s", Headers: []HeaderMatch{{Value: "gold"}}}},
+		"client ip":   {{Name: "a", Rate: 1, Period: "1s", ClientIPs: []string{"10.0.0.256"}}},
+		"cidr":        {{Name: "a", Rate: 1, Period: "1s", ClientIPs: []string{"10.0.0.0/33"}}},
+		"descriptor":  {{Name: "a", Rate: 1, Period: "1s", By: []string{"cookie:session"}}},
+		"header name": {{Name: "a", Rate: 1, Period: "1s", By: []string{"header"}}},
+	} {
+		if _, err := Compile(rules); err == nil {
+			t.Fatalf("the wrong rule of the %v is compiled", name)
+		}
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	policies, err := Compile([]Rule{
+		{Name: "route", ServiceName: "proto.Greeter", Method: "SayHello", Rate: 1, Period: "1s"},
+		{Name: "present", Headers: []HeaderMatch{{Name: "x-api-key"}}, Rate: 1, Period: "1s"},
+		{Name: "value", Headers: []HeaderMatch{{Name: "x-tier", Value: "gold"}}, Rate: 1, Period: "1s"},
+		{Name: "ip", ClientIPs: []string{"10.0.0.0/8", "192.168.1.1", "fd00::1"}, Rate: 1, Period: "1s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		data    *metadata.MetaData
+		matched string
+	}{
+		{ruledata("proto.greeter", "sayhello", "127.0.0.1", nil), "route"},
+		{ruledata("proto.Greeter", "SayHi", "127.0.0.1", nil), ""},
+		{ruledata("proto.Greeter", "SayHi", "127.0.0.1", map[string]string{"X-Api-Key": ""}), "present"},
+		{ruledata("proto.Greeter", "SayHi", "127.0.0.1", map[string]string{"X-Tier": "gold"}), "value"},
+		{ruledata("proto.Greeter", "SayHi", "127.0.0.1", map[string]string{"X-Tier": "silver"}), ""},
+		{ruledata("proto.Greeter", "SayHi", "10.1.2.3", nil), "ip"},
+		{ruledata("proto.Greeter", "SayHi", "192.168.1.1", nil), "ip"},
+		{ruledata("proto.Greeter", "SayHi", "192.168.1.2", nil), ""},
+		{ruledata("proto.Greeter", "SayHi", "fd00::1", nil), "ip"},
+	} {
+		var matched []string
+		for _, policy := range policies {
+			if policy.Match(v.data) {
+				matched = append(matched, policy.Name)
+			}
+		}
+		if strings.Join(matched, ",") != v.matched {
+			t.Fatalf("the request %v/%v of %v is matched by %v", v.data.Descriptor.ServiceName, v.data.Descriptor.Method, v.data.ClientIP(), matched)
+		}
+	}
+}
+
+/*
+the bucket of the rule is split by the descriptors, the rules and the limits do not share the buckets
+*/
+func TestPolicyKey(t *testing.T) {
+	policies, err := Compile([]Rule{
+		{Name: "hello", By: []string{"route", "apikey:x-api-key"}, Rate: 10, Period: "1s"},
+		{Name: "tier", By: []string{"header:X-Tier"}, Rate: 10, Period: "1s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ruledata("proto.Greeter", "SayHello", "127.0.0.1", map[string]string{"X-Api-Key": "a", "X-Tier": "gold"})
+	if key := policies[0].Key(data); key != "hello:SlidingWindow:10/1s:route=/proto.greeter/sayhello|apikey=a" {
+		t.Fatalf("the key is %v", key)
+	}
+	if key := policies[1].Key(data); key != "tier:SlidingWindow:10/1s:x-tier=gold" {
+		t.Fatalf("the key is %v", key)
+	}
+	other := ruledata("proto.Greeter", "SayHello", "127.0.0.1", map[string]string{"X-Api-Key": "b"})
+	if policies[0].Key(data) == policies[0].Key(other) {
+		t.Fatal("the api keys share the bucket")
+	}
+}
@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+type Algorithm string
+
+const (
+	//the sliding window counter, the count of the previous window is weighted by its overlap with the window
+	SlidingWindow Algorithm = "SlidingWindow"
+	//the generic cell rate algorithm, the requests are spaced by the period / rate and the burst is allowed
+	GCRA Algorithm = "GCRA"
+)
+
+/*
+the Rate of the requests in the Period, the Burst of the GCRA is the Rate if it is 0
+*/
+type Limit struct {
+	Algorithm Algorithm
+	Rate      int
+	Period    time.Duration
+	Burst     int
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+func (l Limit) validate() error {
+	if l.Rate <= 0 || l.Period < time.Microsecond {
+		return errors.New("the rate and the period of the limit must be positive")
+	}
+	if l.Algorithm != SlidingWindow && l.Algorithm != GCRA {
+		return fmt.Errorf("the algorithm %q of the limit is not supported", l.Algorithm)
+	}
+	return nil
+}
+
+/*
+such as GCRA:100/1s, it is a part of the key in the store so the limits do not share the counters
+*/
+func (l Limit) String() string {
+	return fmt.Sprintf("%v:%v/%v", l.Algorithm, l.Rate, l.Period)
+}
+
+/*
+the result of the limit, the RetryAfter is the wait of the rejected request and the ResetAfter is the time to the full limit
+(the end of the window of the sliding window)
+*/
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+/*
+the store of the counters, the limit is taken atomically so the store can be shared by the gateways
+*/
+type Store interface {
+	//take n requests from the limit of the key
+	Allow(ctx context.Context, key string, limit Limit, n int) (Result, error)
+	//the result of taking n requests from the limit of the key, the requests are not taken
+	Peek(ctx context.Context, key string, limit Limit, n int) (Result, error)
+}
+
+// the algorithms work in the microseconds, the same as the lua scripts of the redis store
+func microseconds(d float64) time.Duration {
+	return time.Duration(math.Ceil(d)) * time.Microsecond
+}
+
+/*
+the state of the sliding window is the window and the counts of it and the previous one
+*/
+func slidingwindow(window int64, curr, prev, now float64, limit Limit, n int) (int64, float64, float64, Result) {
+	period, rate := float64(limit.Period/time.Microsecond), float64(limit.Rate)
+	current := int64(math.Floor(now / period))
+	switch window {
+	case current:
+	case current - 1:
+		curr, prev = 0, curr
+	default:
+		curr, prev = 0, 0
+	}
+	elapsed := now - float64(current)*period
+	count := prev*(period-elapsed)/period + curr
+	result := Result{ResetAfter: microseconds(period - elapsed)}
+	if count+float64(n) > rate {
+		result.Remaining = max(int(rate-count), 0)
+		result.RetryAfter = result.ResetAfter
+		//the weight of the previous window decreases until the request fits in the window
+		if free := rate - curr - float64(n); free >= 0 && prev > 0 {
+			result.RetryAfter = microseconds(period - free*period/prev - elapsed)
+		}
+		return current, curr, prev, result
+	}
+	result.Allowed = true
+	result.Remaining = int(rate - count - float64(n))
+	return current, curr + float64(n), prev, result
+}
+
+/*
+the state of the gcra is the theoretical arrival time of the next request
+*/
+func gcra(tat, now float64, limit Limit, n int) (float64, Result) {
+	interval := float64(limit.Period/time.Microsecond) / float64(limit.Rate)
+	tolerance := float64(limit.burst()) * interval
+	tat = max(tat, now)
+	next := tat + float64(n)*interval
+	if allowat := next - tolerance; now < allowat {
+		return tat, Result{
+			Remaining:  max(int(math.Floor((now-tat+tolerance)/interval+1e-6)), 0),
+			RetryAfter: microseconds(allowat - now),
+			ResetAfter: microseconds(tat - now),
+		}
+	}
+	return next, Result{
+		Allowed:    true,
+		Remaining:  int(math.Floor((now-next+tolerance)/interval + 1e-6)),
+		ResetAfter: microseconds(next - now),
+	}
+}
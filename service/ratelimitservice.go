@@ -0,0 +1,248 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/service/ratelimit"
+	"octopus/service/ware"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+)
+
+/*
+this option is used to set the parts of the key of the limit, such as ratelimit.RouteKey() and ratelimit.ClientIPKey(),
+the requests share one limit if there is no part
+*/
+func WithRateLimitKey(keys ...ratelimit.Key) metadata.OptionBuilder[RateLimitService] {
+	return func(rl *RateLimitService) {
+		rl.keys = keys
+	}
+}
+
+/*
+this option is used to set the timeout of the store, the request is allowed if the store is failed or timed out
+*/
+func WithRateLimitTimeout(timeout time.Duration) metadata.OptionBuilder[RateLimitService] {
+	return func(rl *RateLimitService) {
+		rl.timeout = timeout
+	}
+}
+
+/*
+the rate limit counts the requests by the key in the store, so the limit is shared by the gateways with the shared store
+(such as ratelimit.NewRedisStore), the request over the limit is rejected with ResourceExhausted.
+the rules are evaluated with the limit, every matched rule counts the request in its own bucket and the request is
+rejected if any of them is over, the buckets are taken only if all of them allow the request when they are checked
+(the bucket emptied by the other gateways between the check and the take still rejects the request after the buckets
+before it are taken, they are not given back).
+the rules are swapped at runtime by SetRules or the watched config file, they replace the single bucket of the LimitService
+*/
+type RateLimitService struct {
+	store   ratelimit.Store
+	keys    []ratelimit.Key
+	timeout time.Duration
+	//the limit of all the requests, it is nil if there are only the rules
+	base  *ratelimit.Policy
+	rules atomic.Pointer[[]*ratelimit.Policy]
+	//the events of the file in the delay are merged into one reload
+	delay time.Duration
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func NewRateLimit(store ratelimit.Store, limit ratelimit.Limit, builders ...metadata.OptionBuilder[RateLimitService]) *RateLimitService {
+	rl := NewRuleRateLimit(store, builders...)
+	rl.base = ratelimit.NewPolicy("", limit, rl.keys...)
+	return rl
+}
+
+/*
+the rate limit of the rules only, the rules are set by SetRules or Watch
+*/
+func NewRuleRateLimit(store ratelimit.Store, builders ...metadata.OptionBuilder[RateLimitService]) *RateLimitService {
+	rl := &RateLimitService{
+		store:   store,
+		timeout: 100 * time.Millisecond,
+		delay:   200 * time.Millisecond,
+		stop:    make(chan struct{}),
+	}
+	metadata.LoadOption(rl, builders...)
+	return rl
+}
+
+/*
+swap the rules, the old rules are kept if the new ones are wrong
+*/
+func (rl *RateLimitService) SetRules(rules []ratelimit.Rule) error {
+	policies, err := ratelimit.Compile(rules)
+	if err != nil {
+		return err
+	}
+	rl.rules.Store(&policies)
+	return nil
+}
+
+/*
+load the rules from the config file and reload them when the file is changed,
+the dir of the file is watched so the file replaced by the editor or the deployment (rename) is still watched
+*/
+func (rl *RateLimitService) Watch(path string, logger *zerolog.Logger) error {
+	if err := rl.load(path); err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(path) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					reload = time.After(rl.delay)
+				}
+			case <-reload:
+				reload = nil
+				if err := rl.load(path); err != nil {
+					logger.Error().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+					continue
+				}
+				logger.Info().Msg(fmt.Sprintf(config.RATELIMITRULES, path))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error().Err(err).Msg(err.Error())
+			case <-rl.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (rl *RateLimitService) load(path string) error {
+	rules, err := ratelimit.LoadRules(path)
+	if err != nil {
+		return err
+	}
+	return rl.SetRules(rules)
+}
+
+// the limit and the rules matched by the request
+func (rl *RateLimitService) match(data *metadata.MetaData) []*ratelimit.Policy {
+	var matched []*ratelimit.Policy
+	if rl.base != nil {
+		matched = append(matched, rl.base)
+	}
+	if rules := rl.rules.Load(); rules != nil {
+		for _, policy := range *rules {
+			if policy.Match(data) {
+				matched = append(matched, policy)
+			}
+		}
+	}
+	return matched
+}
+
+func (rl *RateLimitService) BuildWare() ware.Middleware {
+	return func(next ware.HandlerUnit) ware.HandlerUnit {
+		return func(ctx context.Context, data *metadata.MetaData) error {
+			var (
+				limited, shown *ratelimit.Policy
+				limitedResult  ratelimit.Result
+				shownResult    ratelimit.Result
+			)
+			//the rejected request waits for the longest of the rejecting rules,
+			//otherwise the rule with the least remaining is shown to the client
+			count := func(policy *ratelimit.Policy, result ratelimit.Result) {
+				if !result.Allowed {
+					if limited == nil || result.RetryAfter > limitedResult.RetryAfter {
+						limited, limitedResult = policy, result
+					}
+				} else if shown == nil || result.Remaining < shownResult.Remaining {
+					shown, shownResult = policy, result
+				}
+			}
+			storeCtx, cancel := context.WithTimeout(ctx, rl.timeout)
+			//all the buckets are checked before any of them is taken, so the rejected request takes nothing
+			policies := rl.match(data)
+			keys := make([]string, 0, len(policies))
+			checked := make([]*ratelimit.Policy, 0, len(policies))
+			for _, policy := range policies {
+				key := policy.Key(data)
+				result, err := rl.store.Peek(storeCtx, key, policy.Limit, 1)
+				if err != nil {
+					data.Logger.Error().Msg(fmt.Sprintf(config.RATELIMITSTORE, err))
+					continue
+				}
+				if !result.Allowed {
+					count(policy, result)
+					continue
+				}
+				keys, checked = append(keys, key), append(checked, policy)
+			}
+			//the buckets may be taken by the other requests after the check, so the take is counted again,
+			//the buckets taken before the rejecting one are not given back
+			for i := 0; i < len(checked) && limited == nil; i++ {
+				result, err := rl.store.Allow(storeCtx, keys[i], checked[i].Limit, 1)
+				if err != nil {
+					data.Logger.Error().Msg(fmt.Sprintf(config.RATELIMITSTORE, err))
+					continue
+				}
+				count(checked[i], result)
+			}
+			cancel()
+			if limited != nil {
+				setlimitheader(data, limited.Limit, limitedResult)
+				data.SetResponseHeader("Retry-After", seconds(limitedResult.RetryAfter))
+				message := config.RATELIMITED
+				if limited.Name != "" {
+					message = fmt.Sprintf(config.RULELIMITED, limited.Name)
+				}
+				data.Result = metadata.NewErrorMeta(codes.ResourceExhausted, message)
+				return nil
+			}
+			if shown != nil {
+				setlimitheader(data, shown.Limit, shownResult)
+			}
+			return next(ctx, data)
+		}
+	}
+}
+
+func setlimitheader(data *metadata.MetaData, limit ratelimit.Limit, result ratelimit.Result) {
+	data.SetResponseHeader("X-RateLimit-Limit", strconv.Itoa(limit.Rate))
+	data.SetResponseHeader("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	data.SetResponseHeader("X-RateLimit-Reset", seconds(result.ResetAfter))
+}
+
+// the headers are in the seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func (rl *RateLimitService) Stop() {
+	rl.once.Do(func() {
+		close(rl.stop)
+	})
+}
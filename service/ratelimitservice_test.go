@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"net/http/httptest"
+	"octopus/metadata"
+	"octopus/service/ratelimit"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the http request through the rate limit, the response is recorded
+func ratelimited(rl *RateLimitService, headers map[string]string) (*httptest.ResponseRecorder, error) {
+	logger := zerolog.Nop()
+	r := httptest.NewRequest("POST", "/proto.Greeter/SayHello", nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	data := &metadata.MetaData{
+		Descriptor: &metadata.Descriptor{URI: &metadata.URI{ServiceName: "proto.Greeter", Method: "SayHello"}},
+		HttpMeta:   &metadata.HttpMeta{Request: r, Response: w},
+		Logger:     &logger,
+	}
+	err := rl.BuildWare()(func(ctx context.Context, data *metadata.MetaData) error {
+		return nil
+	})(context.Background(), data)
+	if err == nil {
+		err = data.Err()
+	}
+	return w, err
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	rl := NewRuleRateLimit(ratelimit.NewMemoryStore())
+	defer rl.Stop()
+	if err := rl.SetRules([]ratelimit.Rule{
+		{Name: "all", Rate: 10, Period: "1m"},
+		{Name: "hello", ServiceName: "proto.Greeter", Method: "SayHello", By: []string{"apikey:x-api-key"}, Rate: 2, Period: "1m"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	apikey := map[string]string{"X-Api-Key": "a"}
+	for i := 0; i < 2; i++ {
+		w, err := ratelimited(rl, apikey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the rule with the least remaining is shown
+		if limit, remaining := w.Header().Get("X-RateLimit-Limit"), w.Header().Get("X-RateLimit-Remaining"); limit != "2" || remaining != strconv.Itoa(1-i) {
+			t.Fatalf("the headers of the request %v are %v", i, w.Header())
+		}
+		//the reset is the end of the window of the sliding window
+		if reset, err := strconv.Atoi(w.Header().Get("X-RateLimit-Reset")); err != nil || reset < 1 || reset > 60 {
+			t.Fatalf("the reset is %v", w.Header().Get("X-RateLimit-Reset"))
+		}
+	}
+	for i := 0; i < 3; i++ {
+		w, err := ratelimited(rl, apikey)
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("the request over the limit is %v", err)
+		}
+		if retry := w.Header().Get("Retry-After"); retry == "" || retry == "0" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+			t.Fatalf("the headers of the rejected request are %v", w.Header())
+		}
+	}
+	//the rejected requests do not take the bucket of the rule allowing them
+	w, err := ratelimited(rl, map[string]string{"X-Api-Key": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := w.Header().Get("X-RateLimit-Remaining"); remaining != "1" {
+		t.Fatalf("the remaining of the other api key is %v", remaining)
+	}
+	//the global bucket is taken by the 3 allowed requests only
+	all := (*rl.rules.Load())[0]
+	result, err := rl.store.Peek(context.Background(), all.Key(&metadata.MetaData{}), all.Limit, 1)
+	if err != nil || result.Remaining != 6 {
+		t.Fatalf("the global rule is %+v %v", result, err)
+	}
+}
+
+/*
+the rules are reloaded when the file is changed, the wrong file keeps the old rules
+*/
+func TestRateLimitReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"Rules": [{"Name": "hello", "Method": "SayHello", "Rate": 1, "Period": "1m"}]}`)
+	rl := NewRuleRateLimit(ratelimit.NewMemoryStore())
+	rl.delay = 10 * time.Millisecond
+	defer rl.Stop()
+	logger := zerolog.Nop()
+	if err := rl.Watch(path, &logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ratelimited(rl, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ratelimited(rl, nil); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("the request over the rule is %v", err)
+	}
+
+	write(`{"Rules": [{"Name": "hello", "Method": "SayHello", "Rate": 0, "Period": "1m"}]}`)
+	time.Sleep(100 * time.Millisecond)
+	if rules := rl.rules.Load(); len(*rules) != 1 || (*rules)[0].Limit.Rate != 1 {
+		t.Fatal("the wrong rules are loaded")
+	}
+
+	write(`{"Rules": [{"Name": "hello", "Method": "SayHello", "Rate": 5, "Period": "1m"}]}`)
+	timeout := time.After(2 * time.Second)
+	for {
+		if _, err := ratelimited(rl, nil); err == nil {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatal("the rules are not reloaded")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package regcenter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"octopus/config"
+	"octopus/metadata"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+/*
+this option is used to set the acl token of consul
+*/
+func WithConsulToken(token string) metadata.OptionBuilder[ConsulCenter] {
+	return func(c *ConsulCenter) {
+		c.token = token
+	}
+}
+
+/*
+this option is used to set the datacenter of the services
+*/
+func WithConsulDatacenter(datacenter string) metadata.OptionBuilder[ConsulCenter] {
+	return func(c *ConsulCenter) {
+		c.datacenter = datacenter
+	}
+}
+
+/*
+this option is used to set the max wait time of the blocking query
+*/
+func WithConsulWait(wait time.Duration) metadata.OptionBuilder[ConsulCenter] {
+	return func(c *ConsulCenter) {
+		c.wait = wait
+	}
+}
+
+/*
+this is the router center reading the hosts from the consul service catalog,
+the routers are read from the json config file (the Hosts in the file are replaced by the consul services).
+the instance is the HostInfo, the weight is read from the service meta "weight" (or the service weights),
+the status is false if any health check is critical. the consul service named as the cluster fills the hosts of the cluster
+instead of the Hosts. the changes are pushed by the blocking queries
+*/
+type ConsulCenter struct {
+	address    string
+	path       string
+	services   []string
+	token      string
+	datacenter string
+	wait       time.Duration
+	//the min interval of the queries of a service, the query returns at once if the index is broken
+	interval   time.Duration
+	client     *http.Client
+	useReflect bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	v          *viper.Viper
+	//serialize the building and the pushing of the routers, so the older router does not overwrite the newer one
+	updating sync.Mutex
+	mu       sync.Mutex
+	router   *Router
+	hosts    map[string][]HostInfo
+	indexes  map[string]uint64
+}
+
+type consulentry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+			Warning int
+		}
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+/*
+the address is the http address of the consul agent such as http://127.0.0.1:8500,
+the path is the json config file of the routers and the services are the consul service names of the backends
+*/
+func NewConsulCenter(address string, path string, services []string, builders ...metadata.OptionBuilder[ConsulCenter]) *ConsulCenter {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &ConsulCenter{
+		address:  strings.TrimSuffix(address, "/"),
+		path:     path,
+		services: services,
+		wait:     5 * time.Minute,
+		interval: time.Second,
+		client:   &http.Client{},
+		ctx:      ctx,
+		cancel:   cancel,
+		v:        viper.New(),
+		hosts:    make(map[string][]HostInfo),
+		indexes:  make(map[string]uint64),
+	}
+	metadata.LoadOption(c, builders...)
+	return c
+}
+
+func (c *ConsulCenter) LoadDic(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	c.useReflect = true
+	return c.loadConfig(logger)
+}
+
+func (c *ConsulCenter) LoadDicNoTable(logger *zerolog.Logger) *Router {
+	router, _ := c.loadConfig(logger)
+	return router
+}
+
+func (c *ConsulCenter) loadConfig(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg, err := readConfig(c.v, c.path)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	cfg.Hosts = nil
+	router, regtable, err := cfg.BuildSysConfig(c.useReflect, logger)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	c.router = router
+	for _, service := range c.services {
+		hosts, index, err := c.query(c.ctx, service, 0)
+		if err != nil {
+			logger.Panic().Err(err).Msg(err.Error())
+		}
+		c.hosts[service], c.indexes[service] = hosts, consulindex(0, index)
+	}
+	return c.build(), regtable
+}
+
+/*
+the router with the hosts of all the services, the same host in the services is merged
+*/
+func (c *ConsulCenter) build() *Router {
+	router := c.router.Clone()
+	services := make([]string, 0, len(c.hosts))
+	for service := range c.hosts {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	router.Hosts = make(map[string]*HostInfo)
+	for _, service := range services {
+		hosts := router.Hosts
+		if cluster, ok := router.Clusters[service]; ok {
+			cluster = cluster.Clone()
+			cluster.Hosts = make(map[string]*HostInfo)
+			router.Clusters[service] = cluster
+			hosts = cluster.Hosts
+		}
+		for _, v := range c.hosts[service] {
+			host := v
+			hosts[host.Host] = &host
+		}
+	}
+	return router
+}
+
+/*
+the blocking query of the service health, it returns when the index is changed or the wait time is reached
+*/
+func (c *ConsulCenter) query(ctx context.Context, service string, index uint64) ([]HostInfo, uint64, error) {
+	params := url.Values{}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(c.wait.Seconds())))
+	}
+	if len(c.datacenter) > 0 {
+		params.Set("dc", c.datacenter)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.address+"/v1/health/service/"+url.PathEscape(service)+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("query the consul service %v failed: %v", service, resp.Status)
+	}
+	var entries []consulentry
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	newindex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	hosts := make([]HostInfo, 0, len(entries))
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if len(address) == 0 {
+			address = entry.Node.Address
+		}
+		status, warning := true, false
+		for _, check := range entry.Checks {
+			switch check.Status {
+			case "critical":
+				status = false
+			case "warning":
+				warning = true
+			}
+		}
+		weight := entry.Service.Weights.Passing
+		if warning {
+			weight = entry.Service.Weights.Warning
+		}
+		if w, err := strconv.Atoi(entry.Service.Meta["weight"]); err == nil {
+			weight = w
+		}
+		if weight <= 0 {
+			weight = 1
+		}
+		hosts = append(hosts, HostInfo{
+			Host:   net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)),
+			Weight: weight,
+			Status: status,
+		})
+	}
+	return hosts, newindex, nil
+}
+
+/*
+every service is watched by the blocking query, the queries of a service are limited by the interval
+so the missing or the broken index does not make the loop spin
+*/
+func (c *ConsulCenter) Watch(update UpdateHandler, logger *zerolog.Logger) {
+	for _, service := range c.services {
+		go func(service string) {
+			var last time.Time
+			for {
+				if wait := c.interval - time.Since(last); wait > 0 {
+					select {
+					case <-c.ctx.Done():
+						return
+					case <-time.After(wait):
+					}
+				}
+				last = time.Now()
+				c.mu.Lock()
+				index := c.indexes[service]
+				c.mu.Unlock()
+				hosts, newindex, err := c.query(c.ctx, service, index)
+				if err != nil {
+					if c.ctx.Err() != nil {
+						return
+					}
+					logger.Error().Err(err).Msg(err.Error())
+					continue
+				}
+				newindex = consulindex(index, newindex)
+				if newindex == index {
+					continue
+				}
+				err = c.push(map[string][]HostInfo{service: hosts}, map[string]uint64{service: newindex}, update)
+				if err != nil {
+					logger.Error().Err(err).Msg(err.Error())
+				}
+			}
+		}(service)
+	}
+}
+
+/*
+the index is reset if it goes backwards and it is at least 1, the query of the index 0 never blocks
+*/
+func consulindex(index, newindex uint64) uint64 {
+	if newindex < index {
+		newindex = 0
+	}
+	return max(newindex, 1)
+}
+
+/*
+keep the hosts and the indexes of the services, the router of all the services is pushed if it is valid
+*/
+func (c *ConsulCenter) push(hosts map[string][]HostInfo, indexes map[string]uint64, update UpdateHandler) error {
+	c.updating.Lock()
+	defer c.updating.Unlock()
+	c.mu.Lock()
+	for service := range hosts {
+		c.hosts[service], c.indexes[service] = hosts[service], indexes[service]
+	}
+	router := c.build()
+	c.mu.Unlock()
+	if err := router.Validate(); err != nil {
+		return err
+	}
+	update(router, nil)
+	return nil
+}
+
+func (c *ConsulCenter) Stop() {
+	c.cancel()
+}
+
+/*
+the hosts are updated by the blocking queries, query them again on demand,
+the services are queried without the lock so the watches are not blocked
+*/
+func (c *ConsulCenter) Watcher(sender *RegContext) {
+	hosts := make(map[string][]HostInfo, len(c.services))
+	indexes := make(map[string]uint64, len(c.services))
+	for _, service := range c.services {
+		result, index, err := c.query(sender.Request.Context(), service, 0)
+		if err != nil {
+			sender.Logger.Error().Err(err).Msg(err.Error())
+			sender.Response.Write([]byte(err.Error()))
+			return
+		}
+		hosts[service], indexes[service] = result, consulindex(0, index)
+	}
+	if err := c.push(hosts, indexes, sender.Update); err != nil {
+		sender.Logger.Error().Err(err).Msg(err.Error())
+		sender.Response.Write([]byte(err.Error()))
+		return
+	}
+	sender.Response.Write([]byte("the consul reg center is refreshed"))
+}
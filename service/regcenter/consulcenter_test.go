@@ -0,0 +1,289 @@
+package regcenter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog"
+	"octopus/metadata"
+)
+
+const consulrouters = `{
+	"Clusters": [{"Name": "canary"}],
+	"Routers": [{
+		"ServiceName": "proto.Greeter",
+		"Method": "SayHello",
+		"Matches": [{"Header": "x-canary", "Cluster": "canary"}]
+	}]
+}`
+
+/*
+the fake health api of consul, the blocking query waits until the entries of the service are changed,
+the index header is not sent if the index is 0
+*/
+type fakeconsul struct {
+	mu       sync.Mutex
+	changed  chan struct{}
+	index    uint64
+	entries  map[string][]map[string]any
+	queries  atomic.Int64
+	indexes  []string
+	blocking time.Duration
+	//the query without the index waits for it if it is not nil
+	hold chan struct{}
+}
+
+func newfakeconsul() *fakeconsul {
+	return &fakeconsul{changed: make(chan struct{}), index: 10, entries: make(map[string][]map[string]any), blocking: time.Second}
+}
+
+func consulservice(address string, port int, weight string, checks ...string) map[string]any {
+	entry := map[string]any{
+		"Node":    map[string]any{"Address": "10.0.0.1"},
+		"Service": map[string]any{"Address": address, "Port": port, "Meta": map[string]string{}, "Weights": map[string]int{"Passing": 3, "Warning": 1}},
+	}
+	if weight != "" {
+		entry["Service"].(map[string]any)["Meta"] = map[string]string{"weight": weight}
+	}
+	statuses := make([]map[string]string, 0, len(checks))
+	for _, v := range checks {
+		statuses = append(statuses, map[string]string{"Status": v})
+	}
+	entry["Checks"] = statuses
+	return entry
+}
+
+func (f *fakeconsul) set(service string, index uint64, entries ...map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[service], f.index = entries, index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeconsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.queries.Add(1)
+	service := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	index := r.URL.Query().Get("index")
+	f.mu.Lock()
+	f.indexes = append(f.indexes, index)
+	current, changed, hold := f.index, f.changed, f.hold
+	f.mu.Unlock()
+	if index == "" && hold != nil {
+		<-hold
+	}
+	if index != "" && index == strconv.FormatUint(current, 10) {
+		select {
+		case <-changed:
+		case <-time.After(f.blocking):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	f.mu.Lock()
+	entries := f.entries[service]
+	if f.index > 0 {
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	}
+	f.mu.Unlock()
+	if entries == nil {
+		entries = []map[string]any{}
+	}
+	jsoniter.NewEncoder(w).Encode(entries)
+}
+
+func newconsulcenter(t *testing.T, f *fakeconsul) (*ConsulCenter, *Router) {
+	t.Helper()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	path := filepath.Join(t.TempDir(), "router.json")
+	if err := os.WriteFile(path, []byte(consulrouters), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	c := NewConsulCenter(server.URL, path, []string{"greeter", "canary"})
+	c.interval = 20 * time.Millisecond
+	t.Cleanup(c.Stop)
+	return c, c.LoadDicNoTable(&logger)
+}
+
+func TestConsulCenterLoad(t *testing.T) {
+	f := newfakeconsul()
+	f.entries["greeter"] = []map[string]any{
+		consulservice("127.0.0.1", 9000, "5"),
+		consulservice("", 9001, "", "passing", "warning"),
+		consulservice("127.0.0.1", 9002, "", "critical"),
+	}
+	f.entries["canary"] = []map[string]any{consulservice("127.0.0.2", 9000, "")}
+	_, router := newconsulcenter(t, f)
+
+	for host, want := range map[string]HostInfo{
+		"127.0.0.1:9000": {Weight: 5, Status: true},
+		"10.0.0.1:9001":  {Weight: 1, Status: true},
+		"127.0.0.1:9002": {Weight: 3, Status: false},
+	} {
+		got, ok := router.Hosts[host]
+		if !ok || got.Weight != want.Weight || got.Status != want.Status {
+			t.Fatalf("the host %v is %+v", host, got)
+		}
+	}
+	//the service named as the cluster fills the hosts of the cluster
+	if hosts, _ := router.ClusterHosts("canary"); len(hosts) != 1 || hosts["127.0.0.2:9000"] == nil {
+		t.Fatalf("the hosts of the cluster are %v", hosts)
+	}
+	if err := router.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulCenterWatch(t *testing.T) {
+	f := newfakeconsul()
+	f.entries["greeter"] = []map[string]any{consulservice("127.0.0.1", 9000, "")}
+	f.entries["canary"] = []map[string]any{consulservice("127.0.0.2", 9000, "")}
+	c, _ := newconsulcenter(t, f)
+	logger := zerolog.Nop()
+	routers := make(chan *Router, 16)
+	c.Watch(func(router *Router, regtable metadata.ProtoTable) {
+		routers <- router
+	}, &logger)
+
+	time.Sleep(50 * time.Millisecond)
+	//the index is shared by the services, so the other service may push the same hosts again
+	f.set("greeter", 11, consulservice("127.0.0.1", 9000, ""), consulservice("127.0.0.1", 9001, ""))
+	waitrouter(t, routers, func(router *Router) bool {
+		if hosts, _ := router.ClusterHosts("canary"); len(hosts) != 1 {
+			t.Fatalf("the hosts of the cluster are %v", hosts)
+		}
+		return len(router.Hosts) == 2 && router.Hosts["127.0.0.1:9001"] != nil
+	})
+
+	//all the hosts are critical, the router is refused
+	f.set("greeter", 12, consulservice("127.0.0.1", 9000, "", "critical"))
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case router := <-routers:
+			if host := router.Hosts["127.0.0.1:9000"]; len(router.Hosts) == 1 && !host.Status {
+				t.Fatalf("the router without the available host is pushed: %v", router.Hosts)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+/*
+the index of consul is missing or reset, the queries are limited by the interval instead of spinning
+*/
+func TestConsulCenterBrokenIndex(t *testing.T) {
+	f := newfakeconsul()
+	f.entries["greeter"] = []map[string]any{consulservice("127.0.0.1", 9000, "")}
+	f.entries["canary"] = []map[string]any{consulservice("127.0.0.2", 9000, "")}
+	c, _ := newconsulcenter(t, f)
+	logger := zerolog.Nop()
+	routers := make(chan *Router, 64)
+	c.Watch(func(router *Router, regtable metadata.ProtoTable) {
+		routers <- router
+	}, &logger)
+
+	//the index goes backwards, it is reset and the hosts are read again
+	f.set("greeter", 3, consulservice("127.0.0.1", 9005, ""))
+	waitrouter(t, routers, func(router *Router) bool {
+		return router.Hosts["127.0.0.1:9005"] != nil
+	})
+
+	//the index is missing, so the query never blocks
+	f.set("greeter", 0, consulservice("127.0.0.1", 9005, ""))
+	time.Sleep(50 * time.Millisecond)
+	f.mu.Lock()
+	f.indexes = nil
+	f.mu.Unlock()
+	f.queries.Store(0)
+	time.Sleep(200 * time.Millisecond)
+	//two services, one query per interval (20ms) each
+	if n := f.queries.Load(); n > 24 {
+		t.Fatalf("the watch spins with %v queries", n)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, index := range f.indexes {
+		if n, _ := strconv.ParseUint(index, 10, 64); n < 1 {
+			t.Fatalf("the query of the index %q is sent: %v", index, f.indexes)
+		}
+	}
+}
+
+/*
+the refresh queries the services without the lock, so the watches go on while it is waiting for consul
+*/
+func TestConsulCenterRefresh(t *testing.T) {
+	f := newfakeconsul()
+	f.entries["greeter"] = []map[string]any{consulservice("127.0.0.1", 9000, "")}
+	f.entries["canary"] = []map[string]any{consulservice("127.0.0.2", 9000, "")}
+	c, _ := newconsulcenter(t, f)
+	logger := zerolog.Nop()
+	routers := make(chan *Router, 64)
+	update := func(router *Router, regtable metadata.ProtoTable) {
+		routers <- router
+	}
+	c.Watch(update, &logger)
+	time.Sleep(50 * time.Millisecond)
+
+	hold := make(chan struct{})
+	release := sync.OnceFunc(func() { close(hold) })
+	t.Cleanup(release)
+	f.mu.Lock()
+	f.hold = hold
+	f.mu.Unlock()
+	refreshed := make(chan struct{})
+	w := httptest.NewRecorder()
+	go func() {
+		defer close(refreshed)
+		c.Watcher(&RegContext{
+			Logger:   &logger,
+			Request:  httptest.NewRequest(http.MethodGet, "/watcher", nil),
+			Response: w,
+			Update:   update,
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	f.set("greeter", 11, consulservice("127.0.0.1", 9000, ""), consulservice("127.0.0.1", 9001, ""))
+	waitrouter(t, routers, func(router *Router) bool {
+		return router.Hosts["127.0.0.1:9001"] != nil
+	})
+
+	release()
+	select {
+	case <-refreshed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the refresh is not finished")
+	}
+	if !strings.Contains(w.Body.String(), "refreshed") {
+		t.Fatalf("the refresh is %v", w.Body.String())
+	}
+}
+
+// wait for the router pushed by the watch, the routers before it are skipped
+func waitrouter(t *testing.T, routers <-chan *Router, fn func(router *Router) bool) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case router := <-routers:
+			if fn(router) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the router is not updated")
+		}
+	}
+}
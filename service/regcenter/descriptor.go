@@ -0,0 +1,82 @@
+package regcenter
+
+import (
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+/*
+expand the services to routers by using the method descriptors in the registry
+*/
+func expandServices(registry *metadata.ProtoRegistry, services []ServiceInfo, routers []RouterInfo) ([]RouterInfo, error) {
+	expanded := append(make([]RouterInfo, 0, len(routers)), routers...)
+	for _, service := range services {
+		d, err := registry.FindDescriptorByName(protoreflect.FullName(service.ServiceName))
+		if err != nil {
+			return nil, fmt.Errorf(config.NOPROTODESCRIPTOR, service.ServiceName)
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf(config.NOPROTODESCRIPTOR, service.ServiceName)
+		}
+		methods := sd.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			method := methods.Get(i)
+			expanded = append(expanded, RouterInfo{
+				ServiceName:   service.ServiceName,
+				Method:        string(method.Name()),
+				Host:          service.Host,
+				Cluster:       service.Cluster,
+				Splits:        service.Splits,
+				Matches:       service.Matches,
+				Retry:         service.Retry,
+				Timeout:       service.Timeout,
+				MaxTimeout:    service.MaxTimeout,
+				StreamTimeout: service.StreamTimeout,
+				InMessage:     string(method.Input().FullName()),
+				OutMessage:    string(method.Output().FullName()),
+			})
+		}
+	}
+	return expanded, nil
+}
+
+/*
+load the google.api.http rules of the method, the method without the option has no rule
+*/
+func loadHttpRules(registry *metadata.ProtoRegistry, descriptor *metadata.Descriptor) ([]*metadata.HttpRule, error) {
+	method, ok := findMethod(registry, descriptor)
+	if !ok || method.Options() == nil {
+		return nil, nil
+	}
+	//the options of the loaded files may keep the extension as unknown fields or dynamic message,
+	//so decode them again by the generated google.api.http extension
+	b, err := proto.Marshal(method.Options())
+	if err != nil {
+		return nil, err
+	}
+	options := &descriptorpb.MethodOptions{}
+	if err := (proto.UnmarshalOptions{Resolver: protoregistry.GlobalTypes}).Unmarshal(b, options); err != nil {
+		return nil, err
+	}
+	if !proto.HasExtension(options, annotations.E_Http) {
+		return nil, nil
+	}
+	rule, ok := proto.GetExtension(options, annotations.E_Http).(*annotations.HttpRule)
+	if !ok {
+		return nil, nil
+	}
+	return metadata.BuildHttpRules(descriptor, rule)
+}
+
+func findMethod(registry *metadata.ProtoRegistry, descriptor *metadata.Descriptor) (protoreflect.MethodDescriptor, bool) {
+	method, err := registry.FindMethod(descriptor.GetFullMethod())
+	return method, err == nil
+}
@@ -0,0 +1,500 @@
+package regcenter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"octopus/config"
+	"octopus/metadata"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/*
+this option is used to set the dns server (ip:port), the first nameserver of /etc/resolv.conf is used by default
+*/
+func WithDnsServer(server string) metadata.OptionBuilder[DnsCenter] {
+	return func(c *DnsCenter) {
+		c.server = server
+	}
+}
+
+/*
+this option is used to limit the interval of the re-resolving, the interval is the min ttl of the records
+*/
+func WithDnsTTL(min, max time.Duration) metadata.OptionBuilder[DnsCenter] {
+	return func(c *DnsCenter) {
+		c.min, c.max = min, max
+	}
+}
+
+/*
+this is the router center resolving the hosts by dns, such as the headless service of kubernetes.
+the Host of the HostInfo, the ServiceInfo and the RouterInfo in the json config file can be a dns name,
+
+	_grpc._tcp.echo.default.svc.cluster.local   the SRV records, the targets of the lowest priority are used with the weight of the records
+	echo.default.svc.cluster.local:9090         the A and AAAA records with the port
+
+the names in the Hosts of the cluster are resolved into the hosts of the cluster, the Host of the route without the cluster
+is resolved into the cluster named by the dns name, so the routes of the different names do not share the balance.
+the names are resolved again when the min ttl of the records expires, the changed hosts are swapped in
+*/
+type DnsCenter struct {
+	path       string
+	server     string
+	timeout    time.Duration
+	min        time.Duration
+	max        time.Duration
+	useReflect bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	v          *viper.Viper
+	mu         sync.Mutex
+	router     *Router
+	//the dns names and the weight of the A records
+	names map[dnsname]int
+	hosts map[dnsname][]HostInfo
+	ttl   time.Duration
+}
+
+/*
+the dns name of the cluster, the cluster "" is the global Hosts
+*/
+type dnsname struct {
+	cluster string
+	name    string
+}
+
+func NewDnsCenter(path string, builders ...metadata.OptionBuilder[DnsCenter]) *DnsCenter {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &DnsCenter{
+		path:    path,
+		server:  resolvconf(),
+		timeout: 5 * time.Second,
+		min:     time.Second,
+		max:     time.Minute,
+		ctx:     ctx,
+		cancel:  cancel,
+		v:       viper.New(),
+	}
+	metadata.LoadOption(c, builders...)
+	return c
+}
+
+/*
+the first nameserver of /etc/resolv.conf
+*/
+func resolvconf() string {
+	server := "127.0.0.1"
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "nameserver" {
+				server = fields[1]
+				break
+			}
+		}
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+/*
+the SRV name starts with the underscore, the name of the A records has the port, the ip address is not a dns name
+*/
+func isdnsname(host string) bool {
+	if strings.HasPrefix(host, "_") {
+		return true
+	}
+	name, _, err := net.SplitHostPort(host)
+	return err == nil && len(name) > 0 && net.ParseIP(name) == nil
+}
+
+func (c *DnsCenter) LoadDic(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	c.useReflect = true
+	return c.loadConfig(logger)
+}
+
+func (c *DnsCenter) LoadDicNoTable(logger *zerolog.Logger) *Router {
+	router, _ := c.loadConfig(logger)
+	return router
+}
+
+func (c *DnsCenter) loadConfig(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg, err := readConfig(c.v, c.path)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	router, regtable, err := cfg.BuildSysConfig(c.useReflect, logger)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	c.names = make(map[dnsname]int)
+	for k, v := range router.Hosts {
+		if isdnsname(k) {
+			c.names[dnsname{name: k}] = v.Weight
+			delete(router.Hosts, k)
+		}
+	}
+	for name, cluster := range router.Clusters {
+		cluster = cluster.Clone()
+		for k, v := range cluster.Hosts {
+			if isdnsname(k) {
+				c.names[dnsname{cluster: name, name: k}] = v.Weight
+				delete(cluster.Hosts, k)
+			}
+		}
+		router.Clusters[name] = cluster
+	}
+	for k, v := range router.Descriptors {
+		if !isdnsname(v.Host) || len(v.Cluster) > 0 {
+			continue
+		}
+		if _, ok := router.Clusters[v.Host]; !ok {
+			router.Clusters[v.Host] = &Cluster{Name: v.Host, Hosts: make(map[string]*HostInfo)}
+			c.names[dnsname{cluster: v.Host, name: v.Host}] = 1
+		}
+		descriptor := *v
+		descriptor.Cluster = v.Host
+		router.Descriptors[k] = &descriptor
+	}
+	c.router = router
+	hosts, ttl, err := c.resolveAll(c.ctx)
+	if err != nil {
+		logger.Panic().Err(err).Msg(err.Error())
+	}
+	c.hosts, c.ttl = hosts, ttl
+	return c.build(), regtable
+}
+
+/*
+the static hosts of the config with the resolved hosts, the same host of the names is merged
+*/
+func (c *DnsCenter) build() *Router {
+	router := c.router.Clone()
+	names := make([]dnsname, 0, len(c.hosts))
+	for name := range c.hosts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].cluster != names[j].cluster {
+			return names[i].cluster < names[j].cluster
+		}
+		return names[i].name < names[j].name
+	})
+	for _, name := range names {
+		hosts := router.Hosts
+		if len(name.cluster) > 0 {
+			cluster, ok := router.Clusters[name.cluster]
+			if !ok {
+				continue
+			}
+			if cluster == c.router.Clusters[name.cluster] {
+				cluster = cluster.Clone()
+				router.Clusters[name.cluster] = cluster
+			}
+			hosts = cluster.Hosts
+		}
+		for _, v := range c.hosts[name] {
+			host := v
+			hosts[host.Host] = &host
+		}
+	}
+	return router
+}
+
+func (c *DnsCenter) resolveAll(ctx context.Context) (map[dnsname][]HostInfo, time.Duration, error) {
+	hosts := make(map[dnsname][]HostInfo, len(c.names))
+	ttl := c.max
+	for key, weight := range c.names {
+		name := key.name
+		var (
+			infos  []HostInfo
+			expire time.Duration
+			err    error
+		)
+		if strings.HasPrefix(name, "_") {
+			infos, expire, err = c.resolveSRV(ctx, name)
+		} else {
+			infos, expire, err = c.resolveHost(ctx, name, weight)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("resolve the dns name %v failed: %w", name, err)
+		}
+		hosts[key] = infos
+		ttl = min(ttl, expire)
+	}
+	return hosts, max(ttl, c.min), nil
+}
+
+/*
+the targets of the lowest priority, the ip addresses of the targets are read from the additional section if it has
+*/
+func (c *DnsCenter) resolveSRV(ctx context.Context, name string) ([]HostInfo, time.Duration, error) {
+	msg, err := c.exchange(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := c.max
+	var srvs []*dnsmessage.SRVResource
+	for _, answer := range msg.Answers {
+		if srv, ok := answer.Body.(*dnsmessage.SRVResource); ok {
+			ttl = min(ttl, time.Duration(answer.Header.TTL)*time.Second)
+			if len(srvs) == 0 || srv.Priority < srvs[0].Priority {
+				srvs = []*dnsmessage.SRVResource{srv}
+			} else if srv.Priority == srvs[0].Priority {
+				srvs = append(srvs, srv)
+			}
+		}
+	}
+	additionals := make(map[string][]string)
+	for _, additional := range msg.Additionals {
+		if ip, ok := addressof(additional); ok {
+			target := strings.ToLower(additional.Header.Name.String())
+			additionals[target] = append(additionals[target], ip)
+		}
+	}
+	hosts := make([]HostInfo, 0, len(srvs))
+	for _, srv := range srvs {
+		ips, ok := additionals[strings.ToLower(srv.Target.String())]
+		if !ok {
+			var expire time.Duration
+			if ips, expire, err = c.lookup(ctx, srv.Target.String()); err != nil {
+				return nil, 0, err
+			}
+			ttl = min(ttl, expire)
+		}
+		for _, ip := range ips {
+			hosts = append(hosts, HostInfo{
+				Host:   net.JoinHostPort(ip, strconv.Itoa(int(srv.Port))),
+				Weight: max(int(srv.Weight), 1),
+				Status: true,
+			})
+		}
+	}
+	return hosts, ttl, nil
+}
+
+func (c *DnsCenter) resolveHost(ctx context.Context, name string, weight int) ([]HostInfo, time.Duration, error) {
+	host, port, _ := net.SplitHostPort(name)
+	ips, ttl, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	hosts := make([]HostInfo, 0, len(ips))
+	for _, ip := range ips {
+		hosts = append(hosts, HostInfo{
+			Host:   net.JoinHostPort(ip, port),
+			Weight: max(weight, 1),
+			Status: true,
+		})
+	}
+	return hosts, ttl, nil
+}
+
+/*
+the A and AAAA records of the name
+*/
+func (c *DnsCenter) lookup(ctx context.Context, name string) ([]string, time.Duration, error) {
+	ttl := c.max
+	var ips []string
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := c.exchange(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, answer := range msg.Answers {
+			if ip, ok := addressof(answer); ok {
+				ttl = min(ttl, time.Duration(answer.Header.TTL)*time.Second)
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, ttl, nil
+}
+
+func addressof(resource dnsmessage.Resource) (string, bool) {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:]).String(), true
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:]).String(), true
+	}
+	return "", false
+}
+
+/*
+query the dns server by udp, the truncated response is queried again by tcp
+*/
+func (c *DnsCenter) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	msg, err := c.roundtrip(ctx, "udp", query.Header.ID, b)
+	if err == nil && msg.Header.Truncated {
+		msg, err = c.roundtrip(ctx, "tcp", query.Header.ID, b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		return msg, nil
+	default:
+		return nil, fmt.Errorf("the dns server returns %v", msg.Header.RCode)
+	}
+}
+
+func (c *DnsCenter) roundtrip(ctx context.Context, network string, id uint16, query []byte) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, c.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	resp := make([]byte, 65535)
+	n := 0
+	if network == "tcp" {
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, resp[:2]); err != nil {
+			return nil, err
+		}
+		if n, err = io.ReadFull(conn, resp[:binary.BigEndian.Uint16(resp[:2])]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		if n, err = conn.Read(resp); err != nil {
+			return nil, err
+		}
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp[:n]); err != nil {
+		return nil, err
+	}
+	if msg.Header.ID != id {
+		return nil, errors.New("the id of the dns response is wrong")
+	}
+	return &msg, nil
+}
+
+/*
+resolve the names again when the ttl expires, the router is swapped in only if the hosts are changed
+*/
+func (c *DnsCenter) Watch(update UpdateHandler, logger *zerolog.Logger) {
+	go func() {
+		for {
+			c.mu.Lock()
+			ttl := c.ttl
+			c.mu.Unlock()
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(ttl):
+			}
+			if err := c.refresh(c.ctx, update, false); err != nil {
+				logger.Error().Err(err).Msg(err.Error())
+			}
+		}
+	}()
+}
+
+func (c *DnsCenter) refresh(ctx context.Context, update UpdateHandler, force bool) error {
+	c.mu.Lock()
+	hosts, ttl, err := c.resolveAll(ctx)
+	if err != nil {
+		c.ttl = c.min
+		c.mu.Unlock()
+		return err
+	}
+	changed := !equalhosts(c.hosts, hosts)
+	c.hosts, c.ttl = hosts, ttl
+	router := c.build()
+	c.mu.Unlock()
+	if !changed && !force {
+		return nil
+	}
+	if err := router.Validate(); err != nil {
+		return err
+	}
+	update(router, nil)
+	return nil
+}
+
+func equalhosts(a, b map[dnsname][]HostInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, hosts := range a {
+		other, ok := b[name]
+		if !ok || len(hosts) != len(other) {
+			return false
+		}
+		set := make(map[HostInfo]struct{}, len(hosts))
+		for _, host := range hosts {
+			set[host] = struct{}{}
+		}
+		for _, host := range other {
+			if _, ok := set[host]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *DnsCenter) Stop() {
+	c.cancel()
+}
+
+/*
+resolve the names again on demand
+*/
+func (c *DnsCenter) Watcher(sender *RegContext) {
+	if err := c.refresh(sender.Request.Context(), sender.Update, true); err != nil {
+		sender.Logger.Error().Err(err).Msg(err.Error())
+		sender.Response.Write([]byte(err.Error()))
+		return
+	}
+	sender.Response.Write([]byte("the dns reg center is resolved"))
+}
@@ -0,0 +1,295 @@
+package regcenter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/dns/dnsmessage"
+	"octopus/metadata"
+)
+
+const dnsrouters = `{
+	"Hosts": [{"Host": "_grpc._tcp.echo.local", "Weight": 1, "Status": true}],
+	"Clusters": [{"Name": "canary", "Hosts": [{"Host": "canary.local:9090", "Weight": 3, "Status": true}]}],
+	"Routers": [{
+		"ServiceName": "proto.Greeter",
+		"Method": "SayHello",
+		"Matches": [{"Header": "x-canary", "Cluster": "canary"}]
+	}]
+}`
+
+type dnsquestion struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+/*
+the dns server of the test over udp, the answers and the additionals are set by the question
+*/
+type fakedns struct {
+	mu          sync.Mutex
+	conn        net.PacketConn
+	answers     map[dnsquestion][]dnsmessage.Resource
+	additionals map[dnsquestion][]dnsmessage.Resource
+	queries     map[dnsquestion]int
+}
+
+func startdns(t *testing.T) *fakedns {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakedns{
+		conn:        conn,
+		answers:     make(map[dnsquestion][]dnsmessage.Resource),
+		additionals: make(map[dnsquestion][]dnsmessage.Resource),
+		queries:     make(map[dnsquestion]int),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *fakedns) serve() {
+	b := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(b[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		q := query.Questions[0]
+		key := dnsquestion{name: strings.ToLower(q.Name.String()), qtype: q.Type}
+		d.mu.Lock()
+		d.queries[key]++
+		resp := dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: query.Header.ID, Response: true, Authoritative: true},
+			Questions:   query.Questions,
+			Answers:     d.answers[key],
+			Additionals: d.additionals[key],
+		}
+		d.mu.Unlock()
+		if packed, err := resp.Pack(); err == nil {
+			d.conn.WriteTo(packed, addr)
+		}
+	}
+}
+
+func (d *fakedns) set(name string, qtype dnsmessage.Type, answers []dnsmessage.Resource, additionals ...dnsmessage.Resource) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dnsquestion{name: name, qtype: qtype}
+	d.answers[key], d.additionals[key] = answers, additionals
+}
+
+func (d *fakedns) count(name string, qtype dnsmessage.Type) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queries[dnsquestion{name: name, qtype: qtype}]
+}
+
+func dnsheader(name string, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func dnsA(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: dnsheader(name, ttl), Body: &dnsmessage.AResource{A: a}}
+}
+
+func dnsAAAA(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var aaaa [16]byte
+	copy(aaaa[:], net.ParseIP(ip).To16())
+	return dnsmessage.Resource{Header: dnsheader(name, ttl), Body: &dnsmessage.AAAAResource{AAAA: aaaa}}
+}
+
+func dnsSRV(name string, ttl uint32, priority, weight, port uint16, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsheader(name, ttl), Body: &dnsmessage.SRVResource{
+		Priority: priority,
+		Weight:   weight,
+		Port:     port,
+		Target:   dnsmessage.MustNewName(target),
+	}}
+}
+
+/*
+the SRV records of the lowest priority, a.echo.local is in the additional section and b.echo.local is resolved by the A query
+*/
+func setdnsrecords(d *fakedns, ttl uint32) {
+	d.set("_grpc._tcp.echo.local.", dnsmessage.TypeSRV, []dnsmessage.Resource{
+		dnsSRV("_grpc._tcp.echo.local.", ttl, 10, 5, 9000, "a.echo.local."),
+		dnsSRV("_grpc._tcp.echo.local.", ttl, 10, 0, 9001, "b.echo.local."),
+		dnsSRV("_grpc._tcp.echo.local.", ttl, 20, 9, 9002, "c.echo.local."),
+	}, dnsA("a.echo.local.", ttl, "10.0.0.1"))
+	d.set("b.echo.local.", dnsmessage.TypeA, []dnsmessage.Resource{dnsA("b.echo.local.", ttl, "10.0.0.2")})
+	d.set("c.echo.local.", dnsmessage.TypeA, []dnsmessage.Resource{dnsA("c.echo.local.", ttl, "10.0.0.3")})
+	d.set("canary.local.", dnsmessage.TypeA, []dnsmessage.Resource{dnsA("canary.local.", ttl, "10.0.1.1")})
+	d.set("canary.local.", dnsmessage.TypeAAAA, []dnsmessage.Resource{dnsAAAA("canary.local.", ttl, "fd00::1")})
+}
+
+func newdnscenter(t *testing.T, d *fakedns, routers string, builders ...metadata.OptionBuilder[DnsCenter]) (*DnsCenter, *Router) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "router.json")
+	if err := os.WriteFile(path, []byte(routers), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	c := NewDnsCenter(path, append([]metadata.OptionBuilder[DnsCenter]{WithDnsServer(d.conn.LocalAddr().String())}, builders...)...)
+	t.Cleanup(c.Stop)
+	return c, c.LoadDicNoTable(&logger)
+}
+
+func TestDnsCenterSRV(t *testing.T) {
+	d := startdns(t)
+	setdnsrecords(d, 30)
+	_, router := newdnscenter(t, d, dnsrouters)
+
+	if len(router.Hosts) != 2 {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+	for host, weight := range map[string]int{"10.0.0.1:9000": 5, "10.0.0.2:9001": 1} {
+		if got, ok := router.Hosts[host]; !ok || got.Weight != weight || !got.Status {
+			t.Fatalf("the host %v is %+v", host, got)
+		}
+	}
+	//the target in the additional section is not queried again, the target of the higher priority is not used
+	if n := d.count("a.echo.local.", dnsmessage.TypeA); n != 0 {
+		t.Fatalf("the additional target is queried %v times", n)
+	}
+	if n := d.count("b.echo.local.", dnsmessage.TypeA); n != 1 {
+		t.Fatalf("the target is queried %v times", n)
+	}
+	if n := d.count("c.echo.local.", dnsmessage.TypeA); n != 0 {
+		t.Fatalf("the target of the higher priority is queried %v times", n)
+	}
+}
+
+func TestDnsCenterHost(t *testing.T) {
+	d := startdns(t)
+	setdnsrecords(d, 30)
+	_, router := newdnscenter(t, d, dnsrouters)
+
+	hosts, ok := router.ClusterHosts("canary")
+	if !ok || len(hosts) != 2 {
+		t.Fatalf("the hosts of the cluster are %v", hosts)
+	}
+	for _, host := range []string{"10.0.1.1:9090", "[fd00::1]:9090"} {
+		if got, ok := hosts[host]; !ok || got.Weight != 3 {
+			t.Fatalf("the host %v is %+v", host, got)
+		}
+	}
+	if _, ok := hosts["canary.local:9090"]; ok {
+		t.Fatal("the dns name is kept in the hosts")
+	}
+	if err := router.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+the names are resolved again by the ttl, the router is pushed only if the hosts are changed
+*/
+func TestDnsCenterWatch(t *testing.T) {
+	d := startdns(t)
+	//the ttl 0 is raised to the min interval
+	setdnsrecords(d, 0)
+	c, _ := newdnscenter(t, d, dnsrouters, WithDnsTTL(20*time.Millisecond, time.Second))
+	logger := zerolog.Nop()
+	routers := make(chan *Router, 16)
+	c.Watch(func(router *Router, regtable metadata.ProtoTable) {
+		routers <- router
+	}, &logger)
+
+	time.Sleep(150 * time.Millisecond)
+	if n := d.count("_grpc._tcp.echo.local.", dnsmessage.TypeSRV); n < 3 {
+		t.Fatalf("the name is resolved %v times", n)
+	}
+	select {
+	case router := <-routers:
+		t.Fatalf("the same hosts are pushed: %v", router.Hosts)
+	default:
+	}
+
+	d.set("b.echo.local.", dnsmessage.TypeA, []dnsmessage.Resource{dnsA("b.echo.local.", 0, "10.0.0.4")})
+	select {
+	case router := <-routers:
+		if router.Hosts["10.0.0.4:9001"] == nil || router.Hosts["10.0.0.2:9001"] != nil {
+			t.Fatalf("the hosts are %v", router.Hosts)
+		}
+		if hosts, _ := router.ClusterHosts("canary"); len(hosts) != 2 {
+			t.Fatalf("the hosts of the cluster are %v", hosts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the router is not updated")
+	}
+}
+
+/*
+the Host of the route is resolved into the cluster of the route, the routes of the other names and the static host
+are not balanced across its hosts
+*/
+func TestDnsCenterRouteHost(t *testing.T) {
+	d := startdns(t)
+	d.set("greeter.local.", dnsmessage.TypeA, []dnsmessage.Resource{dnsA("greeter.local.", 30, "10.0.2.1")})
+	d.set("bye.local.", dnsmessage.TypeA, []dnsmessage.Resource{dnsA("bye.local.", 30, "10.0.3.1"), dnsA("bye.local.", 30, "10.0.3.2")})
+	_, router := newdnscenter(t, d, `{
+		"Routers": [
+			{"ServiceName": "proto.Greeter", "Method": "SayHello", "Host": "greeter.local:9000"},
+			{"ServiceName": "proto.Greeter", "Method": "SayBye", "Host": "bye.local:9001"},
+			{"ServiceName": "proto.Greeter", "Method": "SayHi", "Host": "10.0.0.9:9002"}
+		]
+	}`)
+
+	if len(router.Hosts) != 0 {
+		t.Fatalf("the hosts of the routes are in the global hosts: %v", router.Hosts)
+	}
+	for method, want := range map[string][]string{
+		"/proto.greeter/sayhello": {"10.0.2.1:9000"},
+		"/proto.greeter/saybye":   {"10.0.3.1:9001", "10.0.3.2:9001"},
+	} {
+		descriptor := router.Descriptors[method]
+		hosts, ok := router.ClusterHosts(descriptor.Cluster)
+		if !ok || len(descriptor.Cluster) == 0 || len(hosts) != len(want) {
+			t.Fatalf("the hosts of the route %v are %v in the cluster %q", method, hosts, descriptor.Cluster)
+		}
+		for _, host := range want {
+			if hosts[host] == nil {
+				t.Fatalf("the hosts of the route %v are %v", method, hosts)
+			}
+		}
+	}
+	if descriptor := router.Descriptors["/proto.greeter/sayhi"]; descriptor.Cluster != "" || descriptor.Host != "10.0.0.9:9002" {
+		t.Fatalf("the static host of the route is %v in the cluster %q", descriptor.Host, descriptor.Cluster)
+	}
+	if err := router.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEqualHosts(t *testing.T) {
+	name := dnsname{name: "_grpc._tcp.echo.local"}
+	a := map[dnsname][]HostInfo{name: {{Host: "10.0.0.1:9000", Weight: 1, Status: true}, {Host: "10.0.0.2:9000", Weight: 1, Status: true}}}
+	//the order of the records is not a change
+	b := map[dnsname][]HostInfo{name: {{Host: "10.0.0.2:9000", Weight: 1, Status: true}, {Host: "10.0.0.1:9000", Weight: 1, Status: true}}}
+	if !equalhosts(a, b) {
+		t.Fatal("the same hosts are not equal")
+	}
+	b[name][0].Weight = 2
+	if equalhosts(a, b) {
+		t.Fatal("the changed weight is equal")
+	}
+	if equalhosts(a, map[dnsname][]HostInfo{{cluster: "canary", name: name.name}: a[name]}) {
+		t.Fatal("the hosts of the other cluster are equal")
+	}
+}
@@ -1,8 +1,395 @@
 package regcenter
 
+import (
+	"context"
+	"fmt"
+	"maps"
+	"octopus/config"
+	"octopus/metadata"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	etcdhosts    = "hosts/"
+	etcdclusters = "clusters/"
+	etcdservices = "services/"
+	etcdrouters  = "routers/"
+)
+
+/*
+this is the router center stored in etcd, the keys under the prefix are
+
+	<prefix>hosts/<host>                 the HostInfo json, the backend registers itself with the lease
+	<prefix>clusters/<cluster>           the ClusterInfo json
+	<prefix>services/<service>           the ServiceInfo json, all the methods are loaded from the proto descriptor
+	<prefix>routers/<service>/<method>   the RouterInfo json
+
+the router and the balance are updated by the etcd watch events, so there is no need to call /watcher
+*/
 type EtcdCenter struct {
+	client     *clientv3.Client
+	prefix     string
+	useReflect bool
+	timeout    time.Duration
+	ctx        context.Context
+	cancel     context.CancelFunc
+	//serialize the loading and the applying of the events, the router is built and pushed in order
+	updating sync.Mutex
+	mu       sync.Mutex
+	kvs      map[string][]byte
+	revision int64
+	//the last valid router, it is stale if the kvs after it are not valid (such as the route written before its cluster)
+	router *Router
+	stale  bool
+	leases []clientv3.LeaseID
+}
+
+/*
+the address is the etcd endpoints separated by comma
+*/
+func NewEtcdCenter(address string, prefix string) (*EtcdCenter, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(address, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewEtcdCenterWithClient(client, prefix), nil
+}
+
+func NewEtcdCenterWithClient(client *clientv3.Client, prefix string) *EtcdCenter {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdCenter{
+		client:  client,
+		prefix:  prefix,
+		timeout: 5 * time.Second,
+		ctx:     ctx,
+		cancel:  cancel,
+		kvs:     make(map[string][]byte),
+	}
+}
+
+func (c *EtcdCenter) LoadDic(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	c.useReflect = true
+	return c.loadConfig(logger)
+}
+
+func (c *EtcdCenter) LoadDicNoTable(logger *zerolog.Logger) *Router {
+	router, _ := c.loadConfig(logger)
+	return router
+}
+
+func (c *EtcdCenter) loadConfig(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	c.updating.Lock()
+	defer c.updating.Unlock()
+	router, regtable, err := c.load(false, logger)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	return router, regtable
+}
+
+/*
+read all the keys under the prefix and build the router, the keys and the revision are always kept so the watch goes on
+from them, the router is returned only if it is built (and validated)
+*/
+func (c *EtcdCenter) load(validate bool, logger *zerolog.Logger) (*Router, metadata.ProtoTable, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	resp, err := c.client.Get(ctx, c.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, nil, err
+	}
+	kvs := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = kv.Value
+	}
+	router, regtable, err := c.build(kvs, logger)
+	if err == nil && validate {
+		err = router.Validate()
+	}
+	if err != nil {
+		c.commit(kvs, resp.Header.Revision, nil)
+		return nil, nil, err
+	}
+	c.commit(kvs, resp.Header.Revision, router)
+	return router, regtable, nil
+}
+
+/*
+keep the keys and the revision, the last router is kept and marked stale if the router of the keys is not valid
+*/
+func (c *EtcdCenter) commit(kvs map[string][]byte, revision int64, router *Router) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kvs = kvs
+	c.revision = revision
+	if router != nil {
+		c.router = router
+	}
+	c.stale = router == nil
+}
+
+func (c *EtcdCenter) parse(kvs map[string][]byte) (*RouterConfig, error) {
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	cfg := &RouterConfig{}
+	for _, k := range keys {
+		var err error
+		key := strings.TrimPrefix(k, c.prefix)
+		switch {
+		case strings.HasPrefix(key, etcdhosts):
+			var host HostInfo
+			if err = json.Unmarshal(kvs[k], &host); err == nil {
+				cfg.Hosts = append(cfg.Hosts, host)
+			}
+		case strings.HasPrefix(key, etcdclusters):
+			var cluster ClusterInfo
+			if err = json.Unmarshal(kvs[k], &cluster); err == nil {
+				cfg.Clusters = append(cfg.Clusters, cluster)
+			}
+		case strings.HasPrefix(key, etcdservices):
+			var service ServiceInfo
+			if err = json.Unmarshal(kvs[k], &service); err == nil {
+				cfg.Services = append(cfg.Services, service)
+			}
+		case strings.HasPrefix(key, etcdrouters):
+			var router RouterInfo
+			if err = json.Unmarshal(kvs[k], &router); err == nil {
+				cfg.Routers = append(cfg.Routers, router)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the etcd key %v is wrong: %w", k, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (c *EtcdCenter) build(kvs map[string][]byte, logger *zerolog.Logger) (*Router, metadata.ProtoTable, error) {
+	cfg, err := c.parse(kvs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg.BuildSysConfig(c.useReflect, logger)
+}
+
+/*
+the host events (such as the lease of the backend is expired) only replace the hosts and the clusters of the last router,
+the routes, the http rules and the regtable are kept
+*/
+func (c *EtcdCenter) buildhosts(last *Router, kvs map[string][]byte) (*Router, error) {
+	cfg, err := c.parse(kvs)
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := buildClusters(cfg.Clusters)
+	if err != nil {
+		return nil, err
+	}
+	router := last.Clone()
+	router.Hosts = buildHosts(cfg.Hosts)
+	router.Clusters = clusters
+	return router, nil
+}
+
+/*
+watch the prefix from the loaded revision, the keys are read again if the watch is broken (such as compacted)
+*/
+func (c *EtcdCenter) Watch(update UpdateHandler, logger *zerolog.Logger) {
+	go func() {
+		for {
+			c.mu.Lock()
+			revision := c.revision
+			c.mu.Unlock()
+			watch := c.client.Watch(clientv3.WithRequireLeader(c.ctx), c.prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+			for resp := range watch {
+				if err := resp.Err(); err != nil {
+					logger.Error().Err(err).Msg(err.Error())
+					break
+				}
+				if err := c.apply(resp, update, logger); err != nil {
+					logger.Error().Err(err).Msg(err.Error())
+				}
+			}
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			if err := c.refresh(update, logger); err != nil {
+				logger.Error().Err(err).Msg(err.Error())
+			}
+		}
+	}()
+}
+
+/*
+the events are applied to the copy of the keys and the router is built without holding mu,
+the keys and the revision are always kept and the router is pushed only if it is valid,
+so the key waiting for the others (such as the route written before its cluster) is built by the later events
+*/
+func (c *EtcdCenter) apply(resp clientv3.WatchResponse, update UpdateHandler, logger *zerolog.Logger) error {
+	c.updating.Lock()
+	defer c.updating.Unlock()
+	c.mu.Lock()
+	kvs := maps.Clone(c.kvs)
+	last, stale := c.router, c.stale
+	c.mu.Unlock()
+
+	//the stale router misses the keys before the events, so it is built from all the keys
+	hostsonly := last != nil && !stale
+	for _, event := range resp.Events {
+		key := strings.TrimPrefix(string(event.Kv.Key), c.prefix)
+		if !strings.HasPrefix(key, etcdhosts) && !strings.HasPrefix(key, etcdclusters) {
+			hostsonly = false
+		}
+		switch event.Type {
+		case clientv3.EventTypePut:
+			kvs[string(event.Kv.Key)] = event.Kv.Value
+		case clientv3.EventTypeDelete:
+			delete(kvs, string(event.Kv.Key))
+		}
+	}
+	var (
+		router   *Router
+		regtable metadata.ProtoTable
+		err      error
+	)
+	if hostsonly {
+		router, err = c.buildhosts(last, kvs)
+	} else {
+		router, regtable, err = c.build(kvs, logger)
+	}
+	if err == nil {
+		err = router.Validate()
+	}
+	if err != nil {
+		c.commit(kvs, resp.Header.Revision, nil)
+		return err
+	}
+	c.commit(kvs, resp.Header.Revision, router)
+	update(router, regtable)
+	return nil
+}
+
+func (c *EtcdCenter) refresh(update UpdateHandler, logger *zerolog.Logger) error {
+	c.updating.Lock()
+	defer c.updating.Unlock()
+	router, regtable, err := c.load(true, logger)
+	if err != nil {
+		return err
+	}
+	update(router, regtable)
+	return nil
+}
+
+/*
+stop the watching and revoke the leases, so the registered hosts are removed at once
+*/
+func (c *EtcdCenter) Stop() {
+	c.mu.Lock()
+	leases := c.leases
+	c.leases = nil
+	c.mu.Unlock()
+	for _, lease := range leases {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		c.client.Revoke(ctx, lease)
+		cancel()
+	}
+	c.cancel()
+}
+
+/*
+the router is updated by the etcd watch, read the keys again on demand
+*/
+func (c *EtcdCenter) Watcher(sender *RegContext) {
+	if err := c.refresh(sender.Update, sender.Logger); err != nil {
+		sender.Logger.Error().Err(err).Msg(err.Error())
+		sender.Response.Write([]byte(err.Error()))
+		return
+	}
+	sender.Response.Write([]byte("the etcd reg center is refreshed"))
+}
+
+/*
+register the backend host with the lease of the ttl (seconds), the lease is kept alive until the center is stopped,
+the host is removed by etcd when the backend is down
+*/
+func (c *EtcdCenter) Register(host HostInfo, ttl int64) error {
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	lease, err := c.client.Grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	b, err := json.Marshal(host)
+	if err != nil {
+		return err
+	}
+	if _, err := c.client.Put(ctx, c.prefix+etcdhosts+host.Host, string(b), clientv3.WithLease(lease.ID)); err != nil {
+		return err
+	}
+	keepalive, err := c.client.KeepAlive(c.ctx, lease.ID)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range keepalive {
+		}
+	}()
+	c.mu.Lock()
+	c.leases = append(c.leases, lease.ID)
+	c.mu.Unlock()
+	return nil
+}
+
+/*
+put the cluster, the routers reference it by the name
+*/
+func (c *EtcdCenter) PutCluster(cluster ClusterInfo) error {
+	return c.put(etcdclusters+cluster.Name, cluster)
+}
+
+/*
+put the service, all the methods of it are routed
+*/
+func (c *EtcdCenter) PutService(service ServiceInfo) error {
+	return c.put(etcdservices+service.ServiceName, service)
+}
+
+/*
+put the router of the method
+*/
+func (c *EtcdCenter) PutRouter(router RouterInfo) error {
+	return c.put(etcdrouters+router.ServiceName+"/"+router.Method, router)
 }
 
-func NewCenter(address string) *EtcdCenter {
-	return &EtcdCenter{}
+func (c *EtcdCenter) put(key string, v any) error {
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Put(ctx, c.prefix+key, string(b))
+	return err
 }
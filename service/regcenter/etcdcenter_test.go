@@ -0,0 +1,257 @@
+package regcenter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/v3client"
+	"octopus/metadata"
+)
+
+const etcdmethod = "/proto.greeter/sayhello"
+
+func freeurl(t *testing.T) url.URL {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+/*
+start the embedded etcd in the temp dir, the client talks to the server in process
+*/
+func startetcd(t *testing.T) *clientv3.Client {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, peer := freeurl(t), freeurl(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("the etcd is not ready")
+	}
+	c := v3client.New(e.Server)
+	t.Cleanup(func() {
+		c.Close()
+		e.Close()
+	})
+	return c
+}
+
+func etcdput(t *testing.T, client *clientv3.Client, key string, v any, opts ...clientv3.OpOption) {
+	t.Helper()
+	b, err := jsoniter.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(context.Background(), key, string(b), opts...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func etcdrouter(t *testing.T, client *clientv3.Client) {
+	t.Helper()
+	etcdput(t, client, "/octopus/hosts/127.0.0.1:9000", HostInfo{Host: "127.0.0.1:9000", Weight: 1, Status: true})
+	etcdput(t, client, "/octopus/clusters/canary", ClusterInfo{Name: "canary", Hosts: []HostInfo{{Host: "127.0.0.2:9000", Weight: 1, Status: true}}})
+	etcdput(t, client, "/octopus/routers/proto.Greeter/SayHello", RouterInfo{
+		ServiceName: "proto.Greeter",
+		Method:      "SayHello",
+		Matches:     []metadata.SplitMatch{{Header: "x-canary", Cluster: "canary"}},
+	})
+}
+
+// the routers pushed by the center
+func etcdwatch(t *testing.T, center *EtcdCenter) <-chan *Router {
+	t.Helper()
+	logger := zerolog.Nop()
+	routers := make(chan *Router, 16)
+	center.Watch(func(router *Router, regtable metadata.ProtoTable) {
+		routers <- router
+	}, &logger)
+	t.Cleanup(center.Stop)
+	return routers
+}
+
+func nextrouter(t *testing.T, routers <-chan *Router, timeout time.Duration) *Router {
+	t.Helper()
+	select {
+	case router := <-routers:
+		return router
+	case <-time.After(timeout):
+		t.Fatal("the router is not updated")
+		return nil
+	}
+}
+
+func TestEtcdCenterLoad(t *testing.T) {
+	client := startetcd(t)
+	etcdrouter(t, client)
+	logger := zerolog.Nop()
+	router := NewEtcdCenterWithClient(client, "/octopus").LoadDicNoTable(&logger)
+
+	descriptor, ok := router.Descriptors[etcdmethod]
+	if !ok || len(descriptor.Matches) != 1 {
+		t.Fatalf("the descriptors are %v", router.Descriptors)
+	}
+	if _, ok := router.Hosts["127.0.0.1:9000"]; !ok || len(router.Hosts) != 1 {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+	if hosts, ok := router.ClusterHosts("canary"); !ok || hosts["127.0.0.2:9000"] == nil {
+		t.Fatalf("the clusters are %v", router.Clusters)
+	}
+	if err := router.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEtcdCenterWatch(t *testing.T) {
+	client := startetcd(t)
+	etcdrouter(t, client)
+	logger := zerolog.Nop()
+	center := NewEtcdCenterWithClient(client, "/octopus")
+	loaded := center.LoadDicNoTable(&logger)
+	routers := etcdwatch(t, center)
+
+	etcdput(t, client, "/octopus/hosts/127.0.0.1:9001", HostInfo{Host: "127.0.0.1:9001", Weight: 2, Status: true})
+	router := nextrouter(t, routers, 5*time.Second)
+	if len(router.Hosts) != 2 || router.Hosts["127.0.0.1:9001"].Weight != 2 {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+	//the host event does not build the routes again
+	if router.Descriptors[etcdmethod] != loaded.Descriptors[etcdmethod] {
+		t.Fatal("the route is built again by the host event")
+	}
+
+	if _, err := client.Delete(context.Background(), "/octopus/hosts/127.0.0.1:9000"); err != nil {
+		t.Fatal(err)
+	}
+	router = nextrouter(t, routers, 5*time.Second)
+	if _, ok := router.Hosts["127.0.0.1:9000"]; ok || len(router.Hosts) != 1 {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+
+	//the route of the unknown cluster and the broken json are not pushed, but the keys are kept
+	etcdput(t, client, "/octopus/routers/proto.Greeter/SayHi", RouterInfo{ServiceName: "proto.Greeter", Method: "SayHi", Cluster: "none"})
+	if _, err := client.Put(context.Background(), "/octopus/routers/proto.Greeter/Broken", "{"); err != nil {
+		t.Fatal(err)
+	}
+	etcdput(t, client, "/octopus/routers/proto.Greeter/SayBye", RouterInfo{ServiceName: "proto.Greeter", Method: "SayBye", Cluster: "canary"})
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case router := <-routers:
+		t.Fatalf("the wrong router is pushed: %v", router.Descriptors)
+	default:
+	}
+	center.mu.Lock()
+	_, kept := center.kvs["/octopus/routers/proto.Greeter/SayHi"]
+	center.mu.Unlock()
+	if !kept {
+		t.Fatal("the route waiting for its cluster is dropped")
+	}
+
+	//the cluster written after the route and the broken key removed, the router is built from all the keys
+	etcdput(t, client, "/octopus/clusters/none", ClusterInfo{Name: "none", Hosts: []HostInfo{{Host: "127.0.0.3:9000", Weight: 1, Status: true}}})
+	if _, err := client.Delete(context.Background(), "/octopus/routers/proto.Greeter/Broken"); err != nil {
+		t.Fatal(err)
+	}
+	router = nextrouter(t, routers, 5*time.Second)
+	if len(router.Descriptors) != 3 || router.Descriptors["/proto.greeter/sayhi"] == nil || router.Descriptors["/proto.greeter/saybye"] == nil {
+		t.Fatalf("the descriptors are %v", router.Descriptors)
+	}
+	if _, ok := router.Hosts["127.0.0.1:9001"]; !ok || len(router.Hosts) != 1 {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+	select {
+	case router := <-routers:
+		t.Fatalf("the wrong router is pushed: %v", router.Descriptors)
+	default:
+	}
+}
+
+func TestEtcdCenterLeaseExpired(t *testing.T) {
+	client := startetcd(t)
+	etcdrouter(t, client)
+	logger := zerolog.Nop()
+	center := NewEtcdCenterWithClient(client, "/octopus")
+	center.LoadDicNoTable(&logger)
+	routers := etcdwatch(t, center)
+
+	//the backend is down so the lease is not kept alive
+	lease, err := client.Grant(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcdput(t, client, "/octopus/hosts/127.0.0.1:9002", HostInfo{Host: "127.0.0.1:9002", Weight: 1, Status: true}, clientv3.WithLease(lease.ID))
+	if router := nextrouter(t, routers, 5*time.Second); router.Hosts["127.0.0.1:9002"] == nil {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+	if router := nextrouter(t, routers, 10*time.Second); router.Hosts["127.0.0.1:9002"] != nil || len(router.Hosts) != 1 {
+		t.Fatalf("the host of the expired lease is kept: %v", router.Hosts)
+	}
+
+	//the registered host is removed when the center is stopped
+	if err := center.Register(HostInfo{Host: "127.0.0.1:9003", Weight: 1, Status: true}, 5); err != nil {
+		t.Fatal(err)
+	}
+	if router := nextrouter(t, routers, 5*time.Second); router.Hosts["127.0.0.1:9003"] == nil {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+	center.Stop()
+	resp, err := client.Get(context.Background(), "/octopus/hosts/127.0.0.1:9003")
+	if err != nil || len(resp.Kvs) != 0 {
+		t.Fatalf("the registered host is kept: %v %v", resp, err)
+	}
+}
+
+func TestEtcdCenterCompacted(t *testing.T) {
+	client := startetcd(t)
+	etcdrouter(t, client)
+	logger := zerolog.Nop()
+	center := NewEtcdCenterWithClient(client, "/octopus")
+	center.LoadDicNoTable(&logger)
+
+	//the changes after the loaded revision are compacted, so the watch is broken and the keys are read again
+	var last *clientv3.PutResponse
+	for i := 0; i < 3; i++ {
+		b, _ := jsoniter.Marshal(HostInfo{Host: fmt.Sprintf("127.0.0.1:%v", 9010+i), Weight: 1, Status: true})
+		resp, err := client.Put(context.Background(), fmt.Sprintf("/octopus/hosts/127.0.0.1:%v", 9010+i), string(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = resp
+	}
+	if _, err := client.Compact(context.Background(), last.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+	routers := etcdwatch(t, center)
+	router := nextrouter(t, routers, 5*time.Second)
+	if len(router.Hosts) != 4 {
+		t.Fatalf("the hosts are %v", router.Hosts)
+	}
+	center.mu.Lock()
+	revision := center.revision
+	center.mu.Unlock()
+	if revision < last.Header.Revision {
+		t.Fatalf("the revision %v is not refreshed to %v", revision, last.Header.Revision)
+	}
+}
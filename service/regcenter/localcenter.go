@@ -0,0 +1,142 @@
+package regcenter
+
+import (
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+/*
+this is local router center implement the interface RegCenter ,
+there also can using remote registration center
+the config file is json format, it is watched and reloaded when it is changed.
+the new config is validated before it is swapped in, the old router is kept if the new one is wrong
+*/
+type LocalCenter struct {
+	path       string
+	useReflect bool
+	//the events of the file in the delay are merged into one reload
+	delay time.Duration
+	stop  chan struct{}
+	once  sync.Once
+	mu    sync.Mutex
+	v     *viper.Viper
+}
+
+func NewLocalCenter(path string) RegCenter {
+	return &LocalCenter{
+		path:  path,
+		delay: 200 * time.Millisecond,
+		stop:  make(chan struct{}),
+		v:     viper.New(),
+	}
+}
+
+func (l *LocalCenter) LoadDic(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	l.useReflect = true
+	return l.loadConfig(logger)
+}
+
+func (l *LocalCenter) LoadDicNoTable(logger *zerolog.Logger) *Router {
+	router, _ := l.loadConfig(logger)
+	return router
+}
+
+func (l *LocalCenter) loadConfig(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	router, regtable, err := l.load(logger)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	return router, regtable
+}
+
+func (l *LocalCenter) load(logger *zerolog.Logger) (*Router, metadata.ProtoTable, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cfg, err := readConfig(l.v, l.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg.BuildSysConfig(l.useReflect, logger)
+}
+
+/*
+watch the dir of the config file, so the file replaced by the editor or the deployment (rename) is still watched
+*/
+func (l *LocalCenter) Watch(update UpdateHandler, logger *zerolog.Logger) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		return
+	}
+	if err := watcher.Add(filepath.Dir(l.path)); err != nil {
+		logger.Error().Err(err).Msg(err.Error())
+		watcher.Close()
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(l.path) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					reload = time.After(l.delay)
+				}
+			case <-reload:
+				reload = nil
+				if err := l.reload(update, logger); err != nil {
+					logger.Error().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error().Err(err).Msg(err.Error())
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (l *LocalCenter) Stop() {
+	l.once.Do(func() {
+		close(l.stop)
+	})
+}
+
+func (l *LocalCenter) reload(update UpdateHandler, logger *zerolog.Logger) error {
+	router, regtable, err := l.load(logger)
+	if err != nil {
+		return err
+	}
+	if err := router.Validate(); err != nil {
+		return err
+	}
+	update(router, regtable)
+	logger.Info().Msg(fmt.Sprintf("the router config %v is reloaded", l.path))
+	return nil
+}
+
+/*
+reload the config file on demand
+*/
+func (l *LocalCenter) Watcher(sender *RegContext) {
+	if err := l.reload(sender.Update, sender.Logger); err != nil {
+		sender.Logger.Error().Err(err).Msg(err.Error())
+		sender.Response.Write([]byte(err.Error()))
+		return
+	}
+	sender.Response.Write([]byte("the local reg center is reloaded"))
+}
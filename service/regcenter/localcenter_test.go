@@ -0,0 +1,129 @@
+package regcenter
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"octopus/metadata"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// the config of the greeter methods on the host
+func localconfig(t *testing.T, path, host string, methods ...string) {
+	t.Helper()
+	routers := make([]string, 0, len(methods))
+	for _, method := range methods {
+		routers = append(routers, fmt.Sprintf(`{"ServiceName": "proto.Greeter", "Method": %q, "Host": %q}`, method, host))
+	}
+	writeconfig(t, path, fmt.Sprintf(`{"Routers": [%v]}`, strings.Join(routers, ",")))
+}
+
+func writeconfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the router of the next update, nil if there is no update in the wait
+func nextupdate(updates <-chan *Router, wait time.Duration) *Router {
+	select {
+	case router := <-updates:
+		return router
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+/*
+the writes of the config file in the delay are merged into one reload, the wrong config is not swapped in
+and the router keeps the last good one until the file is fixed
+*/
+func TestLocalCenterWatch(t *testing.T) {
+	logger := zerolog.Nop()
+	path := filepath.Join(t.TempDir(), "router.json")
+	localconfig(t, path, "127.0.0.1:9000", "SayHello")
+	center := NewLocalCenter(path).(*LocalCenter)
+	center.delay = 300 * time.Millisecond
+	defer center.Stop()
+	if router := center.LoadDicNoTable(&logger); len(router.Descriptors) != 1 {
+		t.Fatalf("the descriptors are %v", router.Descriptors)
+	}
+
+	updates := make(chan *Router, 8)
+	center.Watch(func(router *Router, regtable metadata.ProtoTable) {
+		updates <- router
+	}, &logger)
+
+	for i, methods := range [][]string{{"SayHello", "SayBye"}, {"SayBye"}, {"SayHello", "SayHi"}} {
+		localconfig(t, path, fmt.Sprintf("127.0.0.1:900%v", i+1), methods...)
+		time.Sleep(50 * time.Millisecond)
+	}
+	router := nextupdate(updates, 2*time.Second)
+	if router == nil {
+		t.Fatal("the config is not reloaded")
+	}
+	if d, ok := router.Descriptors["/proto.greeter/sayhi"]; !ok || len(router.Descriptors) != 2 || d.Host != "127.0.0.1:9003" {
+		t.Fatalf("the reloaded descriptors are %v", router.Descriptors)
+	}
+	if router := nextupdate(updates, 600*time.Millisecond); router != nil {
+		t.Fatalf("the writes are reloaded again : %v", router.Descriptors)
+	}
+
+	for _, content := range []string{`{"Routers": [`, `{"Routers": []}`} {
+		writeconfig(t, path, content)
+		if router := nextupdate(updates, 800*time.Millisecond); router != nil {
+			t.Fatalf("the wrong config %v is swapped in : %v", content, router.Descriptors)
+		}
+	}
+	localconfig(t, path, "127.0.0.1:9004", "SayBye")
+	if router := nextupdate(updates, 2*time.Second); router == nil || len(router.Descriptors) != 1 || router.Descriptors["/proto.greeter/saybye"] == nil {
+		t.Fatalf("the fixed config is not reloaded : %v", router)
+	}
+
+	center.Stop()
+	time.Sleep(100 * time.Millisecond)
+	localconfig(t, path, "127.0.0.1:9005", "SayHello")
+	if router := nextupdate(updates, 600*time.Millisecond); router != nil {
+		t.Fatalf("the stopped center is reloaded : %v", router.Descriptors)
+	}
+}
+
+/*
+the reload on demand answers the error of the wrong config without the update
+*/
+func TestLocalCenterWatcher(t *testing.T) {
+	logger := zerolog.Nop()
+	path := filepath.Join(t.TempDir(), "router.json")
+	localconfig(t, path, "127.0.0.1:9000", "SayHello")
+	center := NewLocalCenter(path)
+	var updated *Router
+	sender := func() (*RegContext, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		return &RegContext{
+			Logger:   &logger,
+			Response: w,
+			Update: func(router *Router, regtable metadata.ProtoTable) {
+				updated = router
+			},
+		}, w
+	}
+	ctx, w := sender()
+	center.Watcher(ctx)
+	if updated == nil || updated.Descriptors["/proto.greeter/sayhello"] == nil {
+		t.Fatalf("the config is not reloaded : %v", w.Body.String())
+	}
+
+	updated = nil
+	writeconfig(t, path, `{"Routers": []}`)
+	ctx, w = sender()
+	center.Watcher(ctx)
+	if updated != nil || w.Body.Len() == 0 || strings.Contains(w.Body.String(), "reloaded") {
+		t.Fatalf("the wrong config is reloaded : %v", w.Body.String())
+	}
+}
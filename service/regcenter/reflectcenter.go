@@ -0,0 +1,246 @@
+package regcenter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/pool"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+/*
+this is the router center discovering the routers by the grpc server reflection of the backend hosts,
+the hosts are read from the json config file (the Routers in the file are kept),
+every service and method of the hosts is loaded with the dynamic messages.
+the discovery is refreshed on the interval and on demand by the watcher
+*/
+type ReflectCenter struct {
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	stop     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	v        *viper.Viper
+	//the last successful reflection of the hosts, it is used when the reflection of the host fails
+	reflected map[string]reflection
+}
+
+type reflection struct {
+	services []string
+	files    []*descriptorpb.FileDescriptorProto
+}
+
+func NewReflectCenter(path string, interval time.Duration) RegCenter {
+	return &ReflectCenter{
+		path:      path,
+		interval:  interval,
+		timeout:   5 * time.Second,
+		stop:      make(chan struct{}),
+		v:         viper.New(),
+		reflected: make(map[string]reflection),
+	}
+}
+
+func (c *ReflectCenter) LoadDic(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
+	router, regtable, err := c.discover(true, logger)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	return router, regtable
+}
+
+func (c *ReflectCenter) LoadDicNoTable(logger *zerolog.Logger) *Router {
+	router, _, err := c.discover(false, logger)
+	if err != nil {
+		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	}
+	return router
+}
+
+func (c *ReflectCenter) Watch(update UpdateHandler, logger *zerolog.Logger) {
+	if c.interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.refresh(update, logger); err != nil {
+					logger.Error().Err(err).Msg(err.Error())
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *ReflectCenter) Stop() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+}
+
+/*
+refresh the discovery on demand
+*/
+func (c *ReflectCenter) Watcher(sender *RegContext) {
+	if err := c.refresh(sender.Update, sender.Logger); err != nil {
+		sender.Logger.Error().Err(err).Msg(err.Error())
+		sender.Response.Write([]byte(err.Error()))
+		return
+	}
+	sender.Response.Write([]byte("the reflect reg center is refreshed"))
+}
+
+func (c *ReflectCenter) refresh(update UpdateHandler, logger *zerolog.Logger) error {
+	router, regtable, err := c.discover(true, logger)
+	if err != nil {
+		return err
+	}
+	if err := router.Validate(); err != nil {
+		return err
+	}
+	update(router, regtable)
+	return nil
+}
+
+func (c *ReflectCenter) discover(useReflect bool, logger *zerolog.Logger) (*Router, metadata.ProtoTable, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg, err := readConfig(c.v, c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	registry, err := cfg.BuildRegistry()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	known := make(map[string]struct{})
+	for _, service := range cfg.Services {
+		known[service.ServiceName] = struct{}{}
+	}
+	//the services discovered from the hosts of the cluster are routed to the cluster,
+	//the host failed in this round keeps the services of its last successful reflection
+	reflected := make(map[string]reflection)
+	discover := func(hosts []HostInfo, cluster string) {
+		for _, host := range hosts {
+			if !host.Status {
+				continue
+			}
+			services, files, err := c.reflect(host.Host)
+			if err != nil {
+				last, ok := c.reflected[host.Host]
+				if !ok {
+					logger.Error().Err(err).Msg(fmt.Sprintf("reflect the host %v failed", host.Host))
+					continue
+				}
+				logger.Error().Err(err).Msg(fmt.Sprintf("reflect the host %v failed, the last discovered services are kept", host.Host))
+				services, files = last.services, last.files
+			}
+			reflected[host.Host] = reflection{services: services, files: files}
+			if err := registry.RegisterFileProtos(files); err != nil {
+				logger.Error().Err(err).Msg(fmt.Sprintf("reflect the host %v failed", host.Host))
+				continue
+			}
+			for _, name := range services {
+				if _, ok := known[name]; !ok {
+					known[name] = struct{}{}
+					info := ServiceInfo{
+						ServiceName: name,
+						Cluster:     cluster,
+					}
+					if len(cluster) == 0 {
+						info.Host = host.Host
+					}
+					cfg.Services = append(cfg.Services, info)
+				}
+			}
+		}
+	}
+	discover(cfg.Hosts, "")
+	for _, cluster := range cfg.Clusters {
+		discover(cluster.Hosts, cluster.Name)
+	}
+	//the hosts removed from the config are forgotten
+	c.reflected = reflected
+	return cfg.BuildSysConfigWithRegistry(registry, useReflect, logger)
+}
+
+/*
+list the services of the host and the file descriptors containing them by grpc.reflection.v1
+*/
+func (c *ReflectCenter) reflect(host string) ([]string, []*descriptorpb.FileDescriptorProto, error) {
+	conn, err := pool.Dial(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	stream, err := grpc_reflection_v1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stream.CloseSend()
+
+	resp, err := reflectRequest(stream, &grpc_reflection_v1.ServerReflectionRequest{
+		MessageRequest: &grpc_reflection_v1.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	services := make([]string, 0)
+	files := make([]*descriptorpb.FileDescriptorProto, 0)
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		name := service.GetName()
+		if strings.HasPrefix(name, "grpc.reflection.") {
+			continue
+		}
+		resp, err := reflectRequest(stream, &grpc_reflection_v1.ServerReflectionRequest{
+			MessageRequest: &grpc_reflection_v1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: name},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		//the server sends the file with its dependencies which have not been sent on the stream
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fdp := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fdp); err != nil {
+				return nil, nil, err
+			}
+			files = append(files, fdp)
+		}
+		services = append(services, name)
+	}
+	return services, files, nil
+}
+
+func reflectRequest(stream grpc_reflection_v1.ServerReflection_ServerReflectionInfoClient, req *grpc_reflection_v1.ServerReflectionRequest) (*grpc_reflection_v1.ServerReflectionResponse, error) {
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, errors.New(e.GetErrorMessage())
+	}
+	return resp, nil
+}
@@ -0,0 +1,115 @@
+package regcenter
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"octopus/metadata"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	grpcreflection "google.golang.org/grpc/reflection"
+)
+
+// the grpc server of the health service with the server reflection
+func reflectserver(t *testing.T) (string, *grpc.Server) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	grpcreflection.Register(server)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	return l.Addr().String(), server
+}
+
+func reflectconfig(t *testing.T, hosts ...string) string {
+	t.Helper()
+	infos := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		infos = append(infos, fmt.Sprintf(`{"Host": %q, "Weight": 1, "Status": true}`, host))
+	}
+	path := filepath.Join(t.TempDir(), "reflect.json")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"Hosts": [%v]}`, strings.Join(infos, ","))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/*
+the services of the hosts are discovered with the messages, the reflection service itself is not routed
+*/
+func TestReflectCenterDiscover(t *testing.T) {
+	logger := zerolog.Nop()
+	addr, _ := reflectserver(t)
+	center := NewReflectCenter(reflectconfig(t, addr), 0)
+	defer center.(*ReflectCenter).Stop()
+	router, regtable := center.LoadDic(&logger)
+	for _, key := range []string{"/grpc.health.v1.health/check", "/grpc.health.v1.health/watch"} {
+		if _, ok := router.Descriptors[key]; !ok {
+			t.Fatalf("the method %v is not discovered in %v", key, router.Descriptors)
+		}
+	}
+	if len(router.Descriptors) != 2 {
+		t.Fatalf("the descriptors are %v", router.Descriptors)
+	}
+	if d := router.Descriptors["/grpc.health.v1.health/watch"]; d.Host != addr || !d.ServerStreaming || d.RequestMessage != "grpc.health.v1.HealthCheckRequest" {
+		t.Fatalf("the watch is %+v", d)
+	}
+	for _, name := range []string{"grpc.health.v1.HealthCheckRequest", "grpc.health.v1.HealthCheckResponse"} {
+		if _, ok := regtable[name]; !ok {
+			t.Fatalf("the message %v is not in the regtable", name)
+		}
+	}
+}
+
+/*
+the host failed in the refresh keeps its last reflection, the host never reflected is skipped
+*/
+func TestReflectCenterKeepLast(t *testing.T) {
+	logger := zerolog.Nop()
+	addr, server := reflectserver(t)
+	//the port of the stopped listener refuses the reflection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+	center := NewReflectCenter(reflectconfig(t, addr, down), 0).(*ReflectCenter)
+	defer center.Stop()
+	center.timeout = 500 * time.Millisecond
+	if router := center.LoadDicNoTable(&logger); len(router.Descriptors) != 2 {
+		t.Fatalf("the descriptors are %v", router.Descriptors)
+	}
+
+	server.Stop()
+	var updated *Router
+	w := httptest.NewRecorder()
+	center.Watcher(&RegContext{
+		Logger:   &logger,
+		Response: w,
+		Update: func(router *Router, regtable metadata.ProtoTable) {
+			updated = router
+		},
+	})
+	if updated == nil {
+		t.Fatalf("the router is not refreshed : %v", w.Body.String())
+	}
+	if d, ok := updated.Descriptors["/grpc.health.v1.health/check"]; !ok || d.Host != addr {
+		t.Fatalf("the services of the failed host are not kept : %v", updated.Descriptors)
+	}
+	if _, ok := center.reflected[down]; ok {
+		t.Fatal("the host never reflected is kept")
+	}
+}
@@ -1,16 +1,22 @@
 package regcenter
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"octopus/config"
 	"octopus/metadata"
 	"octopus/pool"
 	"octopus/service/balance"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -20,6 +26,30 @@ type RegCenter interface {
 	Watcher(*RegContext)
 }
 
+/*
+the registration center which pushes the new router by itself,
+the watching is started after the router is loaded and stopped with the mash
+*/
+type WatchCenter interface {
+	RegCenter
+	Watch(update UpdateHandler, logger *zerolog.Logger)
+	Stop()
+}
+
+/*
+swap in the new router and regtable, the regtable can be nil if it is not changed
+*/
+type UpdateHandler func(router *Router, regtable metadata.ProtoTable)
+
+/*
+change the copy of the router and swap it in, the changes are serialized
+*/
+type ModifyHandler func(change func(router *Router))
+
+/*
+the Router and the Pools of the RegContext are the snapshots, they must not be changed in place,
+use the methods of the RegContext (or Modify) to change the router
+*/
 type RegContext struct {
 	*Router
 	Balance  balance.Balance
@@ -28,10 +58,204 @@ type RegContext struct {
 	Request  *http.Request
 	Response http.ResponseWriter
 	Pools    map[string]pool.Pool
+	Update   UpdateHandler
+	Modify   ModifyHandler
+}
+
+/*
+add or replace the host, the balance and the pools are synced
+*/
+func (c *RegContext) SetHost(host HostInfo) {
+	c.Modify(func(router *Router) {
+		router.Hosts[host.Host] = &host
+	})
 }
+
+func (c *RegContext) RemoveHost(addr string) {
+	c.Modify(func(router *Router) {
+		delete(router.Hosts, addr)
+	})
+}
+
+/*
+add or replace the host of the cluster, the cluster is copied so the snapshot is not changed
+*/
+func (c *RegContext) SetClusterHost(name string, host HostInfo) {
+	c.Modify(func(router *Router) {
+		if cluster, ok := router.Clusters[name]; ok {
+			cluster = cluster.Clone()
+			cluster.Hosts[host.Host] = &host
+			router.Clusters[name] = cluster
+		}
+	})
+}
+
+func (c *RegContext) RemoveClusterHost(name string, addr string) {
+	c.Modify(func(router *Router) {
+		if cluster, ok := router.Clusters[name]; ok {
+			cluster = cluster.Clone()
+			delete(cluster.Hosts, addr)
+			router.Clusters[name] = cluster
+		}
+	})
+}
+
+/*
+add or replace the route of the method
+*/
+func (c *RegContext) SetDescriptor(descriptor *metadata.Descriptor) {
+	c.Modify(func(router *Router) {
+		router.Descriptors[strings.ToLower(descriptor.GetFullMethod())] = descriptor
+	})
+}
+
+/*
+change the weighted splits of the route, such as shifting the canary traffic step by step,
+the descriptor is copied so the snapshot is not changed
+*/
+func (c *RegContext) SetSplits(fullmethod string, splits []metadata.Split) {
+	c.Modify(func(router *Router) {
+		key := strings.ToLower(fullmethod)
+		if descriptor, ok := router.Descriptors[key]; ok {
+			d := *descriptor
+			d.Splits = splits
+			router.Descriptors[key] = &d
+		}
+	})
+}
+
+/*
+remove the route and the http rules of the method
+*/
+func (c *RegContext) RemoveDescriptor(fullmethod string) {
+	c.Modify(func(router *Router) {
+		delete(router.Descriptors, strings.ToLower(fullmethod))
+		router.Rules = slices.DeleteFunc(slices.Clone(router.Rules), func(rule *metadata.HttpRule) bool {
+			return strings.EqualFold(rule.GetFullMethod(), fullmethod)
+		})
+	})
+}
+
 type RouterConfig struct {
+	Hosts []HostInfo
+	//the named upstream clusters, the Services and the Routers reference them by the Cluster
+	Clusters []ClusterInfo
+	Services []ServiceInfo
+	Routers  []RouterInfo
+	//the default timeout and max timeout of the routes without their own, such as "5s"
+	Timeout    string
+	MaxTimeout string
+	//the default timeout of the streaming routes without their own, the stream is not limited if it is empty
+	StreamTimeout string
+	//the descriptor set files created by protoc -o, the messages are built by dynamicpb
+	DescriptorSets []string
+	//the dirs of the proto files, the messages are built by dynamicpb
+	ProtoPaths []string
+}
+
+/*
+all the methods of the service are loaded from the proto descriptor,
+so there is no need to write the Routers one by one
+*/
+type ServiceInfo struct {
+	ServiceName string
+	Host        string
+	Cluster     string
+	//the canary release of the service, the matches go first and then the weighted splits
+	Splits  []metadata.Split
+	Matches []metadata.SplitMatch
+	Retry   *RetryInfo
+	//the timeout of the request and the max of the timeout requested by the client, such as "5s"
+	Timeout    string
+	MaxTimeout string
+	//the timeout of the streaming method instead of the Timeout
+	StreamTimeout string
+}
+
+/*
+the retry policy of the route, the Codes are the grpc codes such as "UNAVAILABLE" (the default),
+the durations are such as "100ms", the MaxAttempts is 2 and the backoff is 25ms to 250ms by default
+*/
+type RetryInfo struct {
+	MaxAttempts   int
+	Codes         []string
+	PerTryTimeout string
+	BaseBackoff   string
+	MaxBackoff    string
+}
+
+/*
+the timeout of the route such as "5s", the empty one is the default of the config
+*/
+func parseTimeout(value, defaultvalue string) (time.Duration, error) {
+	if len(value) == 0 {
+		value = defaultvalue
+	}
+	if len(value) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("%v is negative", value)
+	}
+	return d, err
+}
+
+func (info *RetryInfo) build() (*metadata.RetryPolicy, error) {
+	policy := &metadata.RetryPolicy{
+		MaxAttempts: info.MaxAttempts,
+		Codes:       []codes.Code{codes.Unavailable},
+		BaseBackoff: 25 * time.Millisecond,
+		MaxBackoff:  250 * time.Millisecond,
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 2
+	}
+	if len(info.Codes) > 0 {
+		policy.Codes = make([]codes.Code, 0, len(info.Codes))
+		for _, v := range info.Codes {
+			var code codes.Code
+			if err := code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(v)))); err != nil {
+				return nil, err
+			}
+			policy.Codes = append(policy.Codes, code)
+		}
+	}
+	for _, v := range []struct {
+		value string
+		d     *time.Duration
+	}{{info.PerTryTimeout, &policy.PerTryTimeout}, {info.BaseBackoff, &policy.BaseBackoff}, {info.MaxBackoff, &policy.MaxBackoff}} {
+		if len(v.value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(v.value)
+		if err != nil {
+			return nil, err
+		}
+		*v.d = d
+	}
+	return policy, nil
+}
+
+/*
+the upstream cluster has its own hosts, balance and pool options,
+the routers of the cluster are balanced among its hosts instead of the global Hosts
+*/
+type ClusterInfo struct {
+	Name    string
 	Hosts   []HostInfo
-	Routers []RouterInfo
+	Balance config.BalanceType
+	Pool    *PoolInfo
+}
+
+/*
+the pool options of the cluster, the zero value is the pool options of the mash
+*/
+type PoolInfo struct {
+	MaxIdle              int
+	MaxActive            int
+	MaxConcurrentStreams int
+	Reuse                *bool
 }
 
 type HostInfo struct {
@@ -44,22 +268,53 @@ type RouterInfo struct {
 	ServiceName string
 	Method      string
 	Host        string
-	MethodType  string
-	InMessage   string
-	OutMessage  string
+	Cluster     string
+	//the canary release of the method, the matches go first and then the weighted splits
+	Splits  []metadata.Split
+	Matches []metadata.SplitMatch
+	Retry   *RetryInfo
+	//the timeout of the request and the max of the timeout requested by the client, such as "5s"
+	Timeout    string
+	MaxTimeout string
+	//the timeout of the streaming method instead of the Timeout
+	StreamTimeout string
+	MethodType    string
+	InMessage     string
+	OutMessage    string
+	//the streaming type of the method, it is read from the proto descriptor if the method is in the registry
+	ClientStreaming bool
+	ServerStreaming bool
 }
 
 func (cfg *RouterConfig) BuildSysConfig(useReflect bool, logger *zerolog.Logger) (*Router, metadata.ProtoTable, error) {
+	registry, err := cfg.BuildRegistry()
+	if err != nil {
+		logger.Error().Msg(err.Error())
+		return nil, nil, err
+	}
+	return cfg.BuildSysConfigWithRegistry(registry, useReflect, logger)
+}
+
+/*
+build the router by the proto registry, the InMessage and OutMessage are resolved against the registry
+*/
+func (cfg *RouterConfig) BuildSysConfigWithRegistry(registry *metadata.ProtoRegistry, useReflect bool, logger *zerolog.Logger) (*Router, metadata.ProtoTable, error) {
 	descriptors := make(map[string]*metadata.Descriptor)
+	rules := make([]*metadata.HttpRule, 0)
 	var regtable metadata.ProtoTable = make(map[string]proto.Message)
 	logger.Info().Msg("Loading Router Config Begin ....")
-	for _, info := range cfg.Routers {
+	routers, err := expandServices(registry, cfg.Services, cfg.Routers)
+	if err != nil {
+		logger.Error().Msg(err.Error())
+		return nil, nil, err
+	}
+	for _, info := range routers {
 		if useReflect {
-			if err := regtable.AddProtoMessage(info.InMessage, logger); err != nil {
+			if err := regtable.AddMessage(info.InMessage, registry, logger); err != nil {
 				logger.Error().Msg(err.Error())
 				return nil, nil, err
 			}
-			if err := regtable.AddProtoMessage(info.OutMessage, logger); err != nil {
+			if err := regtable.AddMessage(info.OutMessage, registry, logger); err != nil {
 				logger.Error().Msg(err.Error())
 				return nil, nil, err
 			}
@@ -72,71 +327,280 @@ func (cfg *RouterConfig) BuildSysConfig(useReflect bool, logger *zerolog.Logger)
 				ServiceName: info.ServiceName,
 			},
 		}
+		p.Cluster = info.Cluster
+		p.Splits = info.Splits
+		p.Matches = info.Matches
+		if info.Retry != nil {
+			if p.Retry, err = info.Retry.build(); err != nil {
+				err = fmt.Errorf(config.WRONGRETRY, p.GetFullMethod(), err)
+				logger.Error().Msg(err.Error())
+				return nil, nil, err
+			}
+		}
 		p.RequestMessage = info.InMessage
 		p.ResponseMessage = info.OutMessage
+		p.ClientStreaming = info.ClientStreaming
+		p.ServerStreaming = info.ServerStreaming
+		if method, ok := findMethod(registry, p); ok {
+			p.ClientStreaming = method.IsStreamingClient()
+			p.ServerStreaming = method.IsStreamingServer()
+		}
+		//the stream (such as sse and websocket) is not limited by the Timeout of the request
+		if p.ClientStreaming || p.ServerStreaming {
+			p.Timeout, err = parseTimeout(info.StreamTimeout, cfg.StreamTimeout)
+		} else {
+			p.Timeout, err = parseTimeout(info.Timeout, cfg.Timeout)
+		}
+		if err == nil {
+			p.MaxTimeout, err = parseTimeout(info.MaxTimeout, cfg.MaxTimeout)
+		}
+		if err != nil {
+			err = fmt.Errorf(config.WRONGTIMEOUT, p.GetFullMethod(), err)
+			logger.Error().Msg(err.Error())
+			return nil, nil, err
+		}
 		key := p.GetFullMethod()
 		key = strings.ToLower(key)
 		descriptors[key] = p
+
+		httprules, err := loadHttpRules(registry, p)
+		if err != nil {
+			logger.Error().Msg(err.Error())
+			return nil, nil, err
+		}
+		rules = append(rules, httprules...)
 	}
-	hosts := make(map[string]*HostInfo)
-	for _, v := range cfg.Hosts {
-		host := v
-		hosts[host.Host] = &host
+	clusters, err := buildClusters(cfg.Clusters)
+	if err != nil {
+		logger.Error().Msg(err.Error())
+		return nil, nil, err
 	}
 	logger.Info().Msg("Loading Router Config End....")
 	return &Router{
-			Hosts:       hosts,
+			Hosts:       buildHosts(cfg.Hosts),
+			Clusters:    clusters,
 			Descriptors: descriptors,
+			Rules:       rules,
+			Registry:    registry,
 		},
 		regtable, nil
 }
 
+/*
+the clusters must have the unique names
+*/
+func buildClusters(infos []ClusterInfo) (map[string]*Cluster, error) {
+	clusters := make(map[string]*Cluster)
+	for _, info := range infos {
+		if _, ok := clusters[info.Name]; ok || len(info.Name) == 0 {
+			return nil, fmt.Errorf(config.WRONGCLUSTER, info.Name)
+		}
+		clusters[info.Name] = &Cluster{
+			Name:    info.Name,
+			Hosts:   buildHosts(info.Hosts),
+			Balance: info.Balance,
+			Pool:    info.Pool,
+		}
+	}
+	return clusters, nil
+}
+
+func buildHosts(infos []HostInfo) map[string]*HostInfo {
+	hosts := make(map[string]*HostInfo)
+	for _, v := range infos {
+		host := v
+		hosts[host.Host] = &host
+	}
+	return hosts
+}
+
+/*
+build the proto registry by loading the descriptor set files and the proto files
+*/
+func (cfg *RouterConfig) BuildRegistry() (*metadata.ProtoRegistry, error) {
+	registry := metadata.NewProtoRegistry()
+	for _, path := range cfg.DescriptorSets {
+		if err := registry.LoadDescriptorSet(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range cfg.ProtoPaths {
+		if err := registry.LoadProtoFiles(path); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
 type Router struct {
 	Descriptors map[string]*metadata.Descriptor
 	Hosts       map[string]*HostInfo
+	//the named upstream clusters of the routers
+	Clusters map[string]*Cluster
+	//the http rules read from the google.api.http option
+	Rules []*metadata.HttpRule
+	//the proto descriptors of the routers
+	Registry *metadata.ProtoRegistry
+}
+
+type Cluster struct {
+	Name    string
+	Hosts   map[string]*HostInfo
+	Balance config.BalanceType
+	Pool    *PoolInfo
 }
 
 /*
-this is local router center implement the interface RegCenter ,
-there also can using remote registration center
-the config file is json format
+copy the cluster, the hosts map is new but the hosts are shared
 */
-type LocalCenter struct {
-	path string
+func (c *Cluster) Clone() *Cluster {
+	cluster := *c
+	cluster.Hosts = maps.Clone(c.Hosts)
+	if cluster.Hosts == nil {
+		cluster.Hosts = make(map[string]*HostInfo)
+	}
+	return &cluster
 }
 
-func NewLocalCenter(path string) RegCenter {
-	return &LocalCenter{
-		path: path,
+/*
+copy the router, the maps are new but the descriptors, the hosts and the clusters are shared,
+so replace them instead of changing them in place
+*/
+func (r *Router) Clone() *Router {
+	router := &Router{
+		Descriptors: make(map[string]*metadata.Descriptor, len(r.Descriptors)),
+		Hosts:       make(map[string]*HostInfo, len(r.Hosts)),
+		Clusters:    make(map[string]*Cluster, len(r.Clusters)),
+		Rules:       r.Rules,
+		Registry:    r.Registry,
 	}
+	for k, v := range r.Descriptors {
+		router.Descriptors[k] = v
+	}
+	for k, v := range r.Hosts {
+		router.Hosts[k] = v
+	}
+	for k, v := range r.Clusters {
+		router.Clusters[k] = v
+	}
+	return router
 }
 
-func (l *LocalCenter) LoadDic(logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
-	return l.loadConfig(true, logger)
+/*
+the hosts of the cluster, the "" is the global Hosts
+*/
+func (r *Router) ClusterHosts(name string) (map[string]*HostInfo, bool) {
+	if len(name) == 0 {
+		return r.Hosts, true
+	}
+	if cluster, ok := r.Clusters[name]; ok {
+		return cluster.Hosts, true
+	}
+	return nil, false
 }
 
-func (l *LocalCenter) LoadDicNoTable(logger *zerolog.Logger) *Router {
-	router, _ := l.loadConfig(false, logger)
-	return router
+/*
+the hosts of the global Hosts and all the clusters, the host is available if it is available in any of them
+*/
+func (r *Router) AllHosts() map[string]*HostInfo {
+	hosts := maps.Clone(r.Hosts)
+	if hosts == nil {
+		hosts = make(map[string]*HostInfo)
+	}
+	for _, cluster := range r.Clusters {
+		for k, v := range cluster.Hosts {
+			if host, ok := hosts[k]; !ok || (!host.Status && v.Status) {
+				hosts[k] = v
+			}
+		}
+	}
+	return hosts
 }
 
-func (l *LocalCenter) loadConfig(useReflect bool, logger *zerolog.Logger) (*Router, metadata.ProtoTable) {
-	viper.SetConfigFile(l.path)
-	err := viper.ReadInConfig()
-	if err != nil {
-		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, l.path))
+/*
+match the http request with the google.api.http rules
+*/
+func (r *Router) MatchRule(httpmethod, path string) (*metadata.HttpRule, map[string]string, bool) {
+	for _, rule := range r.Rules {
+		if vars, ok := rule.Match(httpmethod, path); ok {
+			return rule, vars, true
+		}
 	}
-	var cfg RouterConfig
-	if err := viper.Unmarshal(&cfg); err != nil {
-		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	return nil, nil, false
+}
+
+/*
+check the router before it is swapped in, the router without any route or any available host is refused,
+the clusters of the route (and its splits and matches) must exist and have the available host
+*/
+func (r *Router) Validate() error {
+	if len(r.Descriptors) == 0 {
+		return errors.New(config.NOROUTER)
 	}
-	router, regtable, err := cfg.BuildSysConfig(useReflect, logger)
-	if err != nil {
-		logger.Panic().Err(err).Msg(fmt.Sprintf(config.CONFIGFILEERROR, err.Error()))
+	for k, v := range r.Descriptors {
+		total := 0
+		for _, split := range v.Splits {
+			if split.Weight < 0 {
+				return fmt.Errorf(config.WRONGSPLIT, k)
+			}
+			total += split.Weight
+			if err := r.validateCluster(k, split.Cluster); err != nil {
+				return err
+			}
+		}
+		if len(v.Splits) > 0 && total == 0 {
+			return fmt.Errorf(config.WRONGSPLIT, k)
+		}
+		for _, match := range v.Matches {
+			if err := r.validateCluster(k, match.Cluster); err != nil {
+				return err
+			}
+		}
+		if len(v.Cluster) > 0 {
+			if err := r.validateCluster(k, v.Cluster); err != nil {
+				return err
+			}
+		} else if len(r.Hosts) == 0 && len(v.Host) == 0 && len(v.Splits) == 0 {
+			return fmt.Errorf(config.NOROUTERHOST, k)
+		}
+	}
+	if len(r.Hosts) > 0 && !available(r.Hosts) {
+		return errors.New(config.NOHOST)
 	}
-	return router, regtable
+	return nil
 }
 
-func (l *LocalCenter) Watcher(sender *RegContext) {
-	sender.Response.Write([]byte("this is local reg center"))
+func (r *Router) validateCluster(key, name string) error {
+	cluster, ok := r.Clusters[name]
+	if !ok {
+		return fmt.Errorf(config.NOCLUSTER, name, key)
+	}
+	if !available(cluster.Hosts) {
+		return fmt.Errorf(config.NOCLUSTERHOST, name)
+	}
+	return nil
+}
+
+func available(hosts map[string]*HostInfo) bool {
+	for _, v := range hosts {
+		if v.Status {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+read the json config file by the viper instance of the reg center
+*/
+func readConfig(v *viper.Viper, path string) (*RouterConfig, error) {
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var cfg RouterConfig
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
 }
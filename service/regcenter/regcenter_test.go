@@ -0,0 +1,93 @@
+package regcenter
+
+import (
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+the streaming route is limited by the StreamTimeout instead of the Timeout, the MaxTimeout only limits the timeout of the client
+*/
+func TestStreamTimeout(t *testing.T) {
+	logger := zerolog.Nop()
+	cfg := &RouterConfig{
+		Hosts:      []HostInfo{{Host: "127.0.0.1:9000", Weight: 1, Status: true}},
+		Timeout:    "5s",
+		MaxTimeout: "30s",
+		Routers: []RouterInfo{
+			{ServiceName: "proto.Greeter", Method: "SayHello"},
+			{ServiceName: "proto.Greeter", Method: "Watch", ServerStreaming: true},
+			{ServiceName: "proto.Greeter", Method: "Chat", ClientStreaming: true, StreamTimeout: "1m", MaxTimeout: "2m"},
+		},
+	}
+	router, _, err := cfg.BuildSysConfig(false, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]time.Duration{
+		"/proto.greeter/sayhello": 5 * time.Second,
+		"/proto.greeter/watch":    0,
+		"/proto.greeter/chat":     time.Minute,
+	} {
+		if got := router.Descriptors[method].EffectiveTimeout(0); got != want {
+			t.Fatalf("the timeout of %v is %v, want %v", method, got, want)
+		}
+	}
+	if got := router.Descriptors["/proto.greeter/watch"].EffectiveTimeout(time.Hour); got != 30*time.Second {
+		t.Fatalf("the timeout requested by the client is %v", got)
+	}
+}
+
+func TestRouterValidate(t *testing.T) {
+	hosts := func(status bool) map[string]*HostInfo {
+		return map[string]*HostInfo{"127.0.0.1:9000": {Host: "127.0.0.1:9000", Weight: 1, Status: status}}
+	}
+	router := func(d *metadata.Descriptor, global bool) *Router {
+		d.URI = &metadata.URI{ServiceName: "proto.Greeter", Method: "SayHello"}
+		r := &Router{
+			Descriptors: map[string]*metadata.Descriptor{"/proto.greeter/sayhello": d},
+			Clusters: map[string]*Cluster{
+				"v1":   {Name: "v1", Hosts: hosts(true)},
+				"v2":   {Name: "v2", Hosts: hosts(true)},
+				"down": {Name: "down", Hosts: hosts(false)},
+			},
+		}
+		if global {
+			r.Hosts = hosts(true)
+		}
+		return r
+	}
+	for _, v := range []struct {
+		name   string
+		router *Router
+		err    string
+	}{
+		{"cluster", router(&metadata.Descriptor{Cluster: "v1"}, false), ""},
+		{"global hosts", router(&metadata.Descriptor{}, true), ""},
+		{"splits", router(&metadata.Descriptor{Splits: []metadata.Split{{Cluster: "v1", Weight: 95}, {Cluster: "v2", Weight: 5}}}, false), ""},
+		{"no router", &Router{}, config.NOROUTER},
+		{"unknown cluster", router(&metadata.Descriptor{Cluster: "v3"}, true), fmt.Sprintf(config.NOCLUSTER, "v3", "/proto.greeter/sayhello")},
+		{"unknown split", router(&metadata.Descriptor{Splits: []metadata.Split{{Cluster: "v1", Weight: 1}, {Cluster: "v3", Weight: 1}}}, true), fmt.Sprintf(config.NOCLUSTER, "v3", "/proto.greeter/sayhello")},
+		{"unknown match", router(&metadata.Descriptor{Cluster: "v1", Matches: []metadata.SplitMatch{{Header: "x-canary", Cluster: "v3"}}}, false), fmt.Sprintf(config.NOCLUSTER, "v3", "/proto.greeter/sayhello")},
+		{"cluster down", router(&metadata.Descriptor{Cluster: "down"}, true), fmt.Sprintf(config.NOCLUSTERHOST, "down")},
+		{"negative split", router(&metadata.Descriptor{Splits: []metadata.Split{{Cluster: "v1", Weight: 2}, {Cluster: "v2", Weight: -1}}}, false), fmt.Sprintf(config.WRONGSPLIT, "/proto.greeter/sayhello")},
+		{"zero splits", router(&metadata.Descriptor{Splits: []metadata.Split{{Cluster: "v1"}, {Cluster: "v2"}}}, false), fmt.Sprintf(config.WRONGSPLIT, "/proto.greeter/sayhello")},
+		{"no host", router(&metadata.Descriptor{}, false), fmt.Sprintf(config.NOROUTERHOST, "/proto.greeter/sayhello")},
+	} {
+		err := v.router.Validate()
+		if (err == nil && len(v.err) > 0) || (err != nil && err.Error() != v.err) {
+			t.Fatalf("the %v is validated with %v instead of %q", v.name, err, v.err)
+		}
+	}
+	//the global hosts all down
+	r := router(&metadata.Descriptor{Cluster: "v1"}, false)
+	r.Hosts = hosts(false)
+	if err := r.Validate(); err == nil || err.Error() != config.NOHOST {
+		t.Fatalf("the router without the available host is validated with %v", err)
+	}
+}
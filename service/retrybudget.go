@@ -0,0 +1,72 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+type retrybucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+/*
+the retry budget limits the retries to the ratio of the requests in the window (seconds),
+and the min retries per second are always allowed, so the retries never make a storm when the backends are down
+*/
+type RetryBudget struct {
+	ratio   float64
+	min     int
+	mu      sync.Mutex
+	buckets []retrybucket
+}
+
+/*
+such as NewRetryBudget(0.2, 10, 10*time.Second), the retries are at most 20% of the requests plus 10 per second
+*/
+func NewRetryBudget(ratio float64, minpersecond int, window time.Duration) *RetryBudget {
+	return &RetryBudget{
+		ratio:   ratio,
+		min:     minpersecond,
+		buckets: make([]retrybucket, max(int(window/time.Second), 1)),
+	}
+}
+
+func (b *RetryBudget) bucket(second int64) *retrybucket {
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = retrybucket{second: second}
+	}
+	return bucket
+}
+
+/*
+the request is counted in the budget
+*/
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now().Unix()).requests++
+}
+
+/*
+the retry is allowed if the retries of the window are under the budget
+*/
+func (b *RetryBudget) withdraw() bool {
+	now := time.Now().Unix()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, retries := 0, 0
+	for _, v := range b.buckets {
+		if v.second > now-int64(len(b.buckets)) {
+			requests += v.requests
+			retries += v.retries
+		}
+	}
+	if float64(retries+1) > b.ratio*float64(requests)+float64(b.min*len(b.buckets)) {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
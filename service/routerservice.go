@@ -2,11 +2,14 @@ package service
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"octopus/config"
 	"octopus/metadata"
@@ -15,13 +18,18 @@ import (
 	"octopus/service/regcenter"
 	"octopus/service/ware"
 
+	jsoniter "github.com/json-iterator/go"
 	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
 /*
 this option is used to set the balance if you have more than one backend server
-balancetype usually has three mode balance.None (means nil) balance.RoundRobin balance.WeightRobin
+balancetype usually has three mode balance.None (means nil) balance.RoundRobin balance.WeightRobin,
+config.LeastRequest and config.P2CEWMA use the in-flight requests and the latency fed back by the mash
 */
 func WithBalance(balancetype config.BalanceType) metadata.OptionBuilder[RouterService] {
 	return func(rs *RouterService) {
@@ -29,16 +37,26 @@ func WithBalance(balancetype config.BalanceType) metadata.OptionBuilder[RouterSe
 	}
 }
 
+/*
+this option is used to set the consistent hash balance, the same key goes to the same host while the hosts join and leave,
+the key can be balance.HeaderKey, balance.PayloadKey, balance.ParamKey or balance.ClientIPKey (config.ConsistentHash)
+*/
+func WithHashBalance(key balance.HashKey) metadata.OptionBuilder[RouterService] {
+	return func(rs *RouterService) {
+		rs.balance = balance.NewConsistentHash(key, rs.logger)
+	}
+}
+
 /*
 this option is used to set the regCenter
 note if you do not set the regtable by using WithRegisterMessage frist, the method will fill the regtable
 */
 func WithRegCenter(center regcenter.RegCenter) metadata.OptionBuilder[RouterService] {
 	return func(rs *RouterService) {
-		if rs.mashtype == config.Http && (rs.regtable == nil || len(rs.regtable) == 0) {
-			rs.Router, rs.regtable = center.LoadDic(rs.logger)
+		if regtable := rs.GetDic(); rs.mashtype == config.Http && len(regtable) == 0 {
+			rs.store(center.LoadDic(rs.logger))
 		} else {
-			rs.Router = center.LoadDicNoTable(rs.logger)
+			rs.store(center.LoadDicNoTable(rs.logger), regtable)
 		}
 		rs.regcenter = center
 	}
@@ -55,7 +73,7 @@ func WithRegisterMessage(protomessages ...proto.Message) metadata.OptionBuilder[
 			typeOfMessage = typeOfMessage.Elem()
 			regtable[typeOfMessage.String()] = proto
 		}
-		rs.regtable = regtable
+		rs.store(rs.GetRouter(), regtable)
 	}
 }
 
@@ -68,78 +86,402 @@ func WithHookWhite(hostName ...string) metadata.OptionBuilder[RouterService] {
 	}
 }
 
+/*
+this option is used to listen the router swapped in by the regcenter, such as syncing the connection pools
+*/
+func WithUpdateListener(listener func(router *regcenter.Router)) metadata.OptionBuilder[RouterService] {
+	return func(rs *RouterService) {
+		rs.listeners = append(rs.listeners, listener)
+	}
+}
+
+/*
+this option is used to probe the hosts by grpc.health.v1, the unhealthy hosts are removed from the balance
+*/
+func WithHealthCheck(checker *HealthChecker) metadata.OptionBuilder[RouterService] {
+	return func(rs *RouterService) {
+		rs.health = checker
+	}
+}
+
+/*
+this option is used to eject the outlier hosts by the outcomes of the requests, the mash records the outcomes by Record
+*/
+func WithOutlierDetection(detector *OutlierDetector) metadata.OptionBuilder[RouterService] {
+	return func(rs *RouterService) {
+		rs.outlier = detector
+	}
+}
+
+/*
+this option is used to set the global retry budget of the routes, it is NewRetryBudget(0.2, 10, 10*time.Second) by default
+*/
+func WithRetryBudget(budget *RetryBudget) metadata.OptionBuilder[RouterService] {
+	return func(rs *RouterService) {
+		rs.budget = budget
+	}
+}
+
 type RouterService struct {
-	*regcenter.Router
+	table atomic.Pointer[routertable]
+	//serialize the updates of the router
+	mu        sync.Mutex
+	listeners []func(router *regcenter.Router)
 	hookwhite []string
-	regtable  metadata.ProtoTable
 	balance   balance.Balance
+	//the balances of the clusters, they are copied on write
+	balances  atomic.Pointer[map[string]balance.Balance]
+	health    *HealthChecker
+	outlier   *OutlierDetector
+	budget    *RetryBudget
 	regcenter regcenter.RegCenter
 	mashtype  config.MashType
 	logger    *zerolog.Logger
 }
 
+/*
+the router and the regtable are swapped together when the regcenter pushes the new router
+*/
+type routertable struct {
+	*regcenter.Router
+	regtable metadata.ProtoTable
+}
+
 func NewRouterService(logger *zerolog.Logger, mashtype config.MashType, builders ...metadata.OptionBuilder[RouterService]) *RouterService {
 	rs := &RouterService{
 		logger:   logger,
 		balance:  balance.NewBalance(config.RoundRobin, logger),
+		budget:   NewRetryBudget(0.2, 10, 10*time.Second),
 		mashtype: mashtype,
 	}
+	rs.store(&regcenter.Router{
+		Descriptors: make(map[string]*metadata.Descriptor),
+		Hosts:       make(map[string]*regcenter.HostInfo),
+	}, nil)
 
 	metadata.LoadOption(rs, builders...)
-	if len(rs.regtable) == 0 && rs.mashtype != config.Grpc {
+	if len(rs.GetDic()) == 0 && rs.mashtype != config.Grpc {
 		rs.logger.Panic().Msg(config.NOMESSAGETABLE)
 	}
 
-	for k, v := range rs.Hosts {
-		if v.Status {
-			rs.balance.Add(k, v.Weight)
-		}
+	router := rs.GetRouter()
+	balances := rs.newbalances(nil, router)
+	rs.balances.Store(&balances)
+	rs.each(router, func(b balance.Balance, hosts map[string]*regcenter.HostInfo) {
+		rs.addhosts(b, hosts)
+	})
+	if center, ok := rs.regcenter.(regcenter.WatchCenter); ok {
+		center.Watch(rs.Update, rs.logger)
+	}
+	if rs.health != nil {
+		rs.health.start(rs.GetRouter, rs.sethealth, rs.logger)
+	}
+	if rs.outlier != nil {
+		rs.outlier.start(rs.GetRouter, rs.setejected, rs.rampweight, rs.logger)
 	}
 	return rs
 }
 
+func (rs *RouterService) store(router *regcenter.Router, regtable metadata.ProtoTable) {
+	rs.table.Store(&routertable{
+		Router:   router,
+		regtable: regtable,
+	})
+}
+
+/*
+get the router
+*/
+func (rs *RouterService) GetRouter() *regcenter.Router {
+	return rs.table.Load().Router
+}
+
 /*
 get the regtable
 */
 func (rs *RouterService) GetDic() map[string]proto.Message {
-	return rs.regtable
+	return rs.table.Load().regtable
+}
+
+/*
+match the http request with the google.api.http rules of the router
+*/
+func (rs *RouterService) MatchRule(httpmethod, path string) (*metadata.HttpRule, map[string]string, bool) {
+	return rs.GetRouter().MatchRule(httpmethod, path)
+}
+
+/*
+swap in the new router pushed by the regcenter, the regtable is kept if the new one is empty.
+the hosts added or removed are synced to the balance
+*/
+func (rs *RouterService) Update(router *regcenter.Router, regtable metadata.ProtoTable) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.update(router, regtable)
+}
+
+/*
+change the copy of the current router and swap it in
+*/
+func (rs *RouterService) Modify(change func(router *regcenter.Router)) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	router := rs.GetRouter().Clone()
+	change(router)
+	rs.update(router, nil)
+}
+
+/*
+the removed hosts leave the balance first and the added hosts join it after the listeners (the pools) are ready,
+the balance of the cluster is created again if the cluster is new or its balance type is changed
+*/
+func (rs *RouterService) update(router *regcenter.Router, regtable metadata.ProtoTable) {
+	old := rs.table.Load()
+	if len(regtable) == 0 {
+		regtable = old.regtable
+	}
+	balances := rs.newbalances(old.Router, router)
+
+	rs.removehosts(rs.balance, old.Hosts, router.Hosts)
+	for name, cluster := range old.Clusters {
+		if b, ok := balances[name]; ok && b == rs.getbalances()[name] {
+			rs.removehosts(b, cluster.Hosts, router.Clusters[name].Hosts)
+		}
+	}
+	for _, listener := range rs.listeners {
+		listener(router)
+	}
+	rs.balances.Store(&balances)
+	rs.store(router, regtable)
+	rs.each(router, func(b balance.Balance, hosts map[string]*regcenter.HostInfo) {
+		rs.addhosts(b, hosts)
+	})
+}
+
+/*
+the balances of the clusters of the new router, the balances of the old router are kept if they are not changed,
+the new balances are filled before they are swapped in
+*/
+func (rs *RouterService) newbalances(old, router *regcenter.Router) map[string]balance.Balance {
+	current := rs.getbalances()
+	balances := make(map[string]balance.Balance, len(router.Clusters))
+	for name, cluster := range router.Clusters {
+		if b, ok := current[name]; ok && old != nil && old.Clusters[name] != nil && old.Clusters[name].Balance == cluster.Balance {
+			balances[name] = b
+			continue
+		}
+		b := balance.NewBalance(cluster.Balance, rs.logger)
+		rs.addhosts(b, cluster.Hosts)
+		balances[name] = b
+	}
+	return balances
+}
+
+func (rs *RouterService) getbalances() map[string]balance.Balance {
+	if balances := rs.balances.Load(); balances != nil {
+		return *balances
+	}
+	return nil
+}
+
+/*
+call the fn with the balance and the hosts of the global Hosts and every cluster
+*/
+func (rs *RouterService) each(router *regcenter.Router, fn func(b balance.Balance, hosts map[string]*regcenter.HostInfo)) {
+	fn(rs.balance, router.Hosts)
+	balances := rs.getbalances()
+	for name, cluster := range router.Clusters {
+		if b, ok := balances[name]; ok {
+			fn(b, cluster.Hosts)
+		}
+	}
+}
+
+func (rs *RouterService) removehosts(b balance.Balance, old, hosts map[string]*regcenter.HostInfo) {
+	for k := range old {
+		if v, ok := hosts[k]; !ok || !v.Status {
+			b.Remove(k)
+		}
+	}
+}
+
+func (rs *RouterService) addhosts(b balance.Balance, hosts map[string]*regcenter.HostInfo) {
+	for k, v := range hosts {
+		if v.Status && rs.available(k) {
+			b.Add(k, v.Weight)
+		}
+	}
+}
+
+/*
+the host is healthy and not ejected
+*/
+func (rs *RouterService) available(host string) bool {
+	return (rs.health == nil || rs.health.Healthy(host)) && (rs.outlier == nil || !rs.outlier.Ejected(host))
+}
+
+/*
+add or remove the host of the current router by the health and the ejection, it returns true if the host is added
+*/
+func (rs *RouterService) sync(host string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	added := false
+	rs.each(rs.GetRouter(), func(b balance.Balance, hosts map[string]*regcenter.HostInfo) {
+		if v, ok := hosts[host]; ok && v.Status && rs.available(host) {
+			b.Add(host, v.Weight)
+			added = true
+		} else {
+			b.Remove(host)
+		}
+	})
+	return added
+}
+
+func (rs *RouterService) sethealth(host string, healthy bool) {
+	rs.sync(host)
+}
+
+/*
+the ejected host is taken out of the balances, the returned host is restored from the weight of the slow start step
+*/
+func (rs *RouterService) setejected(host string, ejected bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.each(rs.GetRouter(), func(b balance.Balance, hosts map[string]*regcenter.HostInfo) {
+		v, ok := hosts[host]
+		switch {
+		case ejected:
+			b.Eject(host)
+		case ok && v.Status && rs.available(host):
+			b.Restore(host, v.Weight, rs.outlier.step)
+		default:
+			b.Remove(host)
+		}
+	})
+}
+
+func (rs *RouterService) rampweight(host string, step int) {
+	rs.each(rs.GetRouter(), func(b balance.Balance, hosts map[string]*regcenter.HostInfo) {
+		b.SetWegiht(step, host)
+	})
+}
+
+/*
+record the outcome of the request to the host for the outlier detection, the latency of the streaming request is 0
+*/
+func (rs *RouterService) Record(host string, err error, latency time.Duration) {
+	if rs.outlier != nil {
+		rs.outlier.record(host, err, latency)
+	}
+}
+
+/*
+stop the regcenter watching
+*/
+func (rs *RouterService) Stop() {
+	if rs.health != nil {
+		rs.health.Stop()
+	}
+	if rs.outlier != nil {
+		rs.outlier.Stop()
+	}
+	if center, ok := rs.regcenter.(regcenter.WatchCenter); ok {
+		center.Stop()
+	}
 }
 
 func (rs *RouterService) MatcherUnit() ware.HandlerUnit {
 	return func(ctx context.Context, data *metadata.MetaData) error {
+		router := rs.GetRouter()
 		key := strings.ToLower(data.Descriptor.GetFullMethod())
-		descriptor, ok := rs.Descriptors[key]
+		descriptor, ok := router.Descriptors[key]
 		if !ok {
-			return errors.New(config.NOROUTER)
+			return status.Error(codes.NotFound, config.NOROUTER)
 		}
 
 		data.Descriptor.Method = descriptor.Method
 		data.Descriptor.ServiceName = descriptor.ServiceName
 		data.Descriptor.RequestMessage = descriptor.RequestMessage
 		data.Descriptor.ResponseMessage = descriptor.ResponseMessage
+		data.Descriptor.ClientStreaming = descriptor.ClientStreaming
+		data.Descriptor.ServerStreaming = descriptor.ServerStreaming
 
-		var addr string
-		if len(rs.Hosts) == 0 {
-			addr = descriptor.Host
-		} else if len(rs.balance.GetAllAddress()) > 0 {
-			addr = rs.balance.Next()
-		}
+		data.Descriptor.Retry = descriptor.Retry
+		data.Descriptor.MaxTimeout = descriptor.MaxTimeout
+		data.Descriptor.Timeout = descriptor.EffectiveTimeout(data.RequestTimeout(ctx))
+		//the cluster of the canary release is picked by the matches and the weighted splits
+		data.Descriptor.Cluster = descriptor.Destination(data)
+
+		addr, done := rs.next(router, descriptor, data)
 		if len(addr) == 0 {
-			return errors.New(config.NOHOST)
+			return status.Error(codes.Unavailable, config.NOHOST)
 		}
+		rs.budget.deposit()
 
-		data.Target = addr
+		data.Target, data.Done = addr, done
 		return nil
 	}
 }
 
+/*
+the host of the request by the balance of its cluster, or the global balance, or the Host of the route if there is no global host
+*/
+func (rs *RouterService) next(router *regcenter.Router, descriptor *metadata.Descriptor, data *metadata.MetaData) (string, balance.Done) {
+	if cluster := data.Descriptor.Cluster; len(cluster) > 0 {
+		if b, ok := rs.getbalances()[cluster]; ok {
+			return b.Next(data)
+		}
+	} else if len(router.Hosts) == 0 {
+		return descriptor.Host, nil
+	} else if len(rs.balance.GetAllAddress()) > 0 {
+		return rs.balance.Next(data)
+	}
+	return "", nil
+}
+
+/*
+the failed attempt (starting from 1) can be retried by the retry policy of the route and the retry budget
+*/
+func (rs *RouterService) Retryable(data *metadata.MetaData, attempt int, err error) bool {
+	policy := data.Descriptor.Retry
+	return policy != nil && policy.Retryable(attempt, err) && rs.budget.withdraw()
+}
+
+/*
+pick another host of the balance for the retry, the tried hosts are avoided if there is any other,
+the done of the last host must have been called
+*/
+func (rs *RouterService) Retarget(data *metadata.MetaData, tried []string) bool {
+	router := rs.GetRouter()
+	descriptor, ok := router.Descriptors[strings.ToLower(data.Descriptor.GetFullMethod())]
+	if !ok {
+		return false
+	}
+	var (
+		addr string
+		done balance.Done
+	)
+	for i := 0; i < len(tried)+2; i++ {
+		if done != nil {
+			done(context.Canceled)
+		}
+		if addr, done = rs.next(router, descriptor, data); len(addr) == 0 {
+			return false
+		}
+		if !slices.Contains(tried, addr) {
+			break
+		}
+	}
+	data.Target, data.Done = addr, done
+	return true
+}
+
 func (rs *RouterService) BuildWare() ware.Middleware {
 	return func(next ware.HandlerUnit) ware.HandlerUnit {
 		return func(ctx context.Context, data *metadata.MetaData) error {
 			if err := rs.MatcherUnit()(ctx, data); err != nil {
-				data.Result = metadata.ErrorMeta{
-					Error: err.Error(),
-				}
+				data.Result = metadata.ToErrorMeta(err)
 				data.Logger.Error().Msg(err.Error() + " url:" + data.Descriptor.GetFullMethod())
 				return nil
 			} else {
@@ -149,7 +491,10 @@ func (rs *RouterService) BuildWare() ware.Middleware {
 	}
 }
 
-func (rs *RouterService) Watcher(response http.ResponseWriter, request *http.Request, pools map[string]pool.Pool) {
+/*
+the hook request must be from the white list if it is set
+*/
+func (rs *RouterService) hooked(response http.ResponseWriter, request *http.Request) bool {
 	if len(rs.hookwhite) > 0 {
 		host := request.RemoteAddr
 		isIn := false
@@ -160,17 +505,65 @@ func (rs *RouterService) Watcher(response http.ResponseWriter, request *http.Req
 		}
 		if !isIn {
 			http.Error(response, fmt.Sprintf(config.HOOKHOST, host), http.StatusInternalServerError)
-			return
+			return false
 		}
 	}
+	return true
+}
+
+func (rs *RouterService) Watcher(response http.ResponseWriter, request *http.Request, pools map[string]pool.Pool) {
+	if !rs.hooked(response, request) {
+		return
+	}
 
 	rs.regcenter.Watcher(&regcenter.RegContext{
-		Router:   rs.Router,
+		Router:   rs.GetRouter(),
 		Balance:  rs.balance,
-		RegTable: rs.regtable,
+		RegTable: rs.GetDic(),
+		Update:   rs.Update,
+		Modify:   rs.Modify,
 		Logger:   rs.logger,
 		Response: response,
 		Request:  request,
-		Pools:    pools,
+		Pools:    maps.Clone(pools),
 	})
 }
+
+/*
+show the health states, the ejected hosts and the hosts in the balance
+*/
+func (rs *RouterService) Health(response http.ResponseWriter, request *http.Request) {
+	if !rs.hooked(response, request) {
+		return
+	}
+	status := make([]HostHealth, 0)
+	if rs.health != nil {
+		status = rs.health.Status()
+	}
+	ejected := make([]string, 0)
+	if rs.outlier != nil {
+		ejected = rs.outlier.EjectedHosts()
+	}
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	clusters := make(map[string][]string)
+	for name, b := range rs.getbalances() {
+		clusters[name] = b.GetAllAddress()
+	}
+	b, err := json.Marshal(struct {
+		Hosts    []HostHealth
+		Ejected  []string
+		Balance  []string
+		Clusters map[string][]string
+	}{
+		Hosts:    status,
+		Ejected:  ejected,
+		Balance:  rs.balance.GetAllAddress(),
+		Clusters: clusters,
+	})
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(b)
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"octopus/config"
+	"octopus/metadata"
+	"octopus/pool"
+	"octopus/service/regcenter"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the static regcenter of the test, the router is changed by the RegContext
+type testcenter struct {
+	router *regcenter.Router
+}
+
+func (c *testcenter) LoadDic(logger *zerolog.Logger) (*regcenter.Router, metadata.ProtoTable) {
+	return c.router, nil
+}
+
+func (c *testcenter) LoadDicNoTable(logger *zerolog.Logger) *regcenter.Router {
+	return c.router
+}
+
+func (c *testcenter) Watcher(*regcenter.RegContext) {}
+
+func testrouter() *regcenter.Router {
+	hosts := func(prefix string) map[string]*regcenter.HostInfo {
+		m := make(map[string]*regcenter.HostInfo)
+		for i := 0; i < 3; i++ {
+			addr := fmt.Sprintf("%v:%v", prefix, 9000+i)
+			m[addr] = &regcenter.HostInfo{Host: addr, Weight: 1 + i, Status: true}
+		}
+		return m
+	}
+	return &regcenter.Router{
+		Descriptors: map[string]*metadata.Descriptor{
+			"/proto.greeter/sayhello": {
+				URI:    &metadata.URI{ServiceName: "proto.Greeter", Method: "SayHello"},
+				Splits: []metadata.Split{{Cluster: "", Weight: 1}, {Cluster: "canary", Weight: 1}},
+			},
+		},
+		Hosts: hosts("127.0.0.1"),
+		Clusters: map[string]*regcenter.Cluster{
+			"canary": {Name: "canary", Hosts: hosts("127.0.0.2"), Balance: config.LeastRequest},
+		},
+	}
+}
+
+/*
+the pools follow the router as the mash does, the removed pools are drained
+*/
+type testpools struct {
+	mu     sync.Mutex
+	pools  atomic.Pointer[map[string]pool.Pool]
+	logger *zerolog.Logger
+}
+
+func (p *testpools) sync(router *regcenter.Router) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := make(map[string]pool.Pool)
+	if current := p.pools.Load(); current != nil {
+		old = *current
+	}
+	pools := make(map[string]pool.Pool)
+	for host := range router.AllHosts() {
+		if v, ok := old[host]; ok {
+			pools[host] = v
+		} else if v, err := pool.New(host, pool.Options{Dial: pool.Dial, MaxIdle: 1, MaxActive: 2, MaxConcurrentStreams: 4, Reuse: true}, p.logger); err == nil {
+			pools[host] = v
+		}
+	}
+	p.pools.Store(&pools)
+	for host, v := range old {
+		if _, ok := pools[host]; !ok {
+			go v.Drain(10 * time.Millisecond)
+		}
+	}
+}
+
+func (p *testpools) get(host string) (pool.Conn, error) {
+	if v, ok := (*p.pools.Load())[host]; ok {
+		return v.Get()
+	}
+	return nil, status.Error(codes.Unavailable, config.NOPOOL)
+}
+
+/*
+the requests are balanced while the hosts are added and removed by the RegContext and the whole router is swapped,
+it is run with -race to check the copy on write of the router, the balances and the pools
+*/
+func TestRouterServiceConcurrentUpdate(t *testing.T) {
+	logger := zerolog.Nop()
+	pools := &testpools{logger: &logger}
+	center := &testcenter{router: testrouter()}
+	pools.sync(center.router)
+	rs := NewRouterService(&logger, config.Grpc, WithBalance(config.WeightRobin), WithRegCenter(center), WithUpdateListener(pools.sync))
+	defer rs.Stop()
+
+	var (
+		wg       sync.WaitGroup
+		stop     = make(chan struct{})
+		requests atomic.Int64
+	)
+	unit := rs.MatcherUnit()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				data := &metadata.MetaData{
+					Descriptor: &metadata.Descriptor{URI: &metadata.URI{ServiceName: "proto.Greeter", Method: "SayHello"}},
+					Logger:     &logger,
+				}
+				if err := unit(context.Background(), data); err != nil {
+					if status.Code(err) != codes.Unavailable {
+						t.Errorf("the match is failed: %v", err)
+						return
+					}
+					continue
+				}
+				if conn, err := pools.get(data.Target); err == nil {
+					conn.Close()
+				}
+				rs.Record(data.Target, nil, time.Millisecond)
+				if rs.Retarget(data, []string{data.Target}) {
+					data.Finish(nil)
+				}
+				requests.Add(1)
+			}
+		}()
+	}
+
+	ctx := &regcenter.RegContext{Modify: rs.Modify, Update: rs.Update}
+	for i := 0; i < 200; i++ {
+		addr := fmt.Sprintf("127.0.0.3:%v", 9000+i%5)
+		switch i % 5 {
+		case 0:
+			ctx.SetHost(regcenter.HostInfo{Host: addr, Weight: 2, Status: true})
+		case 1:
+			ctx.RemoveHost(addr)
+			ctx.RemoveHost("127.0.0.1:9000")
+		case 2:
+			ctx.SetClusterHost("canary", regcenter.HostInfo{Host: addr, Weight: 1, Status: true})
+		case 3:
+			ctx.RemoveClusterHost("canary", "127.0.0.2:9001")
+		case 4:
+			router := testrouter()
+			//the balance of the cluster is created again when its type is changed
+			if i%10 == 4 {
+				router.Clusters["canary"].Balance = config.RoundRobin
+			}
+			ctx.Update(router, nil)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if requests.Load() == 0 {
+		t.Fatal("no request is balanced")
+	}
+	router := rs.GetRouter()
+	for host := range router.AllHosts() {
+		if _, ok := (*pools.pools.Load())[host]; !ok {
+			t.Fatalf("the pool of %v is not created", host)
+		}
+	}
+	if got := len(rs.balance.GetAllAddress()); got != len(router.Hosts) {
+		t.Fatalf("the balance has %v hosts, the router has %v", got, len(router.Hosts))
+	}
+	if got := len(rs.getbalances()["canary"].GetAllAddress()); got != len(router.Clusters["canary"].Hosts) {
+		t.Fatalf("the balance of the cluster has %v hosts, the router has %v", got, len(router.Clusters["canary"].Hosts))
+	}
+}